@@ -0,0 +1,348 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Options configure an S3-compatible storage such as MinIO
+type S3Options struct {
+	Endpoint  string `yaml:"endpoint"` // e.g. http://localhost:9000
+	Region    string `yaml:"region"`
+	Bucket    string `yaml:"bucket"`
+	Prefix    string `yaml:"prefix"`    // prepended to the hashes
+	AccessKey string `yaml:"accessKey"` // or $AWS_ACCESS_KEY_ID
+	SecretKey string `yaml:"secretKey"` // or $AWS_SECRET_ACCESS_KEY
+	PathStyle bool   `yaml:"pathStyle"` // endpoint/bucket/key, as MinIO
+}
+
+const (
+	DEFAULT_S3_REGION = "us-east-1"
+	EMPTY_SHA256      = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// S3Store keeps contents as objects of a bucket, signed with AWS
+// Signature Version 4
+type S3Store struct {
+	S3Options
+	base   *url.URL
+	Client *http.Client
+	now    func() time.Time
+}
+
+func NewS3Store(opts S3Options) (*S3Store, error) {
+	if opts.Bucket == "" {
+		return nil, fmt.Errorf("s3: missing bucket")
+	}
+	if opts.Region == "" {
+		opts.Region = DEFAULT_S3_REGION
+	}
+	if opts.AccessKey == "" {
+		opts.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if opts.SecretKey == "" {
+		opts.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	base, err := url.Parse(opts.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if base.Scheme == "" || base.Host == "" {
+		return nil, fmt.Errorf("s3: wrong endpoint: %s", opts.Endpoint)
+	}
+	return &S3Store{S3Options: opts, base: base, Client: http.DefaultClient, now: time.Now}, nil
+}
+
+// url returns the URL of the object key, or of the bucket for ""
+func (s *S3Store) url(key string, query url.Values) *url.URL {
+	u := *s.base
+	if s.PathStyle {
+		u.Path = "/" + s.Bucket
+		if key != "" {
+			u.Path += "/" + key
+		}
+	} else {
+		u.Host = s.Bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	u.RawQuery = canonicalQuery(query)
+	return &u
+}
+
+// s3Escape escapes as the canonical requests of Signature Version 4
+func s3Escape(s string, slash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !slash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func canonicalQuery(query url.Values) string {
+	var params []string
+	for k, vs := range query {
+		for _, v := range vs {
+			params = append(params, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(s))
+	return m.Sum(nil)
+}
+
+// sign adds the Authorization header to req whose body has the sha256
+// payload; host and all headers set are signed
+func (s *S3Store) sign(req *http.Request, payload string) {
+	now := s.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, vs := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(vs, ","))
+	}
+	var names []string
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonical strings.Builder
+	for _, k := range names {
+		canonical.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	creq := strings.Join([]string{
+		req.Method,
+		s3Escape(req.URL.Path, false),
+		canonicalQuery(req.URL.Query()),
+		canonical.String(),
+		signed,
+		payload,
+	}, "\n")
+	scope := day + "/" + s.Region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(creq))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), day)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signed, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+// s3Error is the body of a failed request
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// do sends a signed request and checks its status; a missing object gives
+// an os.ErrNotExist
+func (s *S3Store) do(method, key string, query url.Values, body io.Reader, size int64, payload string) (*http.Response, error) {
+	return s.doWith(method, key, query, nil, body, size, payload)
+}
+
+// doWith is do with the headers hdr
+func (s *S3Store) doWith(method, key string, query url.Values, hdr http.Header, body io.Reader, size int64, payload string) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.url(key, query).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, vs := range hdr {
+		req.Header[k] = vs
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	s.sign(req, payload)
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, &os.PathError{Op: strings.ToLower(method), Path: key, Err: os.ErrNotExist}
+	}
+	var e s3Error
+	data, _ := ioutil.ReadAll(resp.Body)
+	if xml.Unmarshal(data, &e) == nil && e.Code != "" {
+		return nil, fmt.Errorf("s3: %s %s: %s: %s", method, key, e.Code, e.Message)
+	}
+	return nil, fmt.Errorf("s3: %s %s: %s", method, key, resp.Status)
+}
+
+// s3Object reads an object from where it is sought with ranged requests
+type s3Object struct {
+	s         *S3Store
+	key       string
+	size, pos int64
+	body      io.ReadCloser
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.pos >= o.size {
+		return 0, io.EOF
+	}
+	if o.body == nil {
+		hdr := http.Header{}
+		if o.pos > 0 {
+			hdr.Set("Range", fmt.Sprintf("bytes=%d-", o.pos))
+		}
+		resp, err := o.s.doWith(http.MethodGet, o.key, nil, hdr, nil, 0, EMPTY_SHA256)
+		if err != nil {
+			return 0, err
+		}
+		o.body = resp.Body
+	}
+	n, err := o.body.Read(p)
+	o.pos += int64(n)
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	pos := offset
+	switch whence {
+	case io.SeekCurrent:
+		pos += o.pos
+	case io.SeekEnd:
+		pos += o.size
+	}
+	if pos < 0 {
+		return o.pos, fmt.Errorf("s3: seek before the start")
+	}
+	if pos != o.pos && o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+	o.pos = pos
+	return pos, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body == nil {
+		return nil
+	}
+	return o.body.Close()
+}
+
+func (s *S3Store) Put(hash, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	// the content is named by its sha256, which is the payload signed
+	resp, err := s.do(http.MethodPut, s.Prefix+hash, nil, f, fi.Size(), hash)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (s *S3Store) Open(hash string) (BlobReader, error) {
+	info, err := s.Stat(hash)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Object{s: s, key: s.Prefix + hash, size: info.Size}, nil
+}
+
+func (s *S3Store) Stat(hash string) (*BlobInfo, error) {
+	resp, err := s.do(http.MethodHead, s.Prefix+hash, nil, nil, 0, EMPTY_SHA256)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	info := &BlobInfo{Hash: hash, Size: resp.ContentLength}
+	info.ModTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	return info, nil
+}
+
+func (s *S3Store) Remove(hash string) error {
+	// S3 deletes missing objects silently
+	if _, err := s.Stat(hash); err != nil {
+		return err
+	}
+	resp, err := s.do(http.MethodDelete, s.Prefix+hash, nil, nil, 0, EMPTY_SHA256)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// listBucketResult is a page of ListObjectsV2
+type listBucketResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *S3Store) List() ([]BlobInfo, error) {
+	blobs := []BlobInfo{}
+	query := url.Values{"list-type": {"2"}}
+	if s.Prefix != "" {
+		query.Set("prefix", s.Prefix)
+	}
+	for {
+		resp, err := s.do(http.MethodGet, "", query, nil, 0, EMPTY_SHA256)
+		if err != nil {
+			return nil, err
+		}
+		var page listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range page.Contents {
+			hash := strings.TrimPrefix(o.Key, s.Prefix)
+			if !blobHash.MatchString(hash) {
+				continue
+			}
+			blobs = append(blobs, BlobInfo{hash, o.Size, o.LastModified})
+		}
+		if !page.IsTruncated {
+			return blobs, nil
+		}
+		query.Set("continuation-token", page.NextContinuationToken)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/labstack/echo/v4"
+)
+
+// contentEncoders compress downloads on the fly by Content-Encoding
+var contentEncoders = map[string]func(io.Writer) io.WriteCloser{
+	"gzip": func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+	"br":   func(w io.Writer) io.WriteCloser { return brotli.NewWriter(w) },
+}
+
+// MIN_COMPRESS_SIZE is the smallest content compressed
+const MIN_COMPRESS_SIZE = 1024
+
+// checkEncodings checks that the configured encodings are available
+func checkEncodings(encodings []string) error {
+	for _, enc := range encodings {
+		if _, ok := contentEncoders[enc]; !ok {
+			return fmt.Errorf("unsupported compression: %s", enc)
+		}
+	}
+	return nil
+}
+
+// acceptEncoding returns the first of encodings that the Accept-Encoding
+// header s accepts, or ""
+func acceptEncoding(s string, encodings []string) string {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(s, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, _ = strconv.ParseFloat(param[2:], 64)
+			}
+		}
+		accepted[name] = q > 0
+	}
+	for _, enc := range encodings {
+		if ok, found := accepted[enc]; ok || (!found && accepted["*"]) {
+			return enc
+		}
+	}
+	return ""
+}
+
+// etagMatch reports whether the If-None-Match header s lists one of etags
+// (by weak comparison)
+func etagMatch(s string, etags ...string) bool {
+	for _, tag := range strings.Split(s, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" {
+			return true
+		}
+		for _, etag := range etags {
+			if tag == etag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// contentDisposition gives an ASCII filename with the UTF-8 one of RFC 6266
+func contentDisposition(disposition, name string) string {
+	ascii := strings.Map(func(r rune) rune {
+		if r < 0x20 || r >= 0x7f || r == '"' || r == '\\' {
+			return '_'
+		}
+		return r
+	}, name)
+	s := fmt.Sprintf("%s; filename=%q", disposition, ascii)
+	if ascii != name {
+		s += "; filename*=UTF-8''" + url.PathEscape(name)
+	}
+	return s
+}
+
+func contentType(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".xml":
+		return "application/xml; charset=utf-8"
+	case "":
+		return echo.MIMEOctetStream
+	}
+	if t := mime.TypeByExtension(filepath.Ext(name)); t != "" {
+		return t
+	}
+	return echo.MIMEOctetStream
+}
+
+func compressible(ctype string) bool {
+	return strings.HasPrefix(ctype, "text/") || strings.Contains(ctype, "xml") ||
+		strings.Contains(ctype, "json")
+}
+
+// serveBlob sends a stored content as the file name last modified at
+// modtime. The sha256 makes a strong ETag; conditional requests give 304,
+// Range is supported and ?download=1 makes it an attachment. Whole
+// contents are compressed with the configured encodings.
+func (h *DbHandler) serveBlob(c echo.Context, hash, name string, modtime time.Time) error {
+	r, err := h.Blobs.Open(hash)
+	if os.IsNotExist(err) {
+		return notFound(c, "openblob", hash)
+	} else if err != nil {
+		return badRequest(c, "openblob", err)
+	}
+	defer r.Close()
+
+	req, hd := c.Request(), c.Response().Header()
+	etag := `"` + hash + `"`
+	ctype := contentType(name)
+	disposition := "inline"
+	if download, _ := strconv.ParseBool(c.QueryParam("download")); download {
+		disposition = "attachment"
+	}
+	hd.Set(echo.HeaderContentType, ctype)
+	hd.Set(echo.HeaderContentDisposition, contentDisposition(disposition, name))
+	hd.Set("Cache-Control", "no-cache")
+	hd.Set("Accept-Ranges", "bytes")
+	if len(h.Compression) > 0 && compressible(ctype) {
+		hd.Add(echo.HeaderVary, echo.HeaderAcceptEncoding)
+	}
+	modtime = modtime.UTC().Truncate(time.Second)
+	if !modtime.IsZero() {
+		hd.Set(echo.HeaderLastModified, modtime.Format(http.TimeFormat))
+	}
+
+	// the encoded representations have their own ETags
+	var etags []string
+	for _, enc := range h.Compression {
+		etags = append(etags, `"`+hash+"-"+enc+`"`)
+	}
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		if etagMatch(inm, append(etags, etag)...) {
+			hd.Set("ETag", etag)
+			return c.NoContent(http.StatusNotModified)
+		}
+	} else if ims, err := http.ParseTime(req.Header.Get("If-Modified-Since")); err == nil &&
+		!modtime.IsZero() && !modtime.After(ims) {
+		hd.Set("ETag", etag)
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	enc := ""
+	if req.Method == http.MethodGet && req.Header.Get("Range") == "" && compressible(ctype) {
+		enc = acceptEncoding(req.Header.Get(echo.HeaderAcceptEncoding), h.Compression)
+	}
+	if enc != "" {
+		if size, err := r.Seek(0, io.SeekEnd); err == nil && size < MIN_COMPRESS_SIZE {
+			enc = ""
+		}
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return badRequest(c, "seekblob", err)
+		}
+	}
+	if enc == "" {
+		hd.Set("ETag", etag)
+		http.ServeContent(c.Response(), req, name, modtime, r)
+		return nil
+	}
+
+	hd.Set("ETag", `"`+hash+"-"+enc+`"`)
+	hd.Set(echo.HeaderContentEncoding, enc)
+	c.Response().WriteHeader(http.StatusOK)
+	w := contentEncoders[enc](c.Response())
+	if _, err := io.Copy(w, r); err != nil {
+		c.Logger().Errorf("compress: %s: %s", hash, err)
+		return nil
+	}
+	return w.Close()
+}
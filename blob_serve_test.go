@@ -0,0 +1,98 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServeBlob(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobs-")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	store, _ := NewLocalStore(dir)
+	content := []byte("<TEI>" + strings.Repeat("いづれの御時にか", 100) + "</TEI>")
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:])
+	tmp := filepath.Join(dir, "tmp")
+	ioutil.WriteFile(tmp, content, 0644)
+	store.Put(hash, tmp)
+
+	h := &DbHandler{Blobs: store, Compression: []string{"gzip"}}
+	modtime := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+	e := echo.New()
+	get := func(hd map[string]string, query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/?"+query, nil)
+		for k, v := range hd {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		assert.NoError(t, h.serveBlob(e.NewContext(req, rec), hash, "源氏.xml", modtime))
+		return rec
+	}
+
+	rec := get(nil, "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, content, rec.Body.Bytes())
+	assert.Equal(t, `"`+hash+`"`, rec.Header().Get("ETag"))
+	assert.Equal(t, "application/xml; charset=utf-8", rec.Header().Get("Content-Type"))
+	assert.Equal(t, `inline; filename="__.xml"; filename*=UTF-8''%E6%BA%90%E6%B0%8F.xml`,
+		rec.Header().Get("Content-Disposition"))
+
+	rec = get(map[string]string{"If-None-Match": `W/"x", "` + hash + `"`}, "")
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+	rec = get(map[string]string{"If-Modified-Since": modtime.Format(http.TimeFormat)}, "")
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+	rec = get(map[string]string{"If-Modified-Since": modtime.Add(-time.Hour).Format(http.TimeFormat)}, "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = get(map[string]string{"Range": "bytes=0-4"}, "download=1")
+	assert.Equal(t, http.StatusPartialContent, rec.Code)
+	assert.Equal(t, "<TEI>", rec.Body.String())
+	assert.True(t, strings.HasPrefix(rec.Header().Get("Content-Disposition"), "attachment;"))
+
+	rec = get(map[string]string{"Accept-Encoding": "br;q=1, gzip;q=0.8"}, "")
+	assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	assert.Equal(t, `"`+hash+`-gzip"`, rec.Header().Get("ETag"))
+	zr, err := gzip.NewReader(rec.Body)
+	if assert.NoError(t, err) {
+		data, _ := ioutil.ReadAll(zr)
+		assert.Equal(t, content, data)
+	}
+	rec = get(map[string]string{"If-None-Match": `"` + hash + `-gzip"`}, "")
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+
+	h.Compression = []string{"br", "gzip"}
+	rec = get(map[string]string{"Accept-Encoding": "br;q=1, gzip;q=0.8"}, "")
+	assert.Equal(t, "br", rec.Header().Get("Content-Encoding"))
+	assert.Equal(t, `"`+hash+`-br"`, rec.Header().Get("ETag"))
+	data, err := ioutil.ReadAll(brotli.NewReader(rec.Body))
+	if assert.NoError(t, err) {
+		assert.Equal(t, content, data)
+	}
+	assert.NoError(t, checkEncodings(h.Compression))
+	assert.Error(t, checkEncodings([]string{"zstd"}))
+}
+
+func TestAcceptEncoding(t *testing.T) {
+	encs := []string{"br", "gzip"}
+	assert.Equal(t, "gzip", acceptEncoding("gzip, deflate", encs))
+	assert.Equal(t, "br", acceptEncoding("gzip, br", encs))
+	assert.Equal(t, "gzip", acceptEncoding("br;q=0, *", encs))
+	assert.Equal(t, "", acceptEncoding("identity", encs))
+	assert.Equal(t, "", acceptEncoding("", encs))
+}
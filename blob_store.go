@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// StorageOptions choose where file contents are stored
+type StorageOptions struct {
+	Backend string    `yaml:"backend"` // local (db.datapath) or s3
+	S3      S3Options `yaml:"s3"`
+}
+
+const (
+	STORAGE_LOCAL = "local"
+	STORAGE_S3    = "s3"
+)
+
+// BlobInfo describes a stored content
+type BlobInfo struct {
+	Hash    string
+	Size    int64
+	ModTime time.Time
+}
+
+// BlobReader reads a stored content from any position
+type BlobReader interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// blobHash matches the names of stored contents; List skips other files
+var blobHash = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// BlobStore stores file contents by their sha256. Missing contents give
+// errors for which os.IsNotExist holds.
+type BlobStore interface {
+	// Put stores the local file at path as hash; path is consumed
+	Put(hash, path string) error
+	Open(hash string) (BlobReader, error)
+	Stat(hash string) (*BlobInfo, error)
+	Remove(hash string) error
+	List() ([]BlobInfo, error)
+}
+
+func NewBlobStore(opts StorageOptions, datapath string) (BlobStore, error) {
+	switch opts.Backend {
+	case "", STORAGE_LOCAL:
+		return NewLocalStore(datapath)
+	case STORAGE_S3:
+		return NewS3Store(opts.S3)
+	}
+	return nil, fmt.Errorf("unknown storage backend: %s", opts.Backend)
+}
+
+// LocalStore keeps contents as files named by their hash in a directory
+type LocalStore struct {
+	Dir string
+}
+
+func NewLocalStore(dir string) (*LocalStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &LocalStore{Dir: dir}, nil
+}
+
+func (s *LocalStore) path(hash string) string {
+	return filepath.Join(s.Dir, hash)
+}
+
+func (s *LocalStore) Put(hash, path string) error {
+	return os.Rename(path, s.path(hash))
+}
+
+func (s *LocalStore) Open(hash string) (BlobReader, error) {
+	f, err := os.Open(s.path(hash))
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (s *LocalStore) Stat(hash string) (*BlobInfo, error) {
+	fi, err := os.Stat(s.path(hash))
+	if err != nil {
+		return nil, err
+	}
+	return &BlobInfo{hash, fi.Size(), fi.ModTime()}, nil
+}
+
+func (s *LocalStore) Remove(hash string) error {
+	return os.Remove(s.path(hash))
+}
+
+func (s *LocalStore) List() ([]BlobInfo, error) {
+	fis, err := ioutil.ReadDir(s.Dir)
+	if err != nil {
+		return nil, err
+	}
+	blobs := []BlobInfo{}
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() && blobHash.MatchString(fi.Name()) {
+			blobs = append(blobs, BlobInfo{fi.Name(), fi.Size(), fi.ModTime()})
+		}
+	}
+	return blobs, nil
+}
+
+// removeUnused removes a stored file no file or revision refers to
+func (h *DbHandler) removeUnused(hash string) error {
+	n, err := h.DbMap.SelectInt("SELECT (SELECT count(*) FROM files WHERE sha256 = $1) + "+
+		"(SELECT count(*) FROM file_revisions WHERE sha256 = $1)", hash)
+	if err != nil || n > 0 {
+		return err
+	}
+	return h.Blobs.Remove(hash)
+}
+
+// ReadFile returns the content of a stored file
+func (h *DbHandler) ReadFile(hash string) ([]byte, error) {
+	r, err := h.Blobs.Open(hash)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
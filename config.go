@@ -13,12 +13,28 @@ type config struct {
 		Port string
 	}
 	Db struct {
-		Driver   string
-		Dsn      string
-		Datapath string
+		Driver      string
+		Dsn         string
+		Datapath    string
+		Storage     StorageOptions    `yaml:"storage"`
+		Validation  ValidationOptions `yaml:"validation"`
+		Uploads     UploadOptions     `yaml:"uploads"`
+		Compression []string          `yaml:"compression"` // e.g. [gzip]
 	}
 	Mecab struct {
-		Dicts []string
+		Dicts        []string
+		Dictionaries map[string][]string `yaml:"dictionaries"`
+		Taggers      int
+		Parallel     int
+		ChunkSize    int               `yaml:"chunkSize"`
+		Languages    map[string]string `yaml:"languages"`
+		DetectLang   bool              `yaml:"detectLang"`
+		OffsetUnit   string            `yaml:"offsetUnit"`
+		Elements     ElementRules      `yaml:"elements"`
+		Normalize    NormalizeOptions  `yaml:"normalize"`
+		Keywords     KeywordOptions    `yaml:"keywords"`
+		Topics       TopicOptions      `yaml:"topics"`
+		Search       SearchOptions     `yaml:"search"`
 	}
 }
 
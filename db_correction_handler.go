@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-gorp/gorp/v3"
+	"github.com/labstack/echo/v4"
+)
+
+// Correction overrides MeCab output for the span [Start, End) of a file,
+// counted in characters of the original document.
+type Correction struct {
+	Id        int          `db:"id,primarykey,autoincrement" json:"id"`
+	Sha256    string       `db:"sha256,notnull" json:"sha256"`
+	Start     int          `db:"start_pos,notnull" json:"start"`
+	End       int          `db:"end_pos,notnull" json:"end"`
+	Surface   string       `db:"surface,notnull" json:"surface"`
+	Features  NodeFeatures `db:"features,notnull" json:"features"`
+	Corrector string       `db:"corrector,notnull" json:"corrector"`
+	Updated   time.Time    `db:"updated,notnull" json:"updated"`
+}
+
+var lockCorrection = sync.Mutex{}
+
+// SelectCorrections returns the corrections of a file ordered by span
+func (h *DbHandler) SelectCorrections(hash string) ([]Correction, error) {
+	var cs []Correction
+	_, err := h.DbMap.Select(&cs,
+		"SELECT * FROM corrections WHERE sha256 = $1 ORDER BY start_pos, end_pos",
+		hash)
+	return cs, err
+}
+
+func checkCorrection(cr *Correction) error {
+	if cr.Sha256 == "" {
+		return fmt.Errorf("sha256 is empty")
+	}
+	if cr.Start < 0 || cr.End <= cr.Start {
+		return fmt.Errorf("wrong span: %d-%d", cr.Start, cr.End)
+	}
+	if cr.Corrector == "" {
+		return fmt.Errorf("corrector is empty")
+	}
+	return nil
+}
+
+// overlapping returns the id of a correction overlapping cr, if any
+func (h *DbHandler) overlapping(cr *Correction) (int, error) {
+	ids, err := h.DbMap.SelectInt(
+		"SELECT COALESCE(MIN(id), 0) FROM corrections WHERE sha256 = $1 AND id <> $2 AND start_pos < $3 AND end_pos > $4",
+		cr.Sha256, cr.Id, cr.End, cr.Start)
+	return int(ids), err
+}
+
+// remapCorrections moves corrections of a content to the same characters
+// in another, given the edits between them; corrections over characters
+// changed are dropped
+func remapCorrections(cs []Correction, edits []TextEdit) []Correction {
+	type run struct{ a, b, n int } // equal characters at a and b
+	var runs []run
+	a, b := 0, 0
+	for _, e := range edits {
+		n := utf8.RuneCountInString(e.Text)
+		switch e.Op {
+		case "equal":
+			runs = append(runs, run{a, b, n})
+			a, b = a+n, b+n
+		case "delete":
+			a += n
+		case "insert":
+			b += n
+		}
+	}
+	moved := []Correction{}
+	for _, cr := range cs {
+		i := sort.Search(len(runs), func(i int) bool { return runs[i].a+runs[i].n >= cr.End })
+		if i == len(runs) || runs[i].a > cr.Start {
+			continue
+		}
+		cr.Start += runs[i].b - runs[i].a
+		cr.End += runs[i].b - runs[i].a
+		moved = append(moved, cr)
+	}
+	return moved
+}
+
+// moveCorrections copies the corrections of the content prev to the new
+// content of f, unless it has some already, and returns how many of
+// them were kept. Those of prev stay for its revision.
+func (h *DbHandler) moveCorrections(trans *gorp.Transaction, prev string, f *File) (int, int, error) {
+	lockCorrection.Lock()
+	defer lockCorrection.Unlock()
+
+	var cs []Correction
+	if _, err := trans.Select(&cs,
+		"SELECT * FROM corrections WHERE sha256 = $1 ORDER BY start_pos, end_pos", prev); err != nil {
+		return 0, 0, err
+	}
+	if len(cs) == 0 {
+		return 0, 0, nil
+	}
+	n, err := trans.SelectInt("SELECT count(*) FROM corrections WHERE sha256 = $1", f.Sha256)
+	if err != nil || n > 0 {
+		return 0, len(cs), err
+	}
+	before, err := h.ReadFile(prev)
+	if err != nil {
+		return 0, len(cs), err
+	}
+	after, err := h.ReadFile(f.Sha256)
+	if err != nil {
+		return 0, len(cs), err
+	}
+	moved := remapCorrections(cs, diffText(string(before), string(after)))
+	for idx := range moved {
+		cr := &moved[idx]
+		cr.Id, cr.Sha256 = 0, f.Sha256
+		if err := trans.Insert(cr); err != nil {
+			return 0, len(cs), err
+		}
+	}
+	return len(moved), len(cs), nil
+}
+
+// GET
+func (h *DbHandler) GetAllCorrections(c echo.Context) error {
+	var (
+		cs  []Correction
+		err error
+	)
+	if hash := c.QueryParam("sha256"); hash != "" {
+		cs, err = h.SelectCorrections(hash)
+	} else {
+		_, err = h.DbMap.Select(&cs,
+			"SELECT * FROM corrections ORDER BY updated desc")
+	}
+	if err != nil {
+		return badRequest(c, "selectcorrections", err)
+	}
+	return c.JSON(http.StatusOK, cs)
+}
+
+func (h *DbHandler) GetCorrection(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return badRequest(c, "atoi", err)
+	}
+	obj, err := h.DbMap.Get(Correction{}, id)
+	if err != nil {
+		return badRequest(c, "getcorrection", err)
+	}
+	if obj == nil {
+		return notFound(c, "getcorrection", strconv.Itoa(id))
+	}
+	return c.JSON(http.StatusOK, obj.(*Correction))
+}
+
+// POST
+func (h *DbHandler) CreateCorrection(c echo.Context) error {
+	lockCorrection.Lock()
+	defer lockCorrection.Unlock()
+
+	cr := &Correction{}
+	if err := c.Bind(cr); err != nil {
+		return badRequest(c, "bind", err)
+	}
+	cr.Id = 0
+	cr.Updated = time.Now()
+
+	if err := checkCorrection(cr); err != nil {
+		return badRequest(c, "bind", err)
+	}
+	if id, err := h.overlapping(cr); err != nil {
+		return badRequest(c, "overlapping", err)
+	} else if id != 0 {
+		return badRequest(c, "overlapping",
+			fmt.Errorf("overlaps correction: %d", id))
+	}
+
+	if err := h.DbMap.Insert(cr); err != nil {
+		return badRequest(c, "insert", err)
+	}
+	c.Logger().Infof("added: corrections: %d", cr.Id)
+	return c.JSON(http.StatusCreated, cr)
+}
+
+// PUT
+func (h *DbHandler) UpdateCorrection(c echo.Context) error {
+	lockCorrection.Lock()
+	defer lockCorrection.Unlock()
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return badRequest(c, "atoi", err)
+	}
+	cr := &Correction{}
+	if err := c.Bind(cr); err != nil {
+		return badRequest(c, "bind", err)
+	}
+	cr.Id = id
+	cr.Updated = time.Now()
+
+	if err := checkCorrection(cr); err != nil {
+		return badRequest(c, "bind", err)
+	}
+	if oid, err := h.overlapping(cr); err != nil {
+		return badRequest(c, "overlapping", err)
+	} else if oid != 0 {
+		return badRequest(c, "overlapping",
+			fmt.Errorf("overlaps correction: %d", oid))
+	}
+
+	count, err := h.DbMap.Update(cr)
+	if err != nil {
+		return badRequest(c, "update", err)
+	}
+	if count != 1 {
+		return badRequest(c, "update",
+			fmt.Errorf("something wrong: update: %d", count))
+	}
+
+	c.Logger().Infof("updated: corrections: %d", cr.Id)
+	return c.JSON(http.StatusCreated, cr)
+}
+
+// DELETE
+func (h *DbHandler) DeleteCorrection(c echo.Context) error {
+	lockCorrection.Lock()
+	defer lockCorrection.Unlock()
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return badRequest(c, "atoi", err)
+	}
+	count, err := h.DbMap.Delete(&Correction{Id: id})
+	if err != nil {
+		return badRequest(c, "deletecorrection", err)
+	}
+	if count != 1 {
+		return notFound(c, "deletecorrection", strconv.Itoa(id))
+	}
+
+	c.Logger().Infof("deleted: corrections: %d", id)
+	return c.JSON(http.StatusOK, map[string]int{"id": id})
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRemapCorrections(t *testing.T) {
+	cs := []Correction{
+		{Id: 1, Start: 0, End: 2, Surface: "いづ"},
+		{Id: 2, Start: 4, End: 6, Surface: "御時"},
+		{Id: 3, Start: 6, End: 8, Surface: "にか"},
+	}
+	moved := remapCorrections(cs, diffText("いづれの御時にか", "いづれの帝の御時にや"))
+	if assert.Len(t, moved, 2) {
+		assert.Equal(t, Correction{Id: 1, Start: 0, End: 2, Surface: "いづ"}, moved[0])
+		assert.Equal(t, Correction{Id: 2, Start: 6, End: 8, Surface: "御時"}, moved[1])
+	}
+	assert.Empty(t, remapCorrections(cs, diffText("いづれの御時にか", "")))
+}
@@ -6,6 +6,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/go-gorp/gorp/v3"
 	"github.com/labstack/echo/v4"
 )
 
@@ -18,36 +19,36 @@ type Entity struct {
 }
 
 type EntityAltLabel struct {
-	EntityID string `db:"entity_id,notnull" json"entityID"`
+	EntityID string `db:"entity_id,notnull" json:"entityID"`
 	AltLabel string `db:"alt_label,notnull" json:"altLabel"`
 }
 
 type EntityExactMatch struct {
-	EntityID   string `db:"entity_id,notnull" json"entityID"`
+	EntityID   string `db:"entity_id,notnull" json:"entityID"`
 	ExactMatch string `db:"exact_match,notnull" json:"exactMatch"`
 }
 
 var lockEntity = sync.Mutex{}
 
-// GET
-func (h *DbHandler) GetAllEntities(c echo.Context) error {
+// selectEntities returns all entities with their labels and matches
+func (h *DbHandler) selectEntities() ([]Entity, error) {
 	var entities []Entity
 	_, err := h.DbMap.Select(&entities,
 		"SELECT id, type, updated FROM entities ORDER BY updated")
 	if err != nil {
-		return badRequest(c, "selectentities", err)
+		return nil, err
 	}
 	var entityAltLabels []EntityAltLabel
 	_, err = h.DbMap.Select(&entityAltLabels,
 		"SELECT entity_id, alt_label FROM entities_alt_labels")
 	if err != nil {
-		return badRequest(c, "selectentities", err)
+		return nil, err
 	}
 	var entityExactMatches []EntityExactMatch
 	_, err = h.DbMap.Select(&entityExactMatches,
 		"SELECT entity_id, exact_match FROM entities_exact_matches")
 	if err != nil {
-		return badRequest(c, "selectentities", err)
+		return nil, err
 	}
 	al := map[string][]string{}
 	for _, el := range entityAltLabels {
@@ -69,9 +70,68 @@ func (h *DbHandler) GetAllEntities(c echo.Context) error {
 			entities[idx].ExactMatches = []string{}
 		}
 	}
+	return entities, nil
+}
+
+// insertEntity inserts e with its labels and matches
+func insertEntity(trans *gorp.Transaction, e *Entity) error {
+	if err := trans.Insert(e); err != nil {
+		return err
+	}
+	for _, s := range e.AltLabels {
+		al := &EntityAltLabel{
+			EntityID: e.ID,
+			AltLabel: s,
+		}
+		if err := trans.Insert(al); err != nil {
+			return err
+		}
+	}
+	for _, s := range e.ExactMatches {
+		em := &EntityExactMatch{
+			EntityID:   e.ID,
+			ExactMatch: s,
+		}
+		if err := trans.Insert(em); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GET
+func (h *DbHandler) GetAllEntities(c echo.Context) error {
+	entities, err := h.selectEntities()
+	if err != nil {
+		return badRequest(c, "selectentities", err)
+	}
+
+	// ?label= matches id or altLabels ignoring kanji variants
+	if label := c.QueryParam("label"); label != "" {
+		matched := []Entity{}
+		for _, e := range entities {
+			if h.matchEntityLabel(e, label) {
+				matched = append(matched, e)
+			}
+		}
+		entities = matched
+	}
 	return c.JSON(http.StatusOK, entities)
 }
 
+func (h *DbHandler) matchEntityLabel(e Entity, label string) bool {
+	label = h.Variants.Normalize(label)
+	if h.Variants.Normalize(e.ID) == label {
+		return true
+	}
+	for _, al := range e.AltLabels {
+		if h.Variants.Normalize(al) == label {
+			return true
+		}
+	}
+	return false
+}
+
 func (h *DbHandler) GetEntity(c echo.Context) error {
 	id := c.Param("id")
 	obj, err := h.DbMap.Get(Entity{}, id)
@@ -116,33 +176,73 @@ func (h *DbHandler) CreateEntity(c echo.Context) error {
 	if err != nil {
 		return badRequest(c, "trans", err)
 	}
-	if err = trans.Insert(e); err != nil {
+	if err = insertEntity(trans, e); err != nil {
 		return badRequest(c, "insert", err)
 	}
-	for _, s := range e.AltLabels {
-		al := &EntityAltLabel{
-			EntityID: e.ID,
-			AltLabel: s,
+	if err = trans.Commit(); err != nil {
+		return badRequest(c, "trans", err)
+	}
+
+	c.Logger().Infof("added: entities: %s", e.ID)
+	return c.JSON(http.StatusCreated, e)
+}
+
+// CreateEntities adds entities in bulk, e.g. from proper-noun candidates.
+// Entities whose id exists already are skipped.
+func (h *DbHandler) CreateEntities(c echo.Context) error {
+	lockEntity.Lock()
+	defer lockEntity.Unlock()
+
+	var es []Entity
+	if err := c.Bind(&es); err != nil {
+		return badRequest(c, "bind", err)
+	}
+	now := time.Now()
+	for idx := range es {
+		if es[idx].ID == "" {
+			return badRequest(c, "bind", fmt.Errorf("%d: id is empty", idx))
 		}
-		if err = trans.Insert(al); err != nil {
-			return badRequest(c, "insert", err)
+		if es[idx].AltLabels == nil {
+			es[idx].AltLabels = []string{}
+		}
+		if es[idx].ExactMatches == nil {
+			es[idx].ExactMatches = []string{}
 		}
+		es[idx].Updated = now
 	}
-	for _, s := range e.ExactMatches {
-		em := &EntityExactMatch{
-			EntityID:   e.ID,
-			ExactMatch: s,
+
+	trans, err := h.DbMap.Begin()
+	if err != nil {
+		return badRequest(c, "trans", err)
+	}
+	created, skipped := []Entity{}, []string{}
+	for idx := range es {
+		e := &es[idx]
+		n, err := trans.SelectInt(
+			"SELECT count(*) FROM entities WHERE id = $1", e.ID)
+		if err != nil {
+			trans.Rollback()
+			return badRequest(c, "selectentities", err)
 		}
-		if err = trans.Insert(em); err != nil {
-			return badRequest(c, "insert", err)
+		if n > 0 {
+			skipped = append(skipped, e.ID)
+			continue
+		}
+		if err = insertEntity(trans, e); err != nil {
+			trans.Rollback()
+			return badRequest(c, "insert", fmt.Errorf("%s: %s", e.ID, err))
 		}
+		created = append(created, *e)
 	}
 	if err = trans.Commit(); err != nil {
 		return badRequest(c, "trans", err)
 	}
 
-	c.Logger().Infof("added: entities: %s", e.ID)
-	return c.JSON(http.StatusCreated, e)
+	c.Logger().Infof("added: entities: %d, skipped: %d", len(created), len(skipped))
+	return c.JSON(http.StatusCreated, map[string]interface{}{
+		"created": created,
+		"skipped": skipped,
+	})
 }
 
 // PUT
@@ -0,0 +1,548 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// xnode is an element or a non-space text node of a document to diff
+type xnode struct {
+	Name     string // "" for text
+	Attrs    []xml.Attr
+	Text     string
+	Children []*xnode
+	Path     string // /TEI[1]/text[1]/p[2] or .../text()[1]
+}
+
+func (n *xnode) id() string {
+	for _, a := range n.Attrs {
+		if a.Name.Space == xmlNamespace && a.Name.Local == "id" {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// parseTree parses data into a tree of elements and texts; space-only
+// texts, comments and processing instructions are left out
+func parseTree(data []byte) (*xnode, error) {
+	root := &xnode{}
+	stack := []*xnode{root}
+	counts := []map[string]int{{}}
+	d := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		parent := stack[len(stack)-1]
+		switch t := tok.(type) {
+		case xml.StartElement:
+			name := t.Name.Local
+			counts[len(counts)-1][name]++
+			n := &xnode{
+				Name: name,
+				Path: fmt.Sprintf("%s/%s[%d]", parent.Path, name, counts[len(counts)-1][name]),
+			}
+			for _, a := range t.Attr {
+				if a.Name.Space != "xmlns" && a.Name.Local != "xmlns" {
+					n.Attrs = append(n.Attrs, a)
+				}
+			}
+			sort.Slice(n.Attrs, func(i, j int) bool {
+				return attrName(n.Attrs[i]) < attrName(n.Attrs[j])
+			})
+			parent.Children = append(parent.Children, n)
+			stack = append(stack, n)
+			counts = append(counts, map[string]int{})
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+			counts = counts[:len(counts)-1]
+		case xml.CharData:
+			if len(bytes.TrimSpace(t)) == 0 || len(stack) == 1 {
+				continue
+			}
+			// texts split by comments or the like are joined
+			if last := len(parent.Children) - 1; last >= 0 && parent.Children[last].Name == "" {
+				parent.Children[last].Text += string(t)
+				continue
+			}
+			counts[len(counts)-1][""]++
+			parent.Children = append(parent.Children, &xnode{
+				Text: string(t),
+				Path: fmt.Sprintf("%s/text()[%d]", parent.Path, counts[len(counts)-1][""]),
+			})
+		}
+	}
+	return root, nil
+}
+
+// String serializes n as XML
+func (n *xnode) String() string {
+	var b strings.Builder
+	n.write(&b)
+	return b.String()
+}
+
+func (n *xnode) write(b *strings.Builder) {
+	if n.Name == "" {
+		xml.EscapeText(b, []byte(n.Text))
+		return
+	}
+	b.WriteString(n.startTag())
+	if len(n.Children) == 0 {
+		return
+	}
+	for _, ch := range n.Children {
+		ch.write(b)
+	}
+	b.WriteString("</" + n.Name + ">")
+}
+
+// startTag gives <name a="v"> or <name a="v"/> without children
+func (n *xnode) startTag() string {
+	var b strings.Builder
+	b.WriteString("<" + n.Name)
+	for _, a := range n.Attrs {
+		b.WriteString(" " + attrName(a) + `="`)
+		xml.EscapeText(&b, []byte(a.Value))
+		b.WriteString(`"`)
+	}
+	if len(n.Children) == 0 {
+		b.WriteString("/")
+	}
+	b.WriteString(">")
+	return b.String()
+}
+
+// MAX_DIFF_EDITS bounds the search of myers, whose memory grows with the
+// square of the number of edits
+const MAX_DIFF_EDITS = 2000
+
+// myers returns the pairs (i, j) of a longest common subsequence of
+// sequences of lengths n and m whose items are compared by eq. Past
+// MAX_DIFF_EDITS only the common prefix and suffix are paired, the
+// middle being replaced as a whole.
+func myers(n, m int, eq func(i, j int) bool) [][2]int {
+	// common prefix and suffix are matched before the search
+	pre := 0
+	for pre < n && pre < m && eq(pre, pre) {
+		pre++
+	}
+	suf := 0
+	for suf < n-pre && suf < m-pre && eq(n-1-suf, m-1-suf) {
+		suf++
+	}
+	var pairs [][2]int
+	for i := 0; i < pre; i++ {
+		pairs = append(pairs, [2]int{i, i})
+	}
+	N, M := n-pre-suf, m-pre-suf
+	eqm := func(i, j int) bool { return eq(pre+i, pre+j) }
+
+	max := N + M
+	v := make([]int, 2*max+2)
+	var trace [][]int // v[-d..d] before each step d
+	found := false
+search:
+	for d := 0; d <= max && d <= MAX_DIFF_EDITS; d++ {
+		trace = append(trace, append([]int(nil), v[max-d:max+d+1]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[max+k-1] < v[max+k+1]) {
+				x = v[max+k+1]
+			} else {
+				x = v[max+k-1] + 1
+			}
+			y := x - k
+			for x < N && y < M && eqm(x, y) {
+				x++
+				y++
+			}
+			v[max+k] = x
+			if x >= N && y >= M {
+				found = true
+				break search
+			}
+		}
+	}
+	if !found {
+		trace = nil
+	}
+
+	// backtrack through the furthest reaching paths
+	var middle [][2]int
+	x, y := N, M
+	for d := len(trace) - 1; d >= 0; d-- {
+		prevX, prevY := 0, 0 // the first snake starts at the origin
+		if d > 0 {
+			vp := trace[d] // vp[d+k] is v[k]
+			k := x - y
+			var prevK int
+			if k == -d || (k != d && vp[d+k-1] < vp[d+k+1]) {
+				prevK = k + 1
+			} else {
+				prevK = k - 1
+			}
+			prevX = vp[d+prevK]
+			prevY = prevX - prevK
+		}
+		for x > prevX && y > prevY {
+			x--
+			y--
+			middle = append(middle, [2]int{pre + x, pre + y})
+		}
+		x, y = prevX, prevY
+	}
+	for i := len(middle) - 1; i >= 0; i-- {
+		pairs = append(pairs, middle[i])
+	}
+	for i := 0; i < suf; i++ {
+		pairs = append(pairs, [2]int{n - suf + i, m - suf + i})
+	}
+	return pairs
+}
+
+// TextEdit is a run of characters kept, inserted or deleted
+type TextEdit struct {
+	Op   string `json:"op"` // equal, insert or delete
+	Text string `json:"text"`
+}
+
+// diffText compares a and b character by character
+func diffText(a, b string) []TextEdit {
+	ra, rb := []rune(a), []rune(b)
+	pairs := myers(len(ra), len(rb), func(i, j int) bool { return ra[i] == rb[j] })
+	var edits []TextEdit
+	add := func(op string, rs []rune) {
+		if len(rs) == 0 {
+			return
+		}
+		if last := len(edits) - 1; last >= 0 && edits[last].Op == op {
+			edits[last].Text += string(rs)
+			return
+		}
+		edits = append(edits, TextEdit{op, string(rs)})
+	}
+	i, j := 0, 0
+	for _, p := range append(pairs, [2]int{len(ra), len(rb)}) {
+		add("delete", ra[i:p[0]])
+		add("insert", rb[j:p[1]])
+		if p[0] < len(ra) {
+			add("equal", ra[p[0]:p[0]+1])
+		}
+		i, j = p[0]+1, p[1]+1
+	}
+	return edits
+}
+
+// DiffOp is an edit turning the base document into the other
+type DiffOp struct {
+	Op      string     `json:"op"` // delete, insert, attribute or text
+	Path    string     `json:"path,omitempty"`
+	NewPath string     `json:"newPath,omitempty"`
+	Name    string     `json:"name,omitempty"` // of the attribute
+	Old     string     `json:"old,omitempty"`
+	New     string     `json:"new,omitempty"`
+	Text    []TextEdit `json:"text,omitempty"`
+}
+
+// diffRow is a line of the side-by-side rendering
+type diffRow struct {
+	Depth       int
+	Left, Right string // HTML
+	Class       string // "", del, ins or mod
+}
+
+type xmlDiff struct {
+	Ops  []DiffOp
+	Rows []diffRow
+}
+
+// alignable elements have the same name and, when both have one, xml:id
+func alignable(a, b *xnode) bool {
+	if a.Name != b.Name {
+		return false
+	}
+	if a.Name == "" {
+		return true
+	}
+	ia, ib := a.id(), b.id()
+	return ia == "" || ib == "" || ia == ib
+}
+
+func (d *xmlDiff) lines(n *xnode, depth int, class string) {
+	if n.Name == "" || len(n.Children) == 0 {
+		s := html.EscapeString(n.String())
+		if class == "del" {
+			d.Rows = append(d.Rows, diffRow{depth, s, "", class})
+		} else {
+			d.Rows = append(d.Rows, diffRow{depth, "", s, class})
+		}
+		return
+	}
+	tag := html.EscapeString(n.startTag())
+	end := html.EscapeString("</" + n.Name + ">")
+	if class == "del" {
+		d.Rows = append(d.Rows, diffRow{depth, tag, "", class})
+	} else {
+		d.Rows = append(d.Rows, diffRow{depth, "", tag, class})
+	}
+	for _, ch := range n.Children {
+		d.lines(ch, depth+1, class)
+	}
+	if class == "del" {
+		d.Rows = append(d.Rows, diffRow{depth, end, "", class})
+	} else {
+		d.Rows = append(d.Rows, diffRow{depth, "", end, class})
+	}
+}
+
+// tagHTML renders the start tag of n marking the attributes in changed
+func tagHTML(n *xnode, changed map[string]bool, mark string) string {
+	var b strings.Builder
+	b.WriteString("&lt;" + html.EscapeString(n.Name))
+	for _, a := range n.Attrs {
+		s := html.EscapeString(fmt.Sprintf(` %s="%s"`, attrName(a), a.Value))
+		if changed[attrName(a)] {
+			s = "<" + mark + ">" + s + "</" + mark + ">"
+		}
+		b.WriteString(s)
+	}
+	if len(n.Children) == 0 {
+		b.WriteString("/")
+	}
+	b.WriteString("&gt;")
+	return b.String()
+}
+
+func (d *xmlDiff) element(a, b *xnode, depth int) {
+	av, bv := map[string]string{}, map[string]string{}
+	for _, at := range a.Attrs {
+		av[attrName(at)] = at.Value
+	}
+	for _, at := range b.Attrs {
+		bv[attrName(at)] = at.Value
+	}
+	var names []string
+	for name := range av {
+		names = append(names, name)
+	}
+	for name := range bv {
+		if _, ok := av[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	changed := map[string]bool{}
+	for _, name := range names {
+		was, okA := av[name]
+		now, okB := bv[name]
+		if okA && okB && was == now {
+			continue
+		}
+		changed[name] = true
+		d.Ops = append(d.Ops, DiffOp{Op: "attribute", Path: a.Path, NewPath: b.Path,
+			Name: name, Old: was, New: now})
+	}
+
+	class := ""
+	if len(changed) > 0 {
+		class = "mod"
+	}
+	if a.Name != "" && (len(a.Children) > 0 || len(b.Children) > 0) {
+		d.Rows = append(d.Rows, diffRow{depth,
+			strings.TrimSuffix(tagHTML(a, changed, "del"), "/&gt;") + "&gt;",
+			strings.TrimSuffix(tagHTML(b, changed, "ins"), "/&gt;") + "&gt;", class})
+	} else if a.Name != "" {
+		d.Rows = append(d.Rows, diffRow{depth,
+			tagHTML(a, changed, "del"), tagHTML(b, changed, "ins"), class})
+		return
+	}
+	d.children(a.Children, b.Children, depth+1)
+	if a.Name != "" {
+		end := html.EscapeString("</" + a.Name + ">")
+		d.Rows = append(d.Rows, diffRow{depth, end, end, ""})
+	}
+}
+
+func (d *xmlDiff) text(a, b *xnode, depth int) {
+	if a.Text == b.Text {
+		s := html.EscapeString(a.Text)
+		d.Rows = append(d.Rows, diffRow{depth, s, s, ""})
+		return
+	}
+	edits := diffText(a.Text, b.Text)
+	d.Ops = append(d.Ops, DiffOp{Op: "text", Path: a.Path, NewPath: b.Path,
+		Old: a.Text, New: b.Text, Text: edits})
+	var left, right strings.Builder
+	for _, e := range edits {
+		s := html.EscapeString(e.Text)
+		switch e.Op {
+		case "equal":
+			left.WriteString(s)
+			right.WriteString(s)
+		case "delete":
+			left.WriteString("<del>" + s + "</del>")
+		case "insert":
+			right.WriteString("<ins>" + s + "</ins>")
+		}
+	}
+	d.Rows = append(d.Rows, diffRow{depth, left.String(), right.String(), "mod"})
+}
+
+// children aligns two lists of siblings and compares the aligned nodes
+func (d *xmlDiff) children(as, bs []*xnode, depth int) {
+	pairs := myers(len(as), len(bs), func(i, j int) bool { return alignable(as[i], bs[j]) })
+	i, j := 0, 0
+	for _, p := range append(pairs, [2]int{len(as), len(bs)}) {
+		for ; i < p[0]; i++ {
+			d.Ops = append(d.Ops, DiffOp{Op: "delete", Path: as[i].Path, Old: as[i].String()})
+			d.lines(as[i], depth, "del")
+		}
+		for ; j < p[1]; j++ {
+			d.Ops = append(d.Ops, DiffOp{Op: "insert", NewPath: bs[j].Path, New: bs[j].String()})
+			d.lines(bs[j], depth, "ins")
+		}
+		if p[0] < len(as) {
+			if as[p[0]].Name == "" {
+				d.text(as[p[0]], bs[p[1]], depth)
+			} else {
+				d.element(as[p[0]], bs[p[1]], depth)
+			}
+		}
+		i, j = p[0]+1, p[1]+1
+	}
+}
+
+// diffXML compares two documents structurally
+func diffXML(a, b []byte) (*xmlDiff, error) {
+	ta, err := parseTree(a)
+	if err != nil {
+		return nil, fmt.Errorf("base: %s", err)
+	}
+	tb, err := parseTree(b)
+	if err != nil {
+		return nil, fmt.Errorf("against: %s", err)
+	}
+	d := &xmlDiff{Ops: []DiffOp{}}
+	d.children(ta.Children, tb.Children, 0)
+	return d, nil
+}
+
+const diffStyle = `table{border-collapse:collapse;width:100%;font-family:monospace}
+td{vertical-align:top;white-space:pre-wrap;padding:0 .5em;width:50%}
+tr.del td:first-child,del{background:#fdd}tr.ins td:last-child,ins{background:#dfd}
+tr.mod{background:#ffe}`
+
+// html renders the documents side by side
+func (d *xmlDiff) html(left, right string) string {
+	var b strings.Builder
+	b.WriteString("<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><style>" +
+		diffStyle + "</style></head><body><table>\n")
+	fmt.Fprintf(&b, "<tr><th>%s</th><th>%s</th></tr>\n",
+		html.EscapeString(left), html.EscapeString(right))
+	for _, r := range d.Rows {
+		indent := fmt.Sprintf(` style="padding-left:%.1fem"`, 0.5+float64(r.Depth))
+		fmt.Fprintf(&b, "<tr class=\"%s\"><td%s>%s</td><td%s>%s</td></tr>\n",
+			r.Class, indent, r.Left, indent, r.Right)
+	}
+	b.WriteString("</table></body></html>\n")
+	return b.String()
+}
+
+// revisionContent returns the label and sha256 of a file, or of one of its
+// revisions when rev > 0
+func (h *DbHandler) revisionContent(id, rev int) (string, string, error) {
+	if rev > 0 {
+		sha, err := h.DbMap.SelectStr(
+			"SELECT sha256 FROM file_revisions WHERE file_id = $1 AND number = $2", id, rev)
+		if err == nil && sha == "" {
+			err = fmt.Errorf("%d@%d not found", id, rev)
+		}
+		return fmt.Sprintf("%d@%d", id, rev), sha, err
+	}
+	sha, err := h.DbMap.SelectStr("SELECT sha256 FROM files WHERE id = $1", id)
+	if err == nil && sha == "" {
+		err = fmt.Errorf("%d not found", id)
+	}
+	return strconv.Itoa(id), sha, err
+}
+
+// parseRevision parses ID, ID@REV or @REV (a revision of the file id)
+func parseRevision(s string, id int) (int, int, error) {
+	var err error
+	at := strings.IndexByte(s, '@')
+	if at < 0 {
+		id, err = strconv.Atoi(s)
+		return id, 0, err
+	}
+	if at > 0 {
+		if id, err = strconv.Atoi(s[:at]); err != nil {
+			return 0, 0, err
+		}
+	}
+	rev, err := strconv.Atoi(s[at+1:])
+	return id, rev, err
+}
+
+// GET
+
+// GetFileDiff compares a file (or its revision ?rev=) with ?against=, a
+// file ID, ID@REV or @REV, as JSON edit operations or ?format=html
+func (h *DbHandler) GetFileDiff(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return badRequest(c, "atoi", err)
+	}
+	rev := 0
+	if s := c.QueryParam("rev"); s != "" {
+		if rev, err = strconv.Atoi(s); err != nil {
+			return badRequest(c, "atoi", err)
+		}
+	}
+	if c.QueryParam("against") == "" {
+		return badRequest(c, "against", fmt.Errorf("missing against"))
+	}
+	otherId, otherRev, err := parseRevision(c.QueryParam("against"), id)
+	if err != nil {
+		return badRequest(c, "against", err)
+	}
+
+	var labels, data [2]string
+	for idx, r := range [][2]int{{id, rev}, {otherId, otherRev}} {
+		label, sha, err := h.revisionContent(r[0], r[1])
+		if err != nil {
+			return badRequest(c, "getcontent", err)
+		}
+		b, err := h.ReadFile(sha)
+		if err != nil {
+			return badRequest(c, "readfile", err)
+		}
+		labels[idx], data[idx] = label, string(b)
+	}
+	d, err := diffXML([]byte(data[0]), []byte(data[1]))
+	if err != nil {
+		return badRequest(c, "diff", err)
+	}
+
+	if c.QueryParam("format") == "html" {
+		return c.HTML(http.StatusOK, d.html(labels[0], labels[1]))
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"base":    labels[0],
+		"against": labels[1],
+		"ops":     d.Ops,
+	})
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffText(t *testing.T) {
+	assert.Equal(t, []TextEdit{
+		{"equal", "花が"}, {"delete", "咲"}, {"insert", "散"}, {"equal", "く"},
+	}, diffText("花が咲く", "花が散く"))
+	assert.Equal(t, []TextEdit{{"insert", "abc"}}, diffText("", "abc"))
+	assert.Equal(t, []TextEdit{
+		{"equal", "a"}, {"delete", "b"}, {"equal", "c"}, {"insert", "d"},
+	}, diffText("abc", "acd"))
+
+	// past MAX_DIFF_EDITS the middle is replaced
+	a := "x" + strings.Repeat("a", MAX_DIFF_EDITS) + "y"
+	b := "x" + strings.Repeat("b", MAX_DIFF_EDITS) + "y"
+	assert.Equal(t, []TextEdit{
+		{"equal", "x"}, {"delete", a[1 : len(a)-1]}, {"insert", b[1 : len(b)-1]}, {"equal", "y"},
+	}, diffText(a, b))
+}
+
+func TestDiffXML(t *testing.T) {
+	a := `<TEI><text><body>
+<p xml:id="p1">春はあけぼの</p>
+<p xml:id="p2" rend="indent">夏は夜</p>
+<note>削除</note>
+</body></text></TEI>`
+	b := `<TEI><text><body>
+<p xml:id="p1">春はあけぼの<lb/></p>
+<p xml:id="p2" rend="none">夏は月</p>
+</body></text></TEI>`
+	d, err := diffXML([]byte(a), []byte(b))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []DiffOp{
+		{Op: "insert", NewPath: "/TEI[1]/text[1]/body[1]/p[1]/lb[1]", New: "<lb/>"},
+		{Op: "attribute", Path: "/TEI[1]/text[1]/body[1]/p[2]", NewPath: "/TEI[1]/text[1]/body[1]/p[2]",
+			Name: "rend", Old: "indent", New: "none"},
+		{Op: "text", Path: "/TEI[1]/text[1]/body[1]/p[2]/text()[1]",
+			NewPath: "/TEI[1]/text[1]/body[1]/p[2]/text()[1]", Old: "夏は夜", New: "夏は月",
+			Text: []TextEdit{{"equal", "夏は"}, {"delete", "夜"}, {"insert", "月"}}},
+		{Op: "delete", Path: "/TEI[1]/text[1]/body[1]/note[1]", Old: "<note>削除</note>"},
+	}, d.Ops)
+
+	page := d.html("1", "2")
+	assert.True(t, strings.Contains(page, "<del>夜</del>"))
+	assert.True(t, strings.Contains(page, `<ins> rend=&#34;none&#34;</ins>`))
+
+	_, err = diffXML([]byte(a), []byte("<TEI>"))
+	assert.Error(t, err)
+}
+
+func TestParseRevision(t *testing.T) {
+	for s, want := range map[string][2]int{"12": {12, 0}, "12@3": {12, 3}, "@2": {5, 2}} {
+		id, rev, err := parseRevision(s, 5)
+		assert.NoError(t, err)
+		assert.Equal(t, want, [2]int{id, rev}, s)
+	}
+	_, _, err := parseRevision("x", 5)
+	assert.Error(t, err)
+}
@@ -10,19 +10,25 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
 )
 
 type File struct {
-	Id      int       `db:"id,primarykey,autoincrement" json:"id"`
-	Name    string    `db:"name" json:"name"`
-	Path    string    `db:"path" json:"path"`
-	Size    int64     `db:"size" json:"size"`
-	Sha256  string    `db:"sha256,notnull" json:"sha256"`
-	Updated time.Time `db:"updated" json:"updated"`
+	Id         int               `db:"id,primarykey,autoincrement" json:"id"`
+	Name       string            `db:"name" json:"name"`
+	Path       string            `db:"path" json:"path"`
+	Size       int64             `db:"size" json:"size"`
+	Sha256     string            `db:"sha256,notnull" json:"sha256"`
+	Genre      string            `db:"genre" json:"genre"`
+	Keywords   Keywords          `db:"keywords" json:"keywords"`
+	Validation *ValidationReport `db:"validation" json:"validation,omitempty"`
+	Metadata   *TEIMetadata      `db:"metadata" json:"metadata,omitempty"`
+	Updated    time.Time         `db:"updated" json:"updated"`
 }
 
 var lockFile = sync.Mutex{}
@@ -35,6 +41,34 @@ func (h *DbHandler) GetAllFiles(c echo.Context) error {
 	if err != nil {
 		return badRequest(c, "select", err)
 	}
+
+	// ?name= matches ignoring kanji variants
+	if name := c.QueryParam("name"); name != "" {
+		matched := []File{}
+		for _, f := range files {
+			if h.Variants.Match(f.Name, name) {
+				matched = append(matched, f)
+			}
+		}
+		files = matched
+	}
+
+	// ?keyword= matches stored keywords ignoring kanji variants
+	if keyword := c.QueryParam("keyword"); keyword != "" {
+		keyword = h.Variants.Normalize(keyword)
+		matched := []File{}
+		for _, f := range files {
+			for _, k := range f.Keywords {
+				if h.Variants.Normalize(k.Lemma) == keyword {
+					matched = append(matched, f)
+					break
+				}
+			}
+		}
+		files = matched
+	}
+
+	files = h.matchMetadata(c, files)
 	return c.JSON(http.StatusOK, files)
 }
 
@@ -48,7 +82,7 @@ func (h *DbHandler) GetFile(c echo.Context) error {
 		return badRequest(c, "getfile", err)
 	}
 	if obj == nil {
-		return notFound(c, "getfile", string(id))
+		return notFound(c, "getfile", strconv.Itoa(id))
 	}
 	return c.JSON(http.StatusOK, obj.(*File))
 }
@@ -63,10 +97,10 @@ func (h *DbHandler) GetFileXML(c echo.Context) error {
 		return badRequest(c, "getfilexml", err)
 	}
 	if obj == nil {
-		return notFound(c, "getfilexml", string(id))
+		return notFound(c, "getfilexml", strconv.Itoa(id))
 	}
-	return c.Inline(filepath.Join(h.Datapath, obj.(*File).Sha256),
-		obj.(*File).Name)
+	f := obj.(*File)
+	return h.serveBlob(c, f.Sha256, f.Name, f.Updated)
 }
 
 func (h *DbHandler) GetFileXMLByName(c echo.Context) error {
@@ -76,7 +110,7 @@ func (h *DbHandler) GetFileXMLByName(c echo.Context) error {
 	if err != nil {
 		return badRequest(c, "selectone", err)
 	}
-	return c.Inline(filepath.Join(h.Datapath, f.Sha256), f.Name)
+	return h.serveBlob(c, f.Sha256, f.Name, f.Updated)
 }
 
 // POST
@@ -90,8 +124,76 @@ func (h *DbHandler) CreateFile(c echo.Context) error {
 	}
 	f.Updated = time.Now()
 
+	if err := h.receiveFile(c, &f); err != nil {
+		return err
+	}
+	if f.Name == "" {
+		name, err := url.PathUnescape(filepath.Base(f.Path))
+		if err != nil {
+			return badRequest(c, "unescape", err)
+		}
+		f.Name = name
+	}
+	if invalid, err := h.checkValid(c, &f); err != nil {
+		return err
+	} else if invalid != nil {
+		return c.JSON(http.StatusUnprocessableEntity, invalid)
+	}
+	if err := h.describeFile(&f); err != nil {
+		return badRequest(c, "describe", err)
+	}
+
+	if err := h.insertFile(c, &f, &revisionRequest{
+		Author:  c.FormValue("author"),
+		Message: c.FormValue("message"),
+	}); err != nil {
+		if err := h.removeUnused(f.Sha256); err != nil {
+			c.Logger().Errorf("remove: %s: %s", f.Sha256, err)
+		}
+		return err
+	}
+	h.indexFile(c, &f)
+	c.Logger().Infof("added: %d: %s", f.Id, f.Name)
+	return c.JSON(http.StatusCreated, f)
+}
+
+// insertFile adds f with its content as the first revision
+func (h *DbHandler) insertFile(c echo.Context, f *File, req *revisionRequest) error {
+	trans, err := h.DbMap.Begin()
+	if err != nil {
+		return badRequest(c, "trans", err)
+	}
+	if err := trans.Insert(f); err != nil {
+		trans.Rollback()
+		if err.Error() == "pq: duplicate key value violates unique constraint \"files_sha256_idx\"" {
+			return badRequest(c, "insert", fmt.Errorf("already exists: sha256: %s", f.Sha256))
+		}
+		return badRequest(c, "insert", err)
+	}
+	rev := &FileRevision{
+		FileId:  f.Id,
+		Number:  1,
+		Sha256:  f.Sha256,
+		Size:    f.Size,
+		Author:  req.Author,
+		Message: req.Message,
+		Created: f.Updated,
+	}
+	if err := trans.Insert(rev); err != nil {
+		trans.Rollback()
+		return badRequest(c, "insertrevision", err)
+	}
+	if err := trans.Commit(); err != nil {
+		return badRequest(c, "trans", err)
+	}
+	return nil
+}
+
+// receiveFile saves the content of f.Path (http(s)://) or of the form file
+// "file" and sets the Path, Size and Sha256 of f
+func (h *DbHandler) receiveFile(c echo.Context, f *File) error {
 	if f.Path != "" {
-		if f.Path[0:7] != "http://" && f.Path[0:8] != "https://" {
+		if !strings.HasPrefix(f.Path, "http://") && !strings.HasPrefix(f.Path, "https://") {
 			return badRequest(c, "wrongpath", fmt.Errorf("missing http(s)://"))
 		}
 		resp, err := http.Get(f.Path)
@@ -125,23 +227,41 @@ func (h *DbHandler) CreateFile(c echo.Context) error {
 			return badRequest(c, "savefile", err)
 		}
 	}
+	return nil
+}
 
-	if f.Name == "" {
-		name, err := url.PathUnescape(filepath.Base(f.Path))
-		if err != nil {
-			return badRequest(c, "unescape", err)
+// checkValid validates the content of f according to the configuration
+// and sets its report; a rejected content is removed unless in use
+func (h *DbHandler) checkValid(c echo.Context, f *File) (*invalidFile, error) {
+	report, err := h.validateStored(f)
+	if err != nil {
+		return nil, badRequest(c, "validate", err)
+	}
+	invalid := h.judgeValid(c, f, report)
+	if invalid != nil {
+		if err := h.removeUnused(f.Sha256); err != nil {
+			c.Logger().Errorf("remove: %s: %s", f.Sha256, err)
 		}
-		f.Name = name
 	}
+	return invalid, nil
+}
 
-	if err := h.DbMap.Insert(&f); err != nil {
-		if err.Error() == "pq: duplicate key value violates unique constraint \"files_sha256_idx\"" {
-			return badRequest(c, "insert", fmt.Errorf("already exists: sha256: %s", f.Sha256))
+// judgeValid sets the validation report of f, and returns the response
+// when the configuration rejects it
+func (h *DbHandler) judgeValid(c echo.Context, f *File, report *ValidationReport) *invalidFile {
+	if report != nil && !report.Valid {
+		if h.Validation.Mode == VALIDATION_REJECT {
+			c.Logger().Errorf("%d:invalidxml:%s", http.StatusUnprocessableEntity, f.Name)
+			return &invalidFile{
+				newHTTPError(http.StatusUnprocessableEntity, "invalidxml",
+					fmt.Sprintf("%s: %d errors", f.Name, len(report.Errors))),
+				report,
+			}
 		}
-		return badRequest(c, "insert", err)
+		c.Logger().Warnf("invalid: %s: %d errors", f.Name, len(report.Errors))
 	}
-	c.Logger().Infof("added: %d: %s", f.Id, f.Name)
-	return c.JSON(http.StatusCreated, f)
+	f.Validation = report
+	return nil
 }
 
 func (h *DbHandler) SaveFile(src io.Reader) (hash string, err error) {
@@ -160,7 +280,7 @@ func (h *DbHandler) SaveFile(src io.Reader) (hash string, err error) {
 	}
 	hash = fmt.Sprintf("%x", sha.Sum(nil))
 
-	err = os.Rename(tmpfile.Name(), filepath.Join(h.Datapath, hash))
+	err = h.Blobs.Put(hash, tmpfile.Name())
 	if err != nil {
 		return
 	}
@@ -168,18 +288,58 @@ func (h *DbHandler) SaveFile(src io.Reader) (hash string, err error) {
 	return
 }
 
+// fileUpdate is the body of a file update; the content fields may only
+// repeat the stored ones, as the content changes by a new revision
+type fileUpdate struct {
+	Name   *string `json:"name" form:"name"`
+	Genre  *string `json:"genre" form:"genre"`
+	Path   *string `json:"path" form:"path"`
+	Size   *int64  `json:"size" form:"size"`
+	Sha256 *string `json:"sha256" form:"sha256"`
+}
+
 // PUT
+
+// UpdateFile changes the name and genre of a file
 func (h *DbHandler) UpdateFile(c echo.Context) error {
 	lockFile.Lock()
 	defer lockFile.Unlock()
 
-	var f File
-	if err := c.Bind(&f); err != nil {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return badRequest(c, "atoi", err)
+	}
+	var req fileUpdate
+	if err := c.Bind(&req); err != nil {
 		return badRequest(c, "bind", err)
 	}
+	obj, err := h.DbMap.Get(File{}, id)
+	if err != nil {
+		return badRequest(c, "gettoupdate", err)
+	}
+	if obj == nil {
+		return notFound(c, "gettoupdate", strconv.Itoa(id))
+	}
+	f := obj.(*File)
+
+	if (req.Path != nil && *req.Path != f.Path) ||
+		(req.Size != nil && *req.Size != f.Size) ||
+		(req.Sha256 != nil && *req.Sha256 != f.Sha256) {
+		return badRequest(c, "content", fmt.Errorf(
+			"content not changed by an update: use POST /api/files/%d/revisions", f.Id))
+	}
+	if req.Name != nil {
+		if *req.Name == "" {
+			return badRequest(c, "name", fmt.Errorf("empty name"))
+		}
+		f.Name = *req.Name
+	}
+	if req.Genre != nil {
+		f.Genre = *req.Genre
+	}
 	f.Updated = time.Now()
 
-	count, err := h.DbMap.Update(&f)
+	count, err := h.DbMap.Update(f)
 	if err != nil {
 		return badRequest(c, "update", err)
 	}
@@ -187,6 +347,7 @@ func (h *DbHandler) UpdateFile(c echo.Context) error {
 		return badRequest(c, "update",
 			fmt.Errorf("something wrong: updated: %d", count))
 	}
+	h.indexFile(c, f)
 
 	c.Logger().Infof("updated: %d: %s", f.Id, f.Name)
 	return c.JSON(http.StatusCreated, f)
@@ -206,17 +367,43 @@ func (h *DbHandler) DeleteFile(c echo.Context) error {
 		return badRequest(c, "gettodelete", err)
 	}
 	if obj == nil {
-		return notFound(c, "gettodelete", string(id))
+		return notFound(c, "gettodelete", strconv.Itoa(id))
 	}
 
 	f := obj.(*File)
-	_, err = h.DbMap.Delete(f)
+	var hashes []string
+	if _, err = h.DbMap.Select(&hashes,
+		"SELECT DISTINCT sha256 FROM file_revisions WHERE file_id = $1", f.Id); err != nil {
+		return badRequest(c, "selectrevisions", err)
+	}
+	trans, err := h.DbMap.Begin()
 	if err != nil {
+		return badRequest(c, "trans", err)
+	}
+	if _, err = trans.Exec("DELETE FROM file_revisions WHERE file_id = $1", f.Id); err != nil {
+		trans.Rollback()
+		return badRequest(c, "deleterevisions", err)
+	}
+	if _, err = trans.Delete(f); err != nil {
+		trans.Rollback()
 		return badRequest(c, "delete", err)
 	}
-	err = os.Remove(filepath.Join(h.Datapath, f.Sha256))
-	if err != nil {
-		return badRequest(c, "remove", err)
+	// corrections go with the contents no file refers to any more
+	if _, err = trans.Exec("DELETE FROM corrections WHERE sha256 = ANY($1) "+
+		"AND sha256 NOT IN (SELECT sha256 FROM files) "+
+		"AND sha256 NOT IN (SELECT sha256 FROM file_revisions)",
+		pq.Array(append(hashes, f.Sha256))); err != nil {
+		trans.Rollback()
+		return badRequest(c, "deletecorrections", err)
+	}
+	if err = trans.Commit(); err != nil {
+		return badRequest(c, "trans", err)
+	}
+	h.unindexFile(c, f.Id)
+	for _, hash := range append(hashes, f.Sha256) {
+		if err = h.removeUnused(hash); err != nil && !os.IsNotExist(err) {
+			return badRequest(c, "remove", err)
+		}
 	}
 
 	c.Logger().Infof("deleted: %d: %s", f.Id, f.Name)
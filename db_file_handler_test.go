@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdateFile(t *testing.T) {
+	h, mock, done := mockFiles(t)
+	defer done()
+	content := "いづれの御時にか"
+	keywords := []byte(`[{"lemma":"御時","count":1,"score":1}]`)
+	expect := func() {
+		mock.ExpectQuery(`select .* from "files" where "id"=\$1`).WithArgs(1).
+			WillReturnRows(sqlmock.NewRows(fileColumns).AddRow(1, "a.xml", "a.xml",
+				len(content), hashOf(content), "", keywords, nil, nil, time.Now()))
+	}
+	put := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, "/1", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(req, rec)
+		c.SetParamNames("id")
+		c.SetParamValues("1")
+		if err := h.UpdateFile(c); err != nil {
+			ErrorHandler(err, c)
+		}
+		return rec
+	}
+
+	// only the name and genre change, the rest is kept
+	expect()
+	mock.ExpectExec(`update "files" set .* where "id"=\$10`).
+		WithArgs("b.xml", "a.xml", len(content), hashOf(content), "monogatari",
+			sqlmock.AnyArg(), nil, nil, sqlmock.AnyArg(), 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	rec := put(`{"name":"b.xml","genre":"monogatari","sha256":"` + hashOf(content) + `"}`)
+	assert.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	var f File
+	if assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &f)) {
+		assert.Equal(t, "b.xml", f.Name)
+		assert.Len(t, f.Keywords, 1)
+	}
+
+	// the content changes by a revision
+	expect()
+	rec = put(`{"sha256":"` + hashOf("changed") + `"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "/api/files/1/revisions")
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/labstack/echo/v4"
+)
+
+// indexJob indexes file, or removes it from the index when nil
+type indexJob struct {
+	file   *File
+	logger echo.Logger
+}
+
+// indexQueue keeps the latest job of each file until the background
+// indexer takes it, so that requests do not wait for MeCab
+type indexQueue struct {
+	mu      sync.Mutex
+	pending map[int]indexJob
+	order   []int
+	wake    chan struct{}
+}
+
+// SetIndex keeps the search index of ix updated with the files in the
+// background
+func (h *DbHandler) SetIndex(ix FileIndexer) {
+	h.Index = ix
+	h.indexing = &indexQueue{pending: map[int]indexJob{}, wake: make(chan struct{}, 1)}
+	go h.runIndex()
+}
+
+func (q *indexQueue) push(id int, job indexJob) {
+	q.mu.Lock()
+	if _, ok := q.pending[id]; !ok {
+		q.order = append(q.order, id)
+	}
+	q.pending[id] = job
+	q.mu.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *indexQueue) pop() (int, indexJob, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.order) == 0 {
+		return 0, indexJob{}, false
+	}
+	id := q.order[0]
+	q.order = q.order[1:]
+	job := q.pending[id]
+	delete(q.pending, id)
+	return id, job, true
+}
+
+func (h *DbHandler) runIndex() {
+	for range h.indexing.wake {
+		for {
+			id, job, ok := h.indexing.pop()
+			if !ok {
+				break
+			}
+			if job.file == nil {
+				if err := h.Index.UnindexFile(id); err != nil {
+					job.logger.Errorf("unindex: %d: %s", id, err)
+				}
+			} else if err := h.Index.IndexFile(job.file); err != nil {
+				job.logger.Errorf("index: %d: %s", id, err)
+			}
+		}
+	}
+}
+
+// indexFile queues f to update its search index; the file is kept if it
+// fails
+func (h *DbHandler) indexFile(c echo.Context, f *File) {
+	if h.indexing == nil {
+		return
+	}
+	file := *f
+	h.indexing.push(f.Id, indexJob{&file, c.Logger()})
+}
+
+func (h *DbHandler) unindexFile(c echo.Context, id int) {
+	if h.indexing == nil {
+		return
+	}
+	h.indexing.push(id, indexJob{nil, c.Logger()})
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIndexQueue(t *testing.T) {
+	q := &indexQueue{pending: map[int]indexJob{}, wake: make(chan struct{}, 1)}
+	q.push(1, indexJob{file: &File{Id: 1}})
+	q.push(2, indexJob{file: &File{Id: 2}})
+	q.push(1, indexJob{}) // deleted before being indexed
+	assert.Len(t, q.wake, 1)
+
+	id, job, ok := q.pop()
+	assert.True(t, ok)
+	assert.Equal(t, 1, id)
+	assert.Nil(t, job.file)
+	id, job, ok = q.pop()
+	assert.True(t, ok)
+	assert.Equal(t, 2, id)
+	assert.Equal(t, 2, job.file.Id)
+	_, _, ok = q.pop()
+	assert.False(t, ok)
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+)
+
+// TEIMetadata is what the teiHeader of a file tells about it
+type TEIMetadata struct {
+	Titles     []string `json:"titles"`
+	Authors    []string `json:"authors"`
+	Editors    []string `json:"editors"`
+	Dates      []string `json:"dates"` // @when, @notBefore/@notAfter or text
+	Publishers []string `json:"publishers"`
+	PubPlaces  []string `json:"pubPlaces"`
+	Source     string   `json:"source"` // text of sourceDesc
+	Languages  []string `json:"languages"`
+	Ids        []string `json:"ids"` // xml:ids in the header
+}
+
+// Value and Scan store TEIMetadata as jsonb
+func (m TEIMetadata) Value() (driver.Value, error) {
+	return json.Marshal(m)
+}
+
+func (m *TEIMetadata) Scan(src interface{}) error {
+	return scanJSON(src, m)
+}
+
+// field returns the list collecting the text of a header element, if any
+func (m *TEIMetadata) field(name string, parents []string) *[]string {
+	switch name {
+	case "title":
+		if within(parents, "titleStmt") {
+			return &m.Titles
+		}
+	case "author":
+		return &m.Authors
+	case "editor":
+		return &m.Editors
+	case "publisher":
+		return &m.Publishers
+	case "pubPlace":
+		return &m.PubPlaces
+	}
+	return nil
+}
+
+func within(parents []string, name string) bool {
+	for _, p := range parents {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
+
+func appendNew(list []string, s string) []string {
+	if s == "" {
+		return list
+	}
+	for _, v := range list {
+		if v == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
+
+// isCJK tells Japanese letters and punctuation, which are not spaced
+func isCJK(r rune) bool {
+	return scriptOf(r) != "other" || (r >= 0x3000 && r <= 0x303f) ||
+		(r >= 0xff00 && r <= 0xffef)
+}
+
+// normalizeSpace collapses white space as XPath normalize-space(), and
+// drops that between two CJK characters, as a line break in 好色\n一代男
+func normalizeSpace(s string) string {
+	fields := strings.Fields(s)
+	var b strings.Builder
+	for i, f := range fields {
+		if i > 0 {
+			prev, _ := utf8.DecodeLastRuneInString(fields[i-1])
+			next, _ := utf8.DecodeRuneInString(f)
+			if !isCJK(prev) || !isCJK(next) {
+				b.WriteByte(' ')
+			}
+		}
+		b.WriteString(f)
+	}
+	return b.String()
+}
+
+// extractMetadata reads the teiHeader of data; documents without one give
+// empty metadata
+func extractMetadata(data []byte) (*TEIMetadata, error) {
+	m := &TEIMetadata{Titles: []string{}, Authors: []string{}, Editors: []string{},
+		Dates: []string{}, Publishers: []string{}, PubPlaces: []string{},
+		Languages: []string{}, Ids: []string{}}
+
+	type open struct {
+		name  string
+		field *[]string
+		text  strings.Builder
+	}
+	var stack []*open
+	var parents []string
+	inHeader := false
+	var source strings.Builder
+	d := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			name := t.Name.Local
+			if name == "teiHeader" {
+				inHeader = true
+			}
+			for _, a := range t.Attr {
+				if a.Name.Space != xmlNamespace {
+					continue
+				}
+				// the language of the document
+				if a.Name.Local == "lang" && len(parents) == 0 {
+					m.Languages = appendNew(m.Languages, a.Value)
+				}
+				if a.Name.Local == "id" && inHeader {
+					m.Ids = appendNew(m.Ids, a.Value)
+				}
+			}
+			if inHeader {
+				switch name {
+				case "date", "origDate":
+					var when, from, to string
+					for _, a := range t.Attr {
+						switch a.Name.Local {
+						case "when":
+							when = a.Value
+						case "notBefore", "from":
+							from = a.Value
+						case "notAfter", "to":
+							to = a.Value
+						}
+					}
+					if when == "" && (from != "" || to != "") {
+						when = from + "/" + to
+					}
+					if when != "" {
+						m.Dates = appendNew(m.Dates, when)
+						stack = append(stack, &open{name: name})
+					} else {
+						stack = append(stack, &open{name: name, field: &m.Dates})
+					}
+				case "language":
+					for _, a := range t.Attr {
+						if a.Name.Local == "ident" {
+							m.Languages = appendNew(m.Languages, a.Value)
+						}
+					}
+					stack = append(stack, &open{name: name})
+				default:
+					stack = append(stack, &open{name: name, field: m.field(name, parents)})
+				}
+			}
+			parents = append(parents, name)
+		case xml.EndElement:
+			parents = parents[:len(parents)-1]
+			if !inHeader {
+				continue
+			}
+			top := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if top.field != nil {
+				*top.field = appendNew(*top.field, normalizeSpace(top.text.String()))
+			}
+			if t.Name.Local == "teiHeader" {
+				// the parts of the source stay spaced
+				m.Source = strings.Join(strings.Fields(source.String()), " ")
+				return m, nil
+			}
+		case xml.CharData:
+			if !inHeader {
+				continue
+			}
+			// the text of an element goes to every element collecting it
+			for _, o := range stack {
+				if o.field != nil {
+					o.text.Write(t)
+				}
+			}
+			if within(parents, "sourceDesc") {
+				source.Write(t)
+				source.WriteByte(' ')
+			}
+		}
+	}
+	return m, nil
+}
+
+// describeFile extracts the metadata of the content of an XML file
+func (h *DbHandler) describeFile(f *File) error {
+	if filepath.Ext(f.Name) != ".xml" {
+		f.Metadata = nil
+		return nil
+	}
+	data, err := h.ReadFile(f.Sha256)
+	if err != nil {
+		return err
+	}
+	describeContent(f, data)
+	return nil
+}
+
+// describeContent sets the metadata of f from its content data
+func describeContent(f *File, data []byte) {
+	if filepath.Ext(f.Name) != ".xml" {
+		f.Metadata = nil
+		return
+	}
+	var err error
+	if f.Metadata, err = extractMetadata(data); err != nil {
+		// not well-formed files have no metadata
+		f.Metadata = nil
+	}
+}
+
+// matchMetadata filters files by ?title=, ?author=, ?editor=, ?publisher=,
+// ?place=, ?source= (substrings ignoring kanji variants), ?date= (prefix),
+// ?lang= and ?xmlid=
+func (h *DbHandler) matchMetadata(c echo.Context, files []File) []File {
+	contains := func(list []string, sub string) bool {
+		for _, s := range list {
+			if h.Variants.Match(s, sub) {
+				return true
+			}
+		}
+		return false
+	}
+	filters := map[string]func(m *TEIMetadata, v string) bool{
+		"title":     func(m *TEIMetadata, v string) bool { return contains(m.Titles, v) },
+		"author":    func(m *TEIMetadata, v string) bool { return contains(m.Authors, v) },
+		"editor":    func(m *TEIMetadata, v string) bool { return contains(m.Editors, v) },
+		"publisher": func(m *TEIMetadata, v string) bool { return contains(m.Publishers, v) },
+		"place":     func(m *TEIMetadata, v string) bool { return contains(m.PubPlaces, v) },
+		"source":    func(m *TEIMetadata, v string) bool { return h.Variants.Match(m.Source, v) },
+		"date": func(m *TEIMetadata, v string) bool {
+			for _, s := range m.Dates {
+				if strings.HasPrefix(s, v) {
+					return true
+				}
+			}
+			return false
+		},
+		"lang": func(m *TEIMetadata, v string) bool {
+			for _, s := range m.Languages {
+				if s == v || strings.HasPrefix(s, v+"-") {
+					return true
+				}
+			}
+			return false
+		},
+		"xmlid": func(m *TEIMetadata, v string) bool { return within(m.Ids, v) },
+	}
+	for param, match := range filters {
+		v := c.QueryParam(param)
+		if v == "" {
+			continue
+		}
+		matched := []File{}
+		for _, f := range files {
+			if f.Metadata != nil && match(f.Metadata, v) {
+				matched = append(matched, f)
+			}
+		}
+		files = matched
+	}
+	return files
+}
+
+// POST
+
+// PostFilesMetadata extracts again the metadata of all files
+func (h *DbHandler) PostFilesMetadata(c echo.Context) error {
+	lockFile.Lock()
+	defer lockFile.Unlock()
+
+	var files []File
+	if _, err := h.DbMap.Select(&files, "SELECT * FROM files ORDER BY id"); err != nil {
+		return badRequest(c, "select", err)
+	}
+	for idx := range files {
+		f := &files[idx]
+		if err := h.describeFile(f); err != nil {
+			return badRequest(c, "describe", err)
+		}
+		if _, err := h.DbMap.Exec(
+			"UPDATE files SET metadata = $1 WHERE id = $2", f.Metadata, f.Id); err != nil {
+			return badRequest(c, "update", err)
+		}
+	}
+	c.Logger().Infof("updated: metadata: %d files", len(files))
+	return c.JSON(http.StatusOK, files)
+}
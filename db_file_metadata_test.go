@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractMetadata(t *testing.T) {
+	data := []byte(`<TEI xmlns="http://www.tei-c.org/ns/1.0" xml:lang="ja">
+<teiHeader xml:id="h">
+ <fileDesc>
+  <titleStmt>
+   <title>好色
+     一代男</title>
+   <author>井原西鶴</author>
+   <editor xml:id="ed1">国文研</editor>
+  </titleStmt>
+  <publicationStmt>
+   <publisher>国文学研究資料館</publisher>
+   <pubPlace>立川</pubPlace>
+   <date when="2024-04-01">2024年4月1日</date>
+  </publicationStmt>
+  <sourceDesc>
+   <bibl><title>好色一代男</title> <author>井原西鶴</author>
+    <pubPlace>大坂</pubPlace> <date notBefore="1682" notAfter="1683">天和二年</date><date>天和</date></bibl>
+  </sourceDesc>
+ </fileDesc>
+ <profileDesc><langUsage><language ident="ja-Kana">仮名</language></langUsage></profileDesc>
+</teiHeader>
+<text xml:id="t"><body><p><date when="1700">元禄</date></p></body></text>
+</TEI>`)
+	m, err := extractMetadata(data)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"好色一代男"}, m.Titles)
+	assert.Equal(t, []string{"井原西鶴"}, m.Authors)
+	assert.Equal(t, []string{"国文研"}, m.Editors)
+	assert.Equal(t, []string{"国文学研究資料館"}, m.Publishers)
+	assert.Equal(t, []string{"立川", "大坂"}, m.PubPlaces)
+	assert.Equal(t, []string{"2024-04-01", "1682/1683", "天和"}, m.Dates)
+	assert.Equal(t, "好色一代男 井原西鶴 大坂 天和二年 天和", m.Source)
+	assert.Equal(t, []string{"ja", "ja-Kana"}, m.Languages)
+	assert.Equal(t, []string{"h", "ed1"}, m.Ids)
+
+	m, err = extractMetadata([]byte(`<TEI><text>本文</text></TEI>`))
+	assert.NoError(t, err)
+	assert.Empty(t, m.Titles)
+}
+
+func TestNormalizeSpace(t *testing.T) {
+	assert.Equal(t, "源氏物語", normalizeSpace(" 源氏\n  物語 "))
+	assert.Equal(t, "Genji monogatari 源氏物語、上", normalizeSpace("Genji\tmonogatari 源氏 物語 、 上"))
+}
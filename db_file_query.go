@@ -0,0 +1,510 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/antchfx/xmlquery"
+	"github.com/antchfx/xpath"
+	"github.com/labstack/echo/v4"
+)
+
+// XPathQuery is a compiled XPath with the prefixes bound to namespaces
+type XPathQuery struct {
+	Source   string
+	Expr     *xpath.Expr
+	prefixes map[string]string // namespace -> prefix
+}
+
+// QueryMatch is a node selected by an XPath
+type QueryMatch struct {
+	Type  string `json:"type"` // element, attribute, text or comment
+	Name  string `json:"name,omitempty"`
+	Path  string `json:"path"`
+	Value string `json:"value"`         // string value
+	XML   string `json:"xml,omitempty"` // fragment of elements and comments
+}
+
+// QueryResult is what an XPath gives on a file: nodes, or a number, string
+// or boolean
+type QueryResult struct {
+	File    int          `json:"file"`
+	Name    string       `json:"name"`
+	Value   interface{}  `json:"value,omitempty"`
+	Matches []QueryMatch `json:"matches"`
+	Error   string       `json:"error,omitempty"`
+}
+
+// ValueCount is a distinct value with the number of its matches
+type ValueCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// QueryAggregate sums up an XPath run over several files
+type QueryAggregate struct {
+	XPath   string        `json:"xpath"`
+	Files   int           `json:"files"`   // files queried
+	Matched int           `json:"matched"` // files with nodes, a true or non-zero value
+	Count   int           `json:"count"`   // nodes
+	Sum     float64       `json:"sum"`     // of numbers
+	Values  []ValueCount  `json:"values"`  // of nodes and strings, most frequent first
+	Results []QueryResult `json:"results"`
+}
+
+const (
+	QUERY_JSON = "json"
+	QUERY_XML  = "xml"
+	QUERY_TEXT = "text"
+)
+
+// compileXPath compiles expr with bindings of "prefix=namespace"; xml is
+// always bound
+func compileXPath(expr string, bindings []string) (*XPathQuery, error) {
+	q := &XPathQuery{Source: expr, prefixes: map[string]string{xmlNamespace: "xml"}}
+	for _, b := range bindings {
+		eq := strings.IndexByte(b, '=')
+		if eq <= 0 || eq == len(b)-1 {
+			return nil, fmt.Errorf("ns: %q is not prefix=namespace", b)
+		}
+		q.prefixes[b[eq+1:]] = b[:eq]
+	}
+	var err error
+	if q.Expr, err = xpath.Compile(expr); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// nsNavigator names the nodes of the namespaces bound in a query by their
+// prefixes there rather than in the document
+type nsNavigator struct {
+	*xmlquery.NodeNavigator
+	prefixes map[string]string
+}
+
+func (x *nsNavigator) Prefix() string {
+	if p, ok := x.prefixes[x.NamespaceURL()]; ok && x.NamespaceURL() != "" {
+		return p
+	}
+	return x.NodeNavigator.Prefix()
+}
+
+func (x *nsNavigator) Copy() xpath.NodeNavigator {
+	return &nsNavigator{x.NodeNavigator.Copy().(*xmlquery.NodeNavigator), x.prefixes}
+}
+
+func (x *nsNavigator) MoveTo(other xpath.NodeNavigator) bool {
+	o, ok := other.(*nsNavigator)
+	return ok && x.NodeNavigator.MoveTo(o.NodeNavigator)
+}
+
+// Evaluate runs q on a document and returns its nodes, or its value
+func (q *XPathQuery) Evaluate(doc *xmlquery.Node) (res QueryResult, err error) {
+	// some functions panic on wrong arguments
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("xpath: %v", r)
+		}
+	}()
+	res.Matches = []QueryMatch{}
+	nav := &nsNavigator{xmlquery.CreateXPathNavigator(doc), q.prefixes}
+	switch v := q.Expr.Evaluate(nav).(type) {
+	case *xpath.NodeIterator:
+		for v.MoveNext() {
+			res.Matches = append(res.Matches, newQueryMatch(v.Current().(*nsNavigator)))
+		}
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			res.Value = fmt.Sprint(v)
+		} else {
+			res.Value = v
+		}
+	default:
+		res.Value = v
+	}
+	return res, nil
+}
+
+func newQueryMatch(nav *nsNavigator) QueryMatch {
+	n := nav.Current()
+	switch nav.NodeType() {
+	case xpath.AttributeNode:
+		name := nav.LocalName()
+		if p := nav.NodeNavigator.Prefix(); p != "" {
+			name = p + ":" + name
+		}
+		return QueryMatch{Type: "attribute", Name: name,
+			Path: nodePath(n) + "/@" + name, Value: nav.Value()}
+	case xpath.ElementNode:
+		return QueryMatch{Type: "element", Name: qualifiedName(n),
+			Path: nodePath(n), Value: n.InnerText(), XML: fragmentXML(n)}
+	case xpath.CommentNode:
+		return QueryMatch{Type: "comment", Path: nodePath(n), Value: n.Data,
+			XML: fragmentXML(n)}
+	case xpath.TextNode:
+		return QueryMatch{Type: "text", Path: nodePath(n), Value: n.Data}
+	}
+	return QueryMatch{Type: "root", Path: "/", Value: n.InnerText()}
+}
+
+func qualifiedName(n *xmlquery.Node) string {
+	if n.Prefix != "" {
+		return n.Prefix + ":" + n.Data
+	}
+	return n.Data
+}
+
+// nodePath is the path of a node with positions, e.g. /TEI[1]/text()[2]
+func nodePath(n *xmlquery.Node) string {
+	same := func(a, b *xmlquery.Node) bool {
+		switch b.Type {
+		case xmlquery.ElementNode:
+			return a.Type == b.Type && a.Data == b.Data && a.NamespaceURI == b.NamespaceURI
+		case xmlquery.TextNode, xmlquery.CharDataNode:
+			return a.Type == xmlquery.TextNode || a.Type == xmlquery.CharDataNode
+		}
+		return a.Type == b.Type
+	}
+	var steps []string
+	for ; n != nil && n.Parent != nil; n = n.Parent {
+		pos := 1
+		for s := n.PrevSibling; s != nil; s = s.PrevSibling {
+			if same(s, n) {
+				pos++
+			}
+		}
+		var step string
+		switch n.Type {
+		case xmlquery.ElementNode:
+			step = qualifiedName(n)
+		case xmlquery.TextNode, xmlquery.CharDataNode:
+			step = "text()"
+		case xmlquery.CommentNode:
+			step = "comment()"
+		default:
+			continue
+		}
+		steps = append(steps, fmt.Sprintf("%s[%d]", step, pos))
+	}
+	var sb strings.Builder
+	for i := len(steps) - 1; i >= 0; i-- {
+		sb.WriteString("/" + steps[i])
+	}
+	return sb.String()
+}
+
+// fragmentXML serializes a node as is, declaring on it the namespaces
+// declared on its ancestors
+func fragmentXML(n *xmlquery.Node) string {
+	var buf bytes.Buffer
+	var decls []xmlquery.Attr
+	if n.Type == xmlquery.ElementNode {
+		declared := map[string]bool{}
+		for _, a := range n.Attr {
+			if a.Name.Space == "xmlns" || a.Name.Space == "" && a.Name.Local == "xmlns" {
+				declared[a.Name.Local] = true
+			}
+		}
+		for p := n.Parent; p != nil; p = p.Parent {
+			for _, a := range p.Attr {
+				prefix := ""
+				if a.Name.Space == "xmlns" {
+					prefix = a.Name.Local
+				} else if a.Name.Space != "" || a.Name.Local != "xmlns" {
+					continue
+				}
+				if !declared[prefix] {
+					declared[prefix] = true
+					decls = append(decls, a)
+				}
+			}
+		}
+	}
+	writeNodeXML(&buf, n, decls)
+	return buf.String()
+}
+
+func writeNodeXML(buf *bytes.Buffer, n *xmlquery.Node, decls []xmlquery.Attr) {
+	switch n.Type {
+	case xmlquery.TextNode:
+		xml.EscapeText(buf, []byte(n.Data))
+		return
+	case xmlquery.CharDataNode:
+		buf.WriteString("<![CDATA[" + n.Data + "]]>")
+		return
+	case xmlquery.CommentNode:
+		buf.WriteString("<!--" + n.Data + "-->")
+		return
+	case xmlquery.ElementNode:
+	default:
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			writeNodeXML(buf, c, nil)
+		}
+		return
+	}
+	buf.WriteString("<" + qualifiedName(n))
+	for _, a := range append(decls, n.Attr...) {
+		buf.WriteByte(' ')
+		if a.Name.Space != "" {
+			buf.WriteString(a.Name.Space + ":")
+		}
+		buf.WriteString(a.Name.Local + `="` + html.EscapeString(a.Value) + `"`)
+	}
+	if n.FirstChild == nil {
+		buf.WriteString("/>")
+		return
+	}
+	buf.WriteByte('>')
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		writeNodeXML(buf, c, nil)
+	}
+	buf.WriteString("</" + qualifiedName(n) + ">")
+}
+
+// queryFile runs q on the content sha256 of a file
+func (h *DbHandler) queryFile(q *XPathQuery, id int, name, sha256 string) QueryResult {
+	res := QueryResult{File: id, Name: name, Matches: []QueryMatch{}}
+	data, err := h.ReadFile(sha256)
+	if err == nil {
+		var doc *xmlquery.Node
+		if doc, err = xmlquery.Parse(bytes.NewReader(data)); err == nil {
+			var r QueryResult
+			if r, err = q.Evaluate(doc); err == nil {
+				res.Value, res.Matches = r.Value, r.Matches
+			}
+		}
+	}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	return res
+}
+
+// aggregate sums up the results of the files
+func (q *XPathQuery) aggregate(results []QueryResult) *QueryAggregate {
+	agg := &QueryAggregate{XPath: q.Source, Files: len(results),
+		Values: []ValueCount{}, Results: results}
+	counts := map[string]int{}
+	for _, r := range results {
+		matched := len(r.Matches) > 0
+		switch v := r.Value.(type) {
+		case float64:
+			agg.Sum += v
+			matched = v != 0
+		case bool:
+			matched = v
+		case string:
+			counts[v]++
+			matched = v != ""
+		}
+		if matched {
+			agg.Matched++
+		}
+		agg.Count += len(r.Matches)
+		for _, m := range r.Matches {
+			counts[normalizeSpace(m.Value)]++
+		}
+	}
+	for v, n := range counts {
+		agg.Values = append(agg.Values, ValueCount{v, n})
+	}
+	sort.Slice(agg.Values, func(i, j int) bool {
+		if agg.Values[i].Count != agg.Values[j].Count {
+			return agg.Values[i].Count > agg.Values[j].Count
+		}
+		return agg.Values[i].Value < agg.Values[j].Value
+	})
+	return agg
+}
+
+// writeQueryXML writes results as <results><result .../></results>, the
+// matches of a file in <file id name> if several
+func writeQueryXML(buf *bytes.Buffer, q *XPathQuery, results []QueryResult, files bool) {
+	attr := func(name, value string) {
+		buf.WriteString(" " + name + `="` + html.EscapeString(value) + `"`)
+	}
+	buf.WriteString(xml.Header + "<results")
+	attr("xpath", q.Source)
+	buf.WriteString(">\n")
+	for _, r := range results {
+		if files {
+			buf.WriteString("<file")
+			attr("id", strconv.Itoa(r.File))
+			attr("name", r.Name)
+			if r.Error != "" {
+				attr("error", r.Error)
+			}
+			buf.WriteString(">\n")
+		}
+		if r.Value != nil {
+			buf.WriteString("<value>")
+			xml.EscapeText(buf, []byte(fmt.Sprint(r.Value)))
+			buf.WriteString("</value>\n")
+		}
+		for _, m := range r.Matches {
+			buf.WriteString("<result")
+			attr("type", m.Type)
+			attr("path", m.Path)
+			buf.WriteByte('>')
+			if m.XML != "" {
+				buf.WriteString(m.XML)
+			} else {
+				xml.EscapeText(buf, []byte(m.Value))
+			}
+			buf.WriteString("</result>\n")
+		}
+		if files {
+			buf.WriteString("</file>\n")
+		}
+	}
+	buf.WriteString("</results>\n")
+}
+
+// writeQueryText writes a value per line, prefixed by the file name if
+// several
+func writeQueryText(buf *bytes.Buffer, results []QueryResult, files bool) {
+	line := func(r QueryResult, s string) {
+		if files {
+			buf.WriteString(r.Name + "\t")
+		}
+		buf.WriteString(strings.ReplaceAll(s, "\n", " ") + "\n")
+	}
+	for _, r := range results {
+		if r.Value != nil {
+			line(r, fmt.Sprint(r.Value))
+		}
+		for _, m := range r.Matches {
+			line(r, m.Value)
+		}
+	}
+}
+
+// queryParams reads ?xpath=, ?ns=prefix=namespace (repeated) and ?format=
+func queryParams(c echo.Context) (*XPathQuery, string, error) {
+	format := c.QueryParam("format")
+	switch format {
+	case "":
+		format = QUERY_JSON
+	case QUERY_JSON, QUERY_XML, QUERY_TEXT:
+	default:
+		return nil, "", fmt.Errorf("unknown format: %s", format)
+	}
+	expr := c.QueryParam("xpath")
+	if expr == "" {
+		return nil, "", fmt.Errorf("missing xpath")
+	}
+	q, err := compileXPath(expr, c.QueryParams()["ns"])
+	return q, format, err
+}
+
+// GET
+
+// GetFileQuery selects the nodes of ?xpath= in a file, or in its revision
+// ?rev=, as JSON, XML fragments (?format=xml) or lines of text
+// (?format=text)
+func (h *DbHandler) GetFileQuery(c echo.Context) error {
+	q, format, err := queryParams(c)
+	if err != nil {
+		return badRequest(c, "xpath", err)
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return badRequest(c, "atoi", err)
+	}
+	obj, err := h.DbMap.Get(File{}, id)
+	if err != nil {
+		return badRequest(c, "getfile", err)
+	}
+	if obj == nil {
+		return notFound(c, "getfile", c.Param("id"))
+	}
+	f := obj.(*File)
+	sha := f.Sha256
+	if s := c.QueryParam("rev"); s != "" {
+		rev, err := strconv.Atoi(s)
+		if err != nil {
+			return badRequest(c, "atoi", err)
+		}
+		if _, sha, err = h.revisionContent(id, rev); err != nil {
+			return notFound(c, "getrevision", fmt.Sprintf("%d@%d", id, rev))
+		}
+	}
+
+	res := h.queryFile(q, f.Id, f.Name, sha)
+	if res.Error != "" {
+		return badRequest(c, "query", fmt.Errorf("%s", res.Error))
+	}
+	var buf bytes.Buffer
+	switch format {
+	case QUERY_XML:
+		writeQueryXML(&buf, q, []QueryResult{res}, false)
+		return c.Blob(http.StatusOK, echo.MIMEApplicationXMLCharsetUTF8, buf.Bytes())
+	case QUERY_TEXT:
+		writeQueryText(&buf, []QueryResult{res}, false)
+		return c.Blob(http.StatusOK, echo.MIMETextPlainCharsetUTF8, buf.Bytes())
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// GetFilesQuery runs ?xpath= over the files of ?files=1,2,..., ?genre=
+// and the metadata filters of /api/files, and sums up the results
+func (h *DbHandler) GetFilesQuery(c echo.Context) error {
+	q, format, err := queryParams(c)
+	if err != nil {
+		return badRequest(c, "xpath", err)
+	}
+	var files []File
+	if _, err := h.DbMap.Select(&files, "SELECT * FROM files ORDER BY id"); err != nil {
+		return badRequest(c, "select", err)
+	}
+	if ids := c.QueryParam("files"); ids != "" {
+		want := map[int]bool{}
+		for _, s := range strings.Split(ids, ",") {
+			id, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil {
+				return badRequest(c, "atoi", err)
+			}
+			want[id] = true
+		}
+		var selected []File
+		for _, f := range files {
+			if want[f.Id] {
+				selected = append(selected, f)
+			}
+		}
+		files = selected
+	}
+	if genre := c.QueryParam("genre"); genre != "" {
+		var selected []File
+		for _, f := range files {
+			if f.Genre == genre {
+				selected = append(selected, f)
+			}
+		}
+		files = selected
+	}
+	files = h.matchMetadata(c, files)
+
+	results := []QueryResult{}
+	for _, f := range files {
+		results = append(results, h.queryFile(q, f.Id, f.Name, f.Sha256))
+	}
+	var buf bytes.Buffer
+	switch format {
+	case QUERY_XML:
+		writeQueryXML(&buf, q, results, true)
+		return c.Blob(http.StatusOK, echo.MIMEApplicationXMLCharsetUTF8, buf.Bytes())
+	case QUERY_TEXT:
+		writeQueryText(&buf, results, true)
+		return c.Blob(http.StatusOK, echo.MIMETextPlainCharsetUTF8, buf.Bytes())
+	}
+	return c.JSON(http.StatusOK, q.aggregate(results))
+}
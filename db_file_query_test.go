@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/antchfx/xmlquery"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestXPathQuery(t *testing.T) {
+	doc, err := xmlquery.Parse(strings.NewReader(`<?xml version="1.0"?>
+<TEI xmlns="http://www.tei-c.org/ns/1.0" xml:id="t">
+<text><body><p>いづれの <hi rend="b">御時</hi> にか</p><!-- c --><p/></body></text>
+</TEI>`))
+	if !assert.NoError(t, err) {
+		return
+	}
+	run := func(expr string, ns ...string) QueryResult {
+		q, err := compileXPath(expr, ns)
+		if !assert.NoError(t, err) {
+			return QueryResult{}
+		}
+		res, err := q.Evaluate(doc)
+		assert.NoError(t, err)
+		return res
+	}
+
+	res := run("//p")
+	if assert.Len(t, res.Matches, 2) {
+		m := res.Matches[0]
+		assert.Equal(t, "element", m.Type)
+		assert.Equal(t, "/TEI[1]/text[1]/body[1]/p[1]", m.Path)
+		assert.Equal(t, "いづれの 御時 にか", m.Value)
+		assert.Equal(t, `<p xmlns="http://www.tei-c.org/ns/1.0">いづれの <hi rend="b">御時</hi> にか</p>`, m.XML)
+		assert.Equal(t, `<p xmlns="http://www.tei-c.org/ns/1.0"/>`, res.Matches[1].XML)
+	}
+
+	// bound prefixes replace those of the document
+	assert.Len(t, run("//tei:p", "tei=http://www.tei-c.org/ns/1.0").Matches, 2)
+	assert.Empty(t, run("//p", "tei=http://www.tei-c.org/ns/1.0").Matches)
+
+	res = run("/tei:TEI/@xml:id", "tei=http://www.tei-c.org/ns/1.0")
+	if assert.Len(t, res.Matches, 1) {
+		assert.Equal(t, QueryMatch{Type: "attribute", Name: "xml:id",
+			Path: "/TEI[1]/@xml:id", Value: "t"}, res.Matches[0])
+	}
+	res = run("//hi/text()")
+	if assert.Len(t, res.Matches, 1) {
+		assert.Equal(t, "/TEI[1]/text[1]/body[1]/p[1]/hi[1]/text()[1]", res.Matches[0].Path)
+	}
+	assert.Equal(t, "/TEI[1]/text[1]/body[1]/comment()[1]", run("//comment()").Matches[0].Path)
+
+	assert.Equal(t, float64(2), run("count(//p)").Value)
+	assert.Equal(t, true, run("boolean(//hi[@rend='b'])").Value)
+	assert.Equal(t, "御時", run("string(//hi)").Value)
+
+	_, err = compileXPath("//p[", nil)
+	assert.Error(t, err)
+	_, err = compileXPath("//p", []string{"tei"})
+	assert.Error(t, err)
+}
+
+func TestQueryAggregate(t *testing.T) {
+	q, _ := compileXPath("//title", nil)
+	agg := q.aggregate([]QueryResult{
+		{File: 1, Matches: []QueryMatch{{Value: "源氏"}, {Value: " 源氏\n"}}},
+		{File: 2, Matches: []QueryMatch{{Value: "枕"}}},
+		{File: 3, Matches: []QueryMatch{}},
+	})
+	assert.Equal(t, 3, agg.Files)
+	assert.Equal(t, 2, agg.Matched)
+	assert.Equal(t, 3, agg.Count)
+	assert.Equal(t, []ValueCount{{"源氏", 2}, {"枕", 1}}, agg.Values)
+
+	agg = q.aggregate([]QueryResult{{Value: float64(2)}, {Value: float64(0)}})
+	assert.Equal(t, float64(2), agg.Sum)
+	assert.Equal(t, 1, agg.Matched)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// FileRevision is a content of a file; the file holds its latest revision
+type FileRevision struct {
+	Id      int       `db:"id,primarykey,autoincrement" json:"id"`
+	FileId  int       `db:"file_id,notnull" json:"fileId"`
+	Number  int       `db:"number,notnull" json:"number"`
+	Sha256  string    `db:"sha256,notnull" json:"sha256"`
+	Size    int64     `db:"size" json:"size"`
+	Author  string    `db:"author" json:"author"`
+	Message string    `db:"message" json:"message"`
+	Created time.Time `db:"created,notnull" json:"created"`
+}
+
+// revisionRequest is the body of a new revision or a rollback
+type revisionRequest struct {
+	Path    string `json:"path" form:"path"` // http(s):// instead of a form file
+	Author  string `json:"author" form:"author"`
+	Message string `json:"message" form:"message"`
+}
+
+// fileAndRevision returns the file of :id and, when :rev is given, its
+// revision
+func (h *DbHandler) fileAndRevision(c echo.Context) (*File, *FileRevision, error) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return nil, nil, badRequest(c, "atoi", err)
+	}
+	obj, err := h.DbMap.Get(File{}, id)
+	if err != nil {
+		return nil, nil, badRequest(c, "getfile", err)
+	}
+	if obj == nil {
+		return nil, nil, notFound(c, "getfile", c.Param("id"))
+	}
+	if c.Param("rev") == "" {
+		return obj.(*File), nil, nil
+	}
+
+	number, err := strconv.Atoi(c.Param("rev"))
+	if err != nil {
+		return nil, nil, badRequest(c, "atoi", err)
+	}
+	var rev FileRevision
+	err = h.DbMap.SelectOne(&rev,
+		"SELECT * FROM file_revisions WHERE file_id = $1 AND number = $2", id, number)
+	if err == sql.ErrNoRows {
+		return nil, nil, notFound(c, "getrevision", fmt.Sprintf("%d@%d", id, number))
+	} else if err != nil {
+		return nil, nil, badRequest(c, "getrevision", err)
+	}
+	return obj.(*File), &rev, nil
+}
+
+// addRevision makes the content of f its next revision, replacing prev,
+// whose corrections go over to it
+func (h *DbHandler) addRevision(c echo.Context, f *File, prev string, req *revisionRequest) (*FileRevision, error) {
+	trans, err := h.DbMap.Begin()
+	if err != nil {
+		return nil, badRequest(c, "trans", err)
+	}
+	last, err := trans.SelectInt(
+		"SELECT coalesce(max(number), 0) FROM file_revisions WHERE file_id = $1", f.Id)
+	if err != nil {
+		trans.Rollback()
+		return nil, badRequest(c, "selectrevisions", err)
+	}
+	rev := &FileRevision{
+		FileId:  f.Id,
+		Number:  int(last) + 1,
+		Sha256:  f.Sha256,
+		Size:    f.Size,
+		Author:  req.Author,
+		Message: req.Message,
+		Created: f.Updated,
+	}
+	if err = trans.Insert(rev); err != nil {
+		trans.Rollback()
+		return nil, badRequest(c, "insertrevision", err)
+	}
+	if _, err = trans.Update(f); err != nil {
+		trans.Rollback()
+		if strings.Contains(err.Error(), "files_sha256_idx") {
+			return nil, badRequest(c, "update", fmt.Errorf("already exists: sha256: %s", f.Sha256))
+		}
+		return nil, badRequest(c, "update", err)
+	}
+	moved, total, err := h.moveCorrections(trans, prev, f)
+	if err != nil {
+		trans.Rollback()
+		return nil, badRequest(c, "movecorrections", err)
+	}
+	if err = trans.Commit(); err != nil {
+		return nil, badRequest(c, "trans", err)
+	}
+	if total > 0 {
+		c.Logger().Infof("corrections: %d: %d of %d kept", f.Id, moved, total)
+	}
+	return rev, nil
+}
+
+// GET
+
+// GetFileRevisions lists the revisions of a file, latest first
+func (h *DbHandler) GetFileRevisions(c echo.Context) error {
+	f, _, err := h.fileAndRevision(c)
+	if err != nil {
+		return err
+	}
+	revs := []FileRevision{}
+	if _, err = h.DbMap.Select(&revs,
+		"SELECT * FROM file_revisions WHERE file_id = $1 ORDER BY number desc", f.Id); err != nil {
+		return badRequest(c, "selectrevisions", err)
+	}
+	return c.JSON(http.StatusOK, revs)
+}
+
+func (h *DbHandler) GetFileRevision(c echo.Context) error {
+	_, rev, err := h.fileAndRevision(c)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, rev)
+}
+
+func (h *DbHandler) GetFileRevisionXML(c echo.Context) error {
+	f, rev, err := h.fileAndRevision(c)
+	if err != nil {
+		return err
+	}
+	return h.serveBlob(c, rev.Sha256, f.Name, rev.Created)
+}
+
+// POST
+
+// CreateFileRevision replaces the content of a file with the form file
+// "file" or the content of path, keeping the former as a revision
+func (h *DbHandler) CreateFileRevision(c echo.Context) error {
+	lockFile.Lock()
+	defer lockFile.Unlock()
+
+	f, _, err := h.fileAndRevision(c)
+	if err != nil {
+		return err
+	}
+	var req revisionRequest
+	if err := c.Bind(&req); err != nil {
+		return badRequest(c, "bind", err)
+	}
+
+	current := f.Sha256
+	f.Path = req.Path
+	if err := h.receiveFile(c, f); err != nil {
+		return err
+	}
+	if f.Sha256 == current {
+		return badRequest(c, "unchanged", fmt.Errorf("same content: sha256: %s", current))
+	}
+	if invalid, err := h.checkValid(c, f); err != nil {
+		return err
+	} else if invalid != nil {
+		return c.JSON(http.StatusUnprocessableEntity, invalid)
+	}
+	if err := h.describeFile(f); err != nil {
+		return badRequest(c, "describe", err)
+	}
+	f.Keywords = nil
+	f.Updated = time.Now()
+
+	rev, err := h.addRevision(c, f, current, &req)
+	if err != nil {
+		if err := h.removeUnused(f.Sha256); err != nil {
+			c.Logger().Errorf("remove: %s: %s", f.Sha256, err)
+		}
+		return err
+	}
+	h.indexFile(c, f)
+	c.Logger().Infof("updated: %d: %s: revision %d", f.Id, f.Name, rev.Number)
+	return c.JSON(http.StatusCreated, rev)
+}
+
+// RollbackFile makes the content of a former revision the latest one
+func (h *DbHandler) RollbackFile(c echo.Context) error {
+	lockFile.Lock()
+	defer lockFile.Unlock()
+
+	f, target, err := h.fileAndRevision(c)
+	if err != nil {
+		return err
+	}
+	var req revisionRequest
+	if err := c.Bind(&req); err != nil {
+		return badRequest(c, "bind", err)
+	}
+	if f.Sha256 == target.Sha256 {
+		return badRequest(c, "unchanged", fmt.Errorf("same content: sha256: %s", f.Sha256))
+	}
+	if req.Message == "" {
+		req.Message = fmt.Sprintf("rollback to %d", target.Number)
+	}
+
+	current := f.Sha256
+	f.Sha256 = target.Sha256
+	f.Size = target.Size
+	report, err := h.validateStored(f)
+	if err != nil {
+		return badRequest(c, "validate", err)
+	}
+	f.Validation = report
+	if err := h.describeFile(f); err != nil {
+		return badRequest(c, "describe", err)
+	}
+	f.Keywords = nil
+	f.Updated = time.Now()
+
+	rev, err := h.addRevision(c, f, current, &req)
+	if err != nil {
+		return err
+	}
+	h.indexFile(c, f)
+	c.Logger().Infof("updated: %d: %s: revision %d from %d",
+		f.Id, f.Name, rev.Number, target.Number)
+	return c.JSON(http.StatusCreated, rev)
+}
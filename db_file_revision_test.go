@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-gorp/gorp/v3"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	fileColumns       = []string{"id", "name", "path", "size", "sha256", "genre", "keywords", "validation", "metadata", "updated"}
+	revisionColumns   = []string{"id", "file_id", "number", "sha256", "size", "author", "message", "created"}
+	correctionColumns = []string{"id", "sha256", "start_pos", "end_pos", "surface", "features", "corrector", "updated"}
+)
+
+// mockFiles is a DbHandler whose database is mocked and whose contents
+// are stored in a temporary directory
+func mockFiles(t *testing.T) (*DbHandler, sqlmock.Sqlmock, func()) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %s", err)
+	}
+	dir, err := ioutil.TempDir("", "revisions-")
+	if err != nil {
+		t.Fatalf("tempdir: %s", err)
+	}
+	store, err := NewLocalStore(dir)
+	if err != nil {
+		t.Fatalf("store: %s", err)
+	}
+	h := &DbHandler{Db: db, Blobs: store, Datapath: dir}
+	h.DbMap = &gorp.DbMap{Db: db, Dialect: CustomPostgresDialect{}}
+	h.DbMap.AddTableWithName(File{}, "files")
+	h.DbMap.AddTableWithName(FileRevision{}, "file_revisions")
+	h.DbMap.AddTableWithName(Correction{}, "corrections")
+	return h, mock, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func hashOf(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// storeBlob stores content as if uploaded before
+func storeBlob(t *testing.T, h *DbHandler, content string) {
+	tmp := filepath.Join(h.Datapath, "tmp")
+	assert.NoError(t, ioutil.WriteFile(tmp, []byte(content), 0644))
+	assert.NoError(t, h.Blobs.Put(hashOf(content), tmp))
+}
+
+func expectFile(mock sqlmock.Sqlmock, id int, name, content string) {
+	mock.ExpectQuery(`select .* from "files" where "id"=\$1`).WithArgs(id).
+		WillReturnRows(sqlmock.NewRows(fileColumns).AddRow(id, name, name,
+			len(content), hashOf(content), "", []byte("[]"), nil, nil, time.Now()))
+}
+
+// expectRevision expects number to be added as the content of file id,
+// the former one having the corrections cs
+func expectRevision(mock sqlmock.Sqlmock, id, last, number int, content string, cs *sqlmock.Rows) {
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT coalesce\(max\(number\), 0\) FROM file_revisions`).WithArgs(id).
+		WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(last))
+	mock.ExpectQuery(`insert into "file_revisions"`).
+		WithArgs(id, number, hashOf(content), len(content), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(100 + number))
+	mock.ExpectExec(`update "files" set .* where "id"=\$10`).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if cs == nil {
+		cs = sqlmock.NewRows(correctionColumns)
+	}
+	mock.ExpectQuery(`SELECT \* FROM corrections WHERE sha256 = \$1`).WillReturnRows(cs)
+}
+
+func postRevision(h *DbHandler, handler echo.HandlerFunc, target string, content *string) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	w.WriteField("author", "editor")
+	if content != nil {
+		fw, _ := w.CreateFormFile("file", "a.txt")
+		fw.Write([]byte(*content))
+	}
+	w.Close()
+	req := httptest.NewRequest(http.MethodPost, target, &body)
+	req.Header.Set(echo.HeaderContentType, w.FormDataContentType())
+	rec := httptest.NewRecorder()
+	e := echo.New()
+	c := e.NewContext(req, rec)
+	parts := strings.Split(strings.Trim(target, "/"), "/")
+	if len(parts) > 2 {
+		c.SetParamNames("id", "rev")
+		c.SetParamValues(parts[0], parts[2])
+	} else {
+		c.SetParamNames("id")
+		c.SetParamValues(parts[0])
+	}
+	if err := handler(c); err != nil {
+		ErrorHandler(err, c)
+	}
+	return rec
+}
+
+func TestCreateFileRevision(t *testing.T) {
+	h, mock, done := mockFiles(t)
+	defer done()
+	first, second := "いづれの御時にか", "いづれの御時にか、女御更衣あまたさぶらひたまひける中に"
+	storeBlob(t, h, first)
+
+	// numbered after the latest revision, with the corrections kept
+	expectFile(mock, 1, "a.txt", first)
+	expectRevision(mock, 1, 2, 3, second, sqlmock.NewRows(correctionColumns).
+		AddRow(5, hashOf(first), 4, 6, "御時", []byte("{}"), "editor", time.Now()))
+	mock.ExpectQuery(`SELECT count\(\*\) FROM corrections WHERE sha256 = \$1`).WithArgs(hashOf(second)).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectQuery(`insert into "corrections"`).
+		WithArgs(hashOf(second), 4, 6, "御時", sqlmock.AnyArg(), "editor", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(6))
+	mock.ExpectCommit()
+	rec := postRevision(h, h.CreateFileRevision, "/1/revisions", &second)
+	assert.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	var rev FileRevision
+	if assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &rev)) {
+		assert.Equal(t, 3, rev.Number)
+		assert.Equal(t, hashOf(second), rev.Sha256)
+		assert.Equal(t, "editor", rev.Author)
+	}
+	_, err := h.Blobs.Stat(hashOf(second))
+	assert.NoError(t, err)
+
+	// the current content is not a new revision
+	expectFile(mock, 1, "a.txt", second)
+	rec = postRevision(h, h.CreateFileRevision, "/1/revisions", &second)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "unchanged")
+
+	// a content whose revision is not added is removed
+	third := "いとやむごとなき際にはあらぬが"
+	expectFile(mock, 1, "a.txt", second)
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT coalesce\(max\(number\), 0\) FROM file_revisions`).
+		WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(3))
+	mock.ExpectQuery(`insert into "file_revisions"`).WillReturnError(assert.AnError)
+	mock.ExpectRollback()
+	mock.ExpectQuery(`SELECT \(SELECT count\(\*\) FROM files WHERE sha256 = \$1\)`).
+		WithArgs(hashOf(third)).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	rec = postRevision(h, h.CreateFileRevision, "/1/revisions", &third)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	_, err = h.Blobs.Stat(hashOf(third))
+	assert.True(t, os.IsNotExist(err), "%v", err)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRollbackFile(t *testing.T) {
+	h, mock, done := mockFiles(t)
+	defer done()
+	first, second := "いづれの御時にか", "女御更衣あまたさぶらひたまひける中に"
+	storeBlob(t, h, first)
+	storeBlob(t, h, second)
+
+	// the former content comes back as a new revision, the others kept
+	expectFile(mock, 1, "a.txt", second)
+	mock.ExpectQuery(`SELECT \* FROM file_revisions WHERE file_id = \$1 AND number = \$2`).
+		WithArgs(1, 1).WillReturnRows(sqlmock.NewRows(revisionColumns).
+		AddRow(101, 1, 1, hashOf(first), len(first), "", "", time.Now()))
+	expectRevision(mock, 1, 2, 3, first, nil)
+	mock.ExpectCommit()
+	rec := postRevision(h, h.RollbackFile, "/1/revisions/1/rollback", nil)
+	assert.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	var rev FileRevision
+	if assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &rev)) {
+		assert.Equal(t, 3, rev.Number)
+		assert.Equal(t, hashOf(first), rev.Sha256)
+		assert.Equal(t, "rollback to 1", rev.Message)
+	}
+
+	// to the current content is refused
+	expectFile(mock, 1, "a.txt", first)
+	mock.ExpectQuery(`SELECT \* FROM file_revisions WHERE file_id = \$1 AND number = \$2`).
+		WithArgs(1, 3).WillReturnRows(sqlmock.NewRows(revisionColumns).
+		AddRow(103, 1, 3, hashOf(first), len(first), "", "", time.Now()))
+	rec = postRevision(h, h.RollbackFile, "/1/revisions/3/rollback", nil)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+	_, err := h.Blobs.Stat(hashOf(second))
+	assert.NoError(t, err, "the content rolled back from is kept")
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+	"gopkg.in/yaml.v2"
+)
+
+// ValidationOptions configure the validation of uploaded XML files
+type ValidationOptions struct {
+	Mode   string `yaml:"mode"`   // "" (off), warn or reject
+	Schema string `yaml:"schema"` // .rng (checked by xmllint) or .yml subset
+}
+
+const (
+	VALIDATION_WARN   = "warn"
+	VALIDATION_REJECT = "reject"
+)
+
+// ValidationIssue is an error found at Line:Column (1-based, in runes)
+type ValidationIssue struct {
+	Line    int    `json:"line"`
+	Column  int    `json:"column,omitempty"`
+	Kind    string `json:"kind"` // wellformedness or schema
+	Message string `json:"message"`
+}
+
+// ValidationReport is the result of validating a file
+type ValidationReport struct {
+	Valid      bool              `json:"valid"`
+	WellFormed bool              `json:"wellFormed"`
+	Schema     string            `json:"schema,omitempty"`
+	Errors     []ValidationIssue `json:"errors"`
+	Warnings   []string          `json:"warnings,omitempty"`
+}
+
+// Value and Scan store ValidationReport as jsonb
+func (r ValidationReport) Value() (driver.Value, error) {
+	return json.Marshal(r)
+}
+
+func (r *ValidationReport) Scan(src interface{}) error {
+	return scanJSON(src, r)
+}
+
+// TEISubset is a schema listing the elements allowed in a document
+type TEISubset struct {
+	Root     string                   `yaml:"root"`
+	Elements map[string]SubsetElement `yaml:"elements"`
+}
+
+// SubsetElement lists the children and attributes allowed in an element;
+// "*" allows any. Attributes in the xml namespace are written xml:id.
+type SubsetElement struct {
+	Children   []string `yaml:"children"`
+	Attributes []string `yaml:"attributes"`
+	Required   []string `yaml:"required"`
+	Text       bool     `yaml:"text"` // allows non-space character data
+}
+
+func allows(list []string, name string) bool {
+	for _, s := range list {
+		if s == "*" || s == name {
+			return true
+		}
+	}
+	return false
+}
+
+func LoadTEISubset(path string) (*TEISubset, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	ts := &TEISubset{}
+	if err := yaml.Unmarshal(data, ts); err != nil {
+		return nil, err
+	}
+	if len(ts.Elements) == 0 {
+		return nil, fmt.Errorf("%s: no elements", path)
+	}
+	return ts, nil
+}
+
+// lineIndex converts byte offsets of a document into lines and columns
+type lineIndex struct {
+	data  []byte
+	lines []int // offsets of line starts
+}
+
+func newLineIndex(data []byte) *lineIndex {
+	li := &lineIndex{data: data, lines: []int{0}}
+	for i, b := range data {
+		if b == '\n' {
+			li.lines = append(li.lines, i+1)
+		}
+	}
+	return li
+}
+
+func (li *lineIndex) position(offset int) (line, column int) {
+	if offset > len(li.data) {
+		offset = len(li.data)
+	}
+	i := sort.SearchInts(li.lines, offset+1) - 1
+	return i + 1, utf8.RuneCount(li.data[li.lines[i]:offset]) + 1
+}
+
+// checkWellFormed parses data to the end and reports the first error
+func checkWellFormed(data []byte, li *lineIndex) *ValidationIssue {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		_, err := d.Token()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			line, column := li.position(int(d.InputOffset()))
+			msg := err.Error()
+			if se, ok := err.(*xml.SyntaxError); ok {
+				msg = se.Msg
+			}
+			return &ValidationIssue{line, column, "wellformedness", msg}
+		}
+	}
+}
+
+func attrName(a xml.Attr) string {
+	if a.Name.Space == xmlNamespace {
+		return "xml:" + a.Name.Local
+	}
+	if a.Name.Space != "" && a.Name.Space != "xmlns" {
+		return a.Name.Space + ":" + a.Name.Local
+	}
+	return a.Name.Local
+}
+
+// Validate checks a well-formed document against the subset
+func (ts *TEISubset) Validate(data []byte, li *lineIndex) []ValidationIssue {
+	issues := []ValidationIssue{}
+	add := func(offset int, format string, args ...interface{}) {
+		line, column := li.position(offset)
+		issues = append(issues, ValidationIssue{
+			line, column, "schema", fmt.Sprintf(format, args...)})
+	}
+
+	type open struct {
+		name string
+		spec *SubsetElement
+	}
+	var stack []open
+	d := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		offset := int(d.InputOffset())
+		tok, err := d.Token()
+		if err != nil {
+			break
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			name := t.Name.Local
+			if len(stack) == 0 && ts.Root != "" && name != ts.Root {
+				add(offset, "root element must be %s, not %s", ts.Root, name)
+			}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				if parent.spec != nil && !allows(parent.spec.Children, name) {
+					add(offset, "element %s not allowed in %s", name, parent.name)
+				}
+			}
+			var spec *SubsetElement
+			if el, ok := ts.Elements[name]; ok {
+				spec = &el
+				for _, a := range t.Attr {
+					if a.Name.Space == "xmlns" || a.Name.Local == "xmlns" {
+						continue
+					}
+					if an := attrName(a); !allows(spec.Attributes, an) {
+						add(offset, "attribute %s not allowed on %s", an, name)
+					}
+				}
+				for _, req := range spec.Required {
+					found := false
+					for _, a := range t.Attr {
+						if attrName(a) == req {
+							found = true
+							break
+						}
+					}
+					if !found {
+						add(offset, "element %s requires attribute %s", name, req)
+					}
+				}
+			} else {
+				add(offset, "element %s not allowed", name)
+			}
+			stack = append(stack, open{name, spec})
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			if len(stack) == 0 || len(bytes.TrimSpace(t)) == 0 {
+				continue
+			}
+			if top := stack[len(stack)-1]; top.spec != nil && !top.spec.Text {
+				add(offset, "text not allowed in %s", top.name)
+			}
+		}
+	}
+	return issues
+}
+
+var (
+	xmllintError   = regexp.MustCompile(`^-:(\d+): (.*)$`)
+	xmllintElement = regexp.MustCompile(`^element ([^\s:]+):`)
+)
+
+// column finds the start tag of the n-th element name (0-based) on line,
+// where xmllint reports it, and returns its column, or 0
+func (li *lineIndex) column(line int, name string, n int) int {
+	if line < 1 || line > len(li.lines) {
+		return 0
+	}
+	start, end := li.lines[line-1], len(li.data)
+	if line < len(li.lines) {
+		end = li.lines[line]
+	}
+	tag := regexp.MustCompile(`<(?:[\w.-]+:)?` + regexp.QuoteMeta(name) + `[\s/>]`)
+	locs := tag.FindAllIndex(li.data[start:end], n+1)
+	if len(locs) <= n {
+		return 0
+	}
+	_, column := li.position(start + locs[n][0])
+	return column
+}
+
+// parseXmllint reads the errors of xmllint on stderr; the column of those
+// about an element is that of its start tag
+func parseXmllint(stderr string, li *lineIndex) []ValidationIssue {
+	issues := []ValidationIssue{}
+	seen := map[string]int{} // line and element -> errors so far
+	for _, l := range strings.Split(stderr, "\n") {
+		m := xmllintError.FindStringSubmatch(l)
+		if m == nil {
+			continue
+		}
+		line, _ := strconv.Atoi(m[1])
+		issue := ValidationIssue{Line: line, Kind: "schema", Message: m[2]}
+		if e := xmllintElement.FindStringSubmatch(m[2]); e != nil {
+			key := m[1] + ":" + e[1]
+			issue.Column = li.column(line, e[1], seen[key])
+			seen[key]++
+		}
+		issues = append(issues, issue)
+	}
+	return issues
+}
+
+// validateRelaxNG validates data with xmllint against a RELAX NG schema
+func validateRelaxNG(schema string, data []byte, li *lineIndex) ([]ValidationIssue, error) {
+	path, err := exec.LookPath("xmllint")
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, path, "--noout", "--relaxng", schema, "-")
+	cmd.Stdin = bytes.NewReader(data)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if _, ok := err.(*exec.ExitError); err != nil && !ok {
+		return nil, err
+	}
+
+	issues := parseXmllint(stderr.String(), li)
+	if err != nil && len(issues) == 0 {
+		return nil, fmt.Errorf("xmllint: %s", strings.TrimSpace(stderr.String()))
+	}
+	return issues, nil
+}
+
+// loadSchema checks that the configured schema can be used, loading a
+// subset once for all validations
+func (h *DbHandler) loadSchema() error {
+	if h.Validation == nil || h.Validation.Schema == "" {
+		return nil
+	}
+	schema := h.Validation.Schema
+	if strings.HasSuffix(schema, ".rng") {
+		if _, err := exec.LookPath("xmllint"); err != nil {
+			return err
+		}
+		_, err := os.Stat(schema)
+		return err
+	}
+	ts, err := LoadTEISubset(schema)
+	if err != nil {
+		return err
+	}
+	h.teiSubset = ts
+	return nil
+}
+
+// ValidateXML checks that data is well-formed and valid against the
+// configured schema. A schema which cannot be checked gives a warning,
+// or an error in reject mode.
+func (h *DbHandler) ValidateXML(data []byte) *ValidationReport {
+	li := newLineIndex(data)
+	report := &ValidationReport{Errors: []ValidationIssue{}}
+	if issue := checkWellFormed(data, li); issue != nil {
+		report.Errors = append(report.Errors, *issue)
+		return report
+	}
+	report.WellFormed = true
+
+	if h.Validation != nil && h.Validation.Schema != "" {
+		schema := h.Validation.Schema
+		report.Schema = filepath.Base(schema)
+		var (
+			issues []ValidationIssue
+			err    error
+		)
+		if strings.HasSuffix(schema, ".rng") {
+			issues, err = validateRelaxNG(schema, data, li)
+		} else {
+			ts := h.teiSubset
+			if ts == nil {
+				ts, err = LoadTEISubset(schema)
+			}
+			if err == nil {
+				issues = ts.Validate(data, li)
+			}
+		}
+		if err != nil {
+			msg := fmt.Sprintf("schema not checked: %s", err)
+			if h.Validation.Mode == VALIDATION_REJECT {
+				issues = append(issues, ValidationIssue{Kind: "schema", Message: msg})
+			} else {
+				report.Warnings = append(report.Warnings, msg)
+			}
+		}
+		report.Errors = append(report.Errors, issues...)
+	}
+	report.Valid = len(report.Errors) == 0
+	return report
+}
+
+// validateStored validates a stored XML file according to the
+// configuration; other files and a disabled validation give nil.
+func (h *DbHandler) validateStored(f *File) (*ValidationReport, error) {
+	if h.Validation == nil || h.Validation.Mode == "" ||
+		filepath.Ext(f.Name) != ".xml" {
+		return nil, nil
+	}
+	data, err := h.ReadFile(f.Sha256)
+	if err != nil {
+		return nil, err
+	}
+	return h.validateContent(f, data), nil
+}
+
+// validateContent validates data, the content of f, as validateStored
+func (h *DbHandler) validateContent(f *File, data []byte) *ValidationReport {
+	if h.Validation == nil || h.Validation.Mode == "" ||
+		filepath.Ext(f.Name) != ".xml" {
+		return nil
+	}
+	return h.ValidateXML(data)
+}
+
+// invalidFile is the response to an upload rejected by validation
+type invalidFile struct {
+	*Error
+	Report *ValidationReport `json:"report"`
+}
+
+// POST
+
+// ValidateFile validates an uploaded file without storing it
+func (h *DbHandler) ValidateFile(c echo.Context) error {
+	fh, err := c.FormFile("file")
+	if err != nil {
+		return badRequest(c, "formfile", err)
+	}
+	src, err := fh.Open()
+	if err != nil {
+		return badRequest(c, "fileopen", err)
+	}
+	defer src.Close()
+	data, err := ioutil.ReadAll(src)
+	if err != nil {
+		return badRequest(c, "fileopen", err)
+	}
+	return c.JSON(http.StatusOK, h.ValidateXML(data))
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckWellFormed(t *testing.T) {
+	data := []byte("<TEI>\n  <text>本文</p>\n</TEI>")
+	issue := checkWellFormed(data, newLineIndex(data))
+	if assert.NotNil(t, issue) {
+		assert.Equal(t, 2, issue.Line)
+		assert.Equal(t, 15, issue.Column) // after </p>, counted in runes
+		assert.Equal(t, "wellformedness", issue.Kind)
+	}
+
+	data = []byte("<TEI><text/></TEI>")
+	assert.Nil(t, checkWellFormed(data, newLineIndex(data)))
+}
+
+func TestTEISubsetValidate(t *testing.T) {
+	ts, err := LoadTEISubset("tei_subset.yml")
+	if !assert.NoError(t, err) {
+		return
+	}
+	data := []byte(`<TEI xmlns="http://www.tei-c.org/ns/1.0" xml:lang="ja">
+<text><body>
+<p rend="indent">本文<lb n="1"/><blink>x</blink></p>
+<lb color="red"/>text
+</body></text>
+</TEI>`)
+	issues := ts.Validate(data, newLineIndex(data))
+	if assert.Len(t, issues, 4) {
+		assert.Equal(t, ValidationIssue{3, 31, "schema", "element blink not allowed in p"}, issues[0])
+		assert.Equal(t, "element blink not allowed", issues[1].Message)
+		assert.Equal(t, ValidationIssue{4, 1, "schema", "attribute color not allowed on lb"}, issues[2])
+		assert.Equal(t, "text not allowed in body", issues[3].Message)
+	}
+
+	data = []byte(`<text/>`)
+	issues = ts.Validate(data, newLineIndex(data))
+	assert.Equal(t, []ValidationIssue{{1, 1, "schema", "root element must be TEI, not text"}}, issues)
+}
+
+func TestValidateXMLUnchecked(t *testing.T) {
+	h := &DbHandler{Validation: &ValidationOptions{Mode: VALIDATION_WARN, Schema: "missing.yml"}}
+	report := h.ValidateXML([]byte("<TEI/>"))
+	assert.True(t, report.Valid)
+	assert.Len(t, report.Warnings, 1)
+
+	h.Validation.Mode = VALIDATION_REJECT
+	report = h.ValidateXML([]byte("<TEI/>"))
+	assert.False(t, report.Valid)
+	assert.Len(t, report.Errors, 1)
+	assert.Error(t, h.loadSchema())
+}
+
+func TestParseXmllint(t *testing.T) {
+	data := []byte("<TEI>\n  <p>a</p><blink/><p>b</p><blink>c</blink>\n<tei:p x=\"1\">c</tei:p></TEI>")
+	issues := parseXmllint("-:2: element blink: Relax-NG validity error : Did not expect element blink there\n"+
+		"-:2: element blink: Relax-NG validity error : Did not expect element blink there\n"+
+		"-:3: element p: Relax-NG validity error : Invalid attribute x for element p\n"+
+		"- fails to validate\n", newLineIndex(data))
+	assert.Equal(t, []ValidationIssue{
+		{2, 11, "schema", "element blink: Relax-NG validity error : Did not expect element blink there"},
+		{2, 28, "schema", "element blink: Relax-NG validity error : Did not expect element blink there"},
+		{3, 1, "schema", "element p: Relax-NG validity error : Invalid attribute x for element p"},
+	}, issues)
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// FsckOptions choose what the storage check verifies and repairs
+type FsckOptions struct {
+	Rehash     bool          // re-hash every content
+	Repair     bool          // fix the rows and remove orphans
+	Quarantine bool          // move bad contents aside
+	Grace      time.Duration // orphans younger are kept
+}
+
+// DEFAULT_FSCK_GRACE keeps contents being uploaded when they are checked
+const DEFAULT_FSCK_GRACE = time.Hour
+
+// MissingBlob is a content referred to but not stored
+type MissingBlob struct {
+	Hash      string   `json:"sha256"`
+	Files     []int    `json:"files,omitempty"`
+	Revisions []string `json:"revisions,omitempty"` // ID@REV
+}
+
+// FsckReport is the result of a storage check
+type FsckReport struct {
+	Started   time.Time     `json:"started"`
+	Files     int           `json:"files"`
+	Revisions int           `json:"revisions"`
+	Blobs     int           `json:"blobs"`
+	Missing   []MissingBlob `json:"missing"`
+	Corrupt   []string      `json:"corrupt"` // contents whose sha256 differs
+	Orphans   []BlobInfo    `json:"orphans"`
+	Actions   []string      `json:"actions"`
+	Errors    []string      `json:"errors"`
+}
+
+func (h *DbHandler) quarantineDir() string {
+	return filepath.Join(h.Datapath, ".quarantine")
+}
+
+// quarantine copies a stored content aside and removes it from the store
+func (h *DbHandler) quarantine(hash string) error {
+	if err := os.MkdirAll(h.quarantineDir(), 0755); err != nil {
+		return err
+	}
+	r, err := h.Blobs.Open(hash)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	name := filepath.Join(h.quarantineDir(), hash+"."+time.Now().Format("20060102150405"))
+	w, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return h.Blobs.Remove(hash)
+}
+
+// rehash reports whether a stored content still has its sha256
+func (h *DbHandler) rehash(hash string) (bool, error) {
+	r, err := h.Blobs.Open(hash)
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+	sha := sha256.New()
+	if _, err := io.Copy(sha, r); err != nil {
+		return false, err
+	}
+	return hex.EncodeToString(sha.Sum(nil)) == hash, nil
+}
+
+// fsckRows updates and deletes the rows repaired, as gorp.DbMap does
+type fsckRows interface {
+	Update(list ...interface{}) (int64, error)
+	Delete(list ...interface{}) (int64, error)
+}
+
+// Fsck reconciles the files and revisions with the stored contents
+func (h *DbHandler) Fsck(opts FsckOptions) (*FsckReport, error) {
+	return h.fsck(opts, func() ([]File, []FileRevision, error) {
+		var files []File
+		if _, err := h.DbMap.Select(&files, "SELECT * FROM files ORDER BY id"); err != nil {
+			return nil, nil, err
+		}
+		var revs []FileRevision
+		if _, err := h.DbMap.Select(&revs,
+			"SELECT * FROM file_revisions ORDER BY file_id, number"); err != nil {
+			return nil, nil, err
+		}
+		return files, revs, nil
+	}, h.DbMap)
+}
+
+// fsck checks the files and revisions given by load, ordered by id and
+// number, against the stored contents and repairs them through rows.
+// The files are locked only once the contents are re-hashed.
+func (h *DbHandler) fsck(opts FsckOptions, load func() ([]File, []FileRevision, error), rows fsckRows) (*FsckReport, error) {
+	report := &FsckReport{Started: time.Now(), Missing: []MissingBlob{},
+		Corrupt: []string{}, Orphans: []BlobInfo{}, Actions: []string{}, Errors: []string{}}
+	fail := func(format string, args ...interface{}) {
+		report.Errors = append(report.Errors, fmt.Sprintf(format, args...))
+	}
+	act := func(format string, args ...interface{}) {
+		report.Actions = append(report.Actions, fmt.Sprintf(format, args...))
+	}
+
+	// contents stored again since they were re-hashed are not corrupt
+	corrupt := map[string]time.Time{}
+	if opts.Rehash {
+		blobs, err := h.Blobs.List()
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range blobs {
+			ok, err := h.rehash(b.Hash)
+			if err != nil {
+				fail("rehash: %s: %s", b.Hash, err)
+			} else if !ok {
+				corrupt[b.Hash] = b.ModTime
+			}
+		}
+	}
+
+	lockFile.Lock()
+	defer lockFile.Unlock()
+
+	files, revs, err := load()
+	if err != nil {
+		return nil, err
+	}
+	blobs, err := h.Blobs.List()
+	if err != nil {
+		return nil, err
+	}
+	report.Files, report.Revisions, report.Blobs = len(files), len(revs), len(blobs)
+
+	stored := map[string]BlobInfo{}
+	for _, b := range blobs {
+		stored[b.Hash] = b
+	}
+
+	// contents stored but corrupt count as missing once quarantined
+	if opts.Rehash {
+		for _, b := range blobs {
+			if t, ok := corrupt[b.Hash]; !ok || !t.Equal(b.ModTime) {
+				continue
+			}
+			report.Corrupt = append(report.Corrupt, b.Hash)
+			if opts.Quarantine {
+				if err := h.quarantine(b.Hash); err != nil {
+					fail("quarantine: %s: %s", b.Hash, err)
+					continue
+				}
+				delete(stored, b.Hash)
+				act("quarantined: %s", b.Hash)
+			}
+		}
+	}
+
+	missing := map[string]*MissingBlob{}
+	miss := func(hash string) *MissingBlob {
+		if missing[hash] == nil {
+			missing[hash] = &MissingBlob{Hash: hash}
+		}
+		return missing[hash]
+	}
+	referred := map[string]bool{}
+	for _, f := range files {
+		referred[f.Sha256] = true
+		if _, ok := stored[f.Sha256]; !ok {
+			m := miss(f.Sha256)
+			m.Files = append(m.Files, f.Id)
+		}
+	}
+	for _, r := range revs {
+		referred[r.Sha256] = true
+		if _, ok := stored[r.Sha256]; !ok {
+			m := miss(r.Sha256)
+			m.Revisions = append(m.Revisions, fmt.Sprintf("%d@%d", r.FileId, r.Number))
+		}
+	}
+	for _, m := range missing {
+		report.Missing = append(report.Missing, *m)
+	}
+	sort.Slice(report.Missing, func(i, j int) bool {
+		return report.Missing[i].Hash < report.Missing[j].Hash
+	})
+
+	grace := opts.Grace
+	if grace == 0 {
+		grace = DEFAULT_FSCK_GRACE
+	}
+	for _, b := range blobs {
+		if _, ok := stored[b.Hash]; ok && !referred[b.Hash] &&
+			report.Started.Sub(b.ModTime) >= grace {
+			report.Orphans = append(report.Orphans, b)
+		}
+	}
+
+	if !opts.Repair {
+		return report, nil
+	}
+
+	// orphans are removed, or moved aside
+	for _, b := range report.Orphans {
+		if opts.Quarantine {
+			err = h.quarantine(b.Hash)
+		} else {
+			err = h.Blobs.Remove(b.Hash)
+		}
+		if err != nil {
+			fail("orphan: %s: %s", b.Hash, err)
+		} else if opts.Quarantine {
+			act("quarantined: %s", b.Hash)
+		} else {
+			act("removed: %s", b.Hash)
+		}
+	}
+
+	// revisions without content are dropped; a file without content goes
+	// back to its latest revision stored, or is deleted
+	byFile := map[int][]FileRevision{}
+	for _, r := range revs {
+		byFile[r.FileId] = append(byFile[r.FileId], r)
+	}
+	for idx := range files {
+		f := &files[idx]
+		var kept *FileRevision
+		for i := range byFile[f.Id] {
+			r := &byFile[f.Id][i]
+			if _, ok := stored[r.Sha256]; ok {
+				kept = r
+				continue
+			}
+			if _, err := rows.Delete(r); err != nil {
+				fail("revision: %d@%d: %s", r.FileId, r.Number, err)
+				continue
+			}
+			act("deleted: revision %d@%d", r.FileId, r.Number)
+		}
+		if _, ok := stored[f.Sha256]; ok {
+			continue
+		}
+		if kept == nil {
+			if _, err := rows.Delete(f); err != nil {
+				fail("file: %d: %s", f.Id, err)
+				continue
+			}
+			act("deleted: file %d: %s", f.Id, f.Name)
+			if h.Index != nil {
+				if err := h.Index.UnindexFile(f.Id); err != nil {
+					fail("unindex: %d: %s", f.Id, err)
+				}
+			}
+			continue
+		}
+		f.Sha256, f.Size, f.Updated = kept.Sha256, kept.Size, time.Now()
+		f.Keywords = nil
+		if err := h.describeFile(f); err != nil {
+			fail("describe: %d: %s", f.Id, err)
+		}
+		if _, err := rows.Update(f); err != nil {
+			fail("file: %d: %s", f.Id, err)
+			continue
+		}
+		act("restored: file %d: revision %d", f.Id, kept.Number)
+		if h.Index != nil {
+			if err := h.Index.IndexFile(f); err != nil {
+				fail("index: %d: %s", f.Id, err)
+			}
+		}
+	}
+	return report, nil
+}
+
+// FsckCommand runs "texts-api fsck [flags]" and prints the report; it
+// fails when problems remain
+func (h *DbHandler) FsckCommand(args []string) error {
+	var opts FsckOptions
+	fs := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	fs.BoolVar(&opts.Rehash, "rehash", false, "re-hash every content")
+	fs.BoolVar(&opts.Repair, "repair", false, "fix the rows and remove orphans")
+	fs.BoolVar(&opts.Quarantine, "quarantine", false, "move bad contents to "+h.quarantineDir())
+	fs.DurationVar(&opts.Grace, "grace", DEFAULT_FSCK_GRACE, "keep orphans younger")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	h.DbMap.TraceOff()
+	report, err := h.Fsck(opts)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		return err
+	}
+	if len(report.Errors) > 0 {
+		return fmt.Errorf("fsck: %d errors", len(report.Errors))
+	}
+	if !opts.Repair && len(report.Missing)+len(report.Corrupt)+len(report.Orphans) > 0 {
+		return fmt.Errorf("fsck: %d missing, %d corrupt, %d orphans",
+			len(report.Missing), len(report.Corrupt), len(report.Orphans))
+	}
+	return nil
+}
+
+// fsckOptions reads ?rehash=, ?repair=, ?quarantine= and ?grace= (a
+// duration)
+func fsckOptions(c echo.Context) (FsckOptions, error) {
+	var opts FsckOptions
+	for name, v := range map[string]*bool{
+		"rehash": &opts.Rehash, "repair": &opts.Repair, "quarantine": &opts.Quarantine,
+	} {
+		if s := c.QueryParam(name); s != "" {
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				return opts, fmt.Errorf("%s: %s", name, err)
+			}
+			*v = b
+		}
+	}
+	if s := c.QueryParam("grace"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return opts, fmt.Errorf("grace: %s", err)
+		}
+		opts.Grace = d
+	}
+	return opts, nil
+}
+
+// GET
+
+// GetFsck checks the storage without changing it
+func (h *DbHandler) GetFsck(c echo.Context) error {
+	opts, err := fsckOptions(c)
+	if err != nil {
+		return badRequest(c, "fsckoptions", err)
+	}
+	opts.Repair, opts.Quarantine = false, false
+	report, err := h.Fsck(opts)
+	if err != nil {
+		return badRequest(c, "fsck", err)
+	}
+	return c.JSON(http.StatusOK, report)
+}
+
+// POST
+
+// PostFsck checks the storage and, with ?repair=true, repairs it
+func (h *DbHandler) PostFsck(c echo.Context) error {
+	opts, err := fsckOptions(c)
+	if err != nil {
+		return badRequest(c, "fsckoptions", err)
+	}
+	report, err := h.Fsck(opts)
+	if err != nil {
+		return badRequest(c, "fsck", err)
+	}
+	c.Logger().Infof("fsck: %d actions, %d errors", len(report.Actions), len(report.Errors))
+	return c.JSON(http.StatusOK, report)
+}
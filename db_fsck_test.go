@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeRows records the rows repaired by fsck
+type fakeRows struct {
+	updated, deleted []interface{}
+}
+
+func (r *fakeRows) Update(list ...interface{}) (int64, error) {
+	r.updated = append(r.updated, list...)
+	return int64(len(list)), nil
+}
+
+func (r *fakeRows) Delete(list ...interface{}) (int64, error) {
+	r.deleted = append(r.deleted, list...)
+	return int64(len(list)), nil
+}
+
+func TestFsck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsck-")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewLocalStore(dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+	h := &DbHandler{Datapath: dir, Blobs: store}
+
+	hashOf := func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+	old := time.Now().Add(-2 * DEFAULT_FSCK_GRACE)
+	put := func(hash, content string) {
+		path := filepath.Join(dir, hash)
+		assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+		assert.NoError(t, os.Chtimes(path, old, old))
+	}
+	first, second := "<TEI>first</TEI>", "<TEI>second</TEI>"
+	put(hashOf(first), first)
+	corrupt := hashOf("<TEI>third</TEI>")
+	put(corrupt, "<TEI>changed</TEI>")
+	orphan := hashOf("orphan")
+	put(orphan, "orphan")
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, hashOf("young")), []byte("young"), 0644))
+
+	files := []File{
+		{Id: 1, Name: "a.xml", Sha256: hashOf(second)},
+		{Id: 2, Name: "b.txt", Sha256: hashOf("gone")},
+		{Id: 3, Name: "c.xml", Sha256: corrupt},
+	}
+	revs := []FileRevision{
+		{FileId: 1, Number: 1, Sha256: hashOf(first), Size: int64(len(first))},
+		{FileId: 1, Number: 2, Sha256: hashOf(second)},
+		{FileId: 2, Number: 1, Sha256: hashOf("gone")},
+		{FileId: 3, Number: 1, Sha256: corrupt},
+	}
+
+	load := func() ([]File, []FileRevision, error) { return files, revs, nil }
+	rows := &fakeRows{}
+	report, err := h.fsck(FsckOptions{Rehash: true}, load, rows)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 4, report.Blobs)
+	assert.ElementsMatch(t, []MissingBlob{
+		{Hash: hashOf(second), Files: []int{1}, Revisions: []string{"1@2"}},
+		{Hash: hashOf("gone"), Files: []int{2}, Revisions: []string{"2@1"}},
+	}, report.Missing)
+	assert.Equal(t, []string{corrupt}, report.Corrupt)
+	if assert.Len(t, report.Orphans, 1) {
+		assert.Equal(t, orphan, report.Orphans[0].Hash)
+	}
+	assert.Empty(t, report.Actions)
+	assert.Empty(t, rows.updated)
+	assert.Empty(t, rows.deleted)
+
+	// repair goes back to the latest revision stored
+	report, err = h.fsck(FsckOptions{Repair: true}, load, rows)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Empty(t, report.Errors)
+	assert.Equal(t, []interface{}{&revs[1], &revs[2], &files[1]}, rows.deleted)
+	if assert.Len(t, rows.updated, 1) {
+		f := rows.updated[0].(*File)
+		assert.Equal(t, 1, f.Id)
+		assert.Equal(t, hashOf(first), f.Sha256)
+		assert.Equal(t, int64(len(first)), f.Size)
+	}
+	assert.Contains(t, report.Actions, "restored: file 1: revision 1")
+	assert.Contains(t, report.Actions, "removed: "+orphan)
+	_, err = store.Stat(orphan)
+	assert.True(t, os.IsNotExist(err))
+	_, err = store.Stat(hashOf("young"))
+	assert.NoError(t, err)
+
+	// a corrupt content quarantined is missing
+	report, err = h.fsck(FsckOptions{Rehash: true, Quarantine: true}, load, &fakeRows{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Contains(t, report.Actions, "quarantined: "+corrupt)
+	assert.Contains(t, report.Missing, MissingBlob{Hash: corrupt, Files: []int{3}, Revisions: []string{"3@1"}})
+	_, err = store.Stat(corrupt)
+	assert.True(t, os.IsNotExist(err))
+}
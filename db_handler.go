@@ -9,13 +9,28 @@ import (
 	"strings"
 
 	"github.com/go-gorp/gorp/v3"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 type DbHandler struct {
-	Db       *sql.DB
-	DbMap    *gorp.DbMap
-	Datapath string
+	Db          *sql.DB
+	DbMap       *gorp.DbMap
+	Datapath    string
+	Blobs       BlobStore
+	Variants    *VariantTable
+	Validation  *ValidationOptions
+	Uploads     *UploadOptions
+	Compression []string    // Content-Encodings of downloads
+	Index       FileIndexer // search index kept with the files, if any
+
+	teiSubset *TEISubset  // Validation.Schema when a subset
+	indexing  *indexQueue // files waiting for the Index
+}
+
+// FileIndexer keeps an index of the contents of files
+type FileIndexer interface {
+	IndexFile(f *File) error
+	UnindexFile(id int) error
 }
 
 // constructor
@@ -34,6 +49,13 @@ func NewDbHandler(cfg *config) (dbh *DbHandler, err error) {
 	t := dbh.DbMap.AddTableWithName(File{}, "files")
 	t.AddIndex("files_sha256_idx", "Btree", []string{"sha256"}).SetUnique(true)
 
+	t = dbh.DbMap.AddTableWithName(FileRevision{}, "file_revisions")
+	t.SetUniqueTogether("file_id", "number")
+
+	dbh.DbMap.AddTableWithName(Upload{}, "uploads")
+
+	dbh.DbMap.AddTableWithName(SearchEntry{}, "search_texts")
+
 	dbh.DbMap.AddTableWithName(JSONDatum{}, "json_data")
 
 	dbh.DbMap.AddTableWithName(Entity{}, "entities")
@@ -42,6 +64,15 @@ func NewDbHandler(cfg *config) (dbh *DbHandler, err error) {
 	t = dbh.DbMap.AddTableWithName(EntityExactMatch{}, "entities_exact_matches")
 	t.SetUniqueTogether("entity_id", "exact_match")
 
+	dbh.DbMap.AddTableWithName(Variant{}, "variants")
+
+	t = dbh.DbMap.AddTableWithName(Correction{}, "corrections")
+	t.AddIndex("corrections_sha256_idx", "Btree", []string{"sha256"})
+
+	dbh.DbMap.AddTableWithName(TopicRun{}, "topic_runs")
+	t = dbh.DbMap.AddTableWithName(TopicDoc{}, "topic_docs")
+	t.SetUniqueTogether("run_id", "file_id")
+
 	dbh.DbMap.TraceOn("[gorp]",
 		log.New(os.Stdout, "texts-api:", log.Lmicroseconds))
 
@@ -53,9 +84,39 @@ func NewDbHandler(cfg *config) (dbh *DbHandler, err error) {
 		!strings.HasSuffix(err.Error(), "すでに存在します") {
 		log.Fatal(err)
 	}
+	for _, q := range migrations {
+		if _, err = dbh.DbMap.Exec(q); err != nil {
+			log.Fatal(err)
+		}
+	}
+	// topic models do not survive a restart
+	if _, err = dbh.DbMap.Exec(
+		"UPDATE topic_runs SET status = $1, error = 'interrupted' WHERE status = $2",
+		TOPIC_FAILED, TOPIC_RUNNING); err != nil {
+		log.Fatal(err)
+	}
+
+	variants, err := dbh.loadVariants()
+	if err != nil {
+		return
+	}
+	dbh.Variants = NewVariantTable(variants)
 
 	dbh.Datapath = cfg.Db.Datapath
-	err = os.MkdirAll(dbh.Datapath, 0755)
+	dbh.Validation = &cfg.Db.Validation
+	if err = dbh.loadSchema(); err != nil {
+		if dbh.Validation.Mode == VALIDATION_REJECT {
+			return
+		}
+		log.Printf("schema not checked: %s", err)
+		err = nil
+	}
+	dbh.Uploads = &cfg.Db.Uploads
+	if err = checkEncodings(cfg.Db.Compression); err != nil {
+		return
+	}
+	dbh.Compression = cfg.Db.Compression
+	dbh.Blobs, err = NewBlobStore(cfg.Db.Storage, dbh.Datapath)
 	if err != nil {
 		return
 	}
@@ -63,6 +124,20 @@ func NewDbHandler(cfg *config) (dbh *DbHandler, err error) {
 	return dbh, err
 }
 
+// migrations add columns to tables created by older versions
+var migrations = []string{
+	"ALTER TABLE files ADD COLUMN IF NOT EXISTS genre text NOT NULL DEFAULT ''",
+	"ALTER TABLE files ADD COLUMN IF NOT EXISTS keywords jsonb NOT NULL DEFAULT '[]'",
+	"ALTER TABLE files ADD COLUMN IF NOT EXISTS validation jsonb",
+	"ALTER TABLE files ADD COLUMN IF NOT EXISTS metadata jsonb",
+	"CREATE INDEX IF NOT EXISTS search_texts_grams_idx ON search_texts USING gin (grams)",
+	"CREATE INDEX IF NOT EXISTS search_texts_lemmas_idx ON search_texts USING gin (lemmas)",
+	// files stored before revisions start with their content as the first
+	"INSERT INTO file_revisions (file_id, number, sha256, size, author, message, created) " +
+		"SELECT id, 1, sha256, size, '', '', updated FROM files f WHERE NOT EXISTS " +
+		"(SELECT 1 FROM file_revisions r WHERE r.file_id = f.id)",
+}
+
 // CustomPostgresDialect for gorp to manipulate json
 /*
 	original:
@@ -74,8 +149,19 @@ type CustomPostgresDialect struct {
 }
 
 func (d CustomPostgresDialect) ToSqlType(val reflect.Type, maxsize int, isAutoIncr bool) string {
-	if val == reflect.TypeOf((json.RawMessage)(nil)) {
+	if val == reflect.TypeOf((json.RawMessage)(nil)) ||
+		val == reflect.TypeOf(NodeFeatures{}) ||
+		val == reflect.TypeOf(Keywords{}) ||
+		val == reflect.TypeOf(TopicOptions{}) ||
+		val == reflect.TypeOf(Topics{}) ||
+		val == reflect.TypeOf(TopicDist{}) ||
+		val == reflect.TypeOf((*ValidationReport)(nil)) ||
+		val == reflect.TypeOf((*TEIMetadata)(nil)) ||
+		val == reflect.TypeOf(SearchHits{}) {
 		return "jsonb"
 	}
+	if val == reflect.TypeOf(pq.StringArray{}) {
+		return "text[]"
+	}
 	return d.PostgresDialect.ToSqlType(val, maxsize, isAutoIncr)
 }
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// UploadOptions configure resumable uploads
+type UploadOptions struct {
+	Dir     string `yaml:"dir"`     // partial contents; default in the temp dir
+	Expiry  string `yaml:"expiry"`  // since the last chunk, e.g. 24h
+	MaxSize int64  `yaml:"maxSize"` // bytes, 0 for no limit
+}
+
+const (
+	TUS_VERSION      = "1.0.0"
+	TUS_EXTENSIONS   = "creation,expiration,termination"
+	TUS_CONTENT_TYPE = "application/offset+octet-stream"
+
+	DEFAULT_UPLOAD_EXPIRY = 24 * time.Hour
+)
+
+// Upload is a content received in chunks with the tus protocol
+// (https://tus.io/protocols/resumable-upload); it becomes a File when
+// complete.
+type Upload struct {
+	Id      string    `db:"id,primarykey" json:"id"`
+	Name    string    `db:"name" json:"name"`
+	Genre   string    `db:"genre" json:"genre"`
+	Author  string    `db:"author" json:"author"`
+	Message string    `db:"message" json:"message"`
+	Size    int64     `db:"size,notnull" json:"size"`
+	Offset  int64     `db:"upload_offset,notnull" json:"offset"`
+	State   []byte    `db:"state" json:"-"` // of the incremental sha256
+	FileId  int       `db:"file_id" json:"fileId,omitempty"`
+	Error   string    `db:"error" json:"error,omitempty"`
+	Created time.Time `db:"created,notnull" json:"created"`
+	Expires time.Time `db:"expires,notnull" json:"expires"`
+}
+
+// uploadLocks serialize the requests on each upload
+var uploadLocks sync.Map
+
+func lockUpload(id string) func() {
+	m, _ := uploadLocks.LoadOrStore(id, &sync.Mutex{})
+	m.(*sync.Mutex).Lock()
+	return m.(*sync.Mutex).Unlock
+}
+
+func (h *DbHandler) uploadDir() string {
+	if h.Uploads != nil && h.Uploads.Dir != "" {
+		return h.Uploads.Dir
+	}
+	return filepath.Join(os.TempDir(), "texts-api-uploads")
+}
+
+func (h *DbHandler) uploadExpiry() time.Duration {
+	if h.Uploads != nil && h.Uploads.Expiry != "" {
+		if d, err := time.ParseDuration(h.Uploads.Expiry); err == nil {
+			return d
+		}
+	}
+	return DEFAULT_UPLOAD_EXPIRY
+}
+
+func (h *DbHandler) uploadPath(id string) string {
+	return filepath.Join(h.uploadDir(), id)
+}
+
+// parseUploadMetadata parses "key base64,key base64" of Upload-Metadata
+func parseUploadMetadata(s string) (map[string]string, error) {
+	md := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		fields := strings.Fields(pair)
+		if len(fields) == 0 {
+			continue
+		}
+		v := []byte{}
+		if len(fields) > 1 {
+			var err error
+			if v, err = base64.StdEncoding.DecodeString(fields[1]); err != nil {
+				return nil, fmt.Errorf("metadata %s: %s", fields[0], err)
+			}
+		}
+		md[fields[0]] = string(v)
+	}
+	return md, nil
+}
+
+// uploadHeaders sets the headers of the state of u
+func uploadHeaders(c echo.Context, u *Upload) {
+	hd := c.Response().Header()
+	hd.Set("Tus-Resumable", TUS_VERSION)
+	hd.Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	hd.Set("Upload-Length", strconv.FormatInt(u.Size, 10))
+	hd.Set("Upload-Expires", u.Expires.UTC().Format(http.TimeFormat))
+	hd.Set("Cache-Control", "no-store")
+	if u.FileId != 0 {
+		hd.Set("Upload-File-Id", strconv.Itoa(u.FileId))
+	}
+}
+
+// getUpload returns the upload of :id which has not expired
+func (h *DbHandler) getUpload(c echo.Context) (*Upload, error) {
+	obj, err := h.DbMap.Get(Upload{}, c.Param("id"))
+	if err != nil {
+		return nil, badRequest(c, "getupload", err)
+	}
+	if obj == nil {
+		return nil, notFound(c, "getupload", c.Param("id"))
+	}
+	u := obj.(*Upload)
+	if u.FileId == 0 && time.Now().After(u.Expires) {
+		c.Logger().Errorf("%d:getupload:%s expired", http.StatusGone, u.Id)
+		return nil, newHTTPError(http.StatusGone, "getupload", u.Id+" expired")
+	}
+	return u, nil
+}
+
+// restoreHash resumes the sha256 of the content received so far
+func (u *Upload) restoreHash() (hash.Hash, error) {
+	sha := sha256.New()
+	if len(u.State) > 0 {
+		if err := sha.(encoding.BinaryUnmarshaler).UnmarshalBinary(u.State); err != nil {
+			return nil, err
+		}
+	}
+	return sha, nil
+}
+
+// finishUpload stores the complete content of u and adds its file
+func (h *DbHandler) finishUpload(c echo.Context, u *Upload, sha hash.Hash) error {
+	lockFile.Lock()
+	defer lockFile.Unlock()
+
+	f := File{
+		Name:    u.Name,
+		Path:    u.Name,
+		Size:    u.Size,
+		Sha256:  hex.EncodeToString(sha.Sum(nil)),
+		Genre:   u.Genre,
+		Updated: time.Now(),
+	}
+	// the content is checked before it is stored, so that the upload
+	// keeps it when refused and can be finished again
+	if filepath.Ext(f.Name) == ".xml" {
+		data, err := ioutil.ReadFile(h.uploadPath(u.Id))
+		if err != nil {
+			return h.failUpload(c, u, badRequest(c, "readupload", err))
+		}
+		if invalid := h.judgeValid(c, &f, h.validateContent(&f, data)); invalid != nil {
+			return h.failUpload(c, u, invalid.Error)
+		}
+		describeContent(&f, data)
+	}
+
+	// once stored, the content has left the upload, which starts again
+	// if the file cannot be added
+	if err := h.Blobs.Put(f.Sha256, h.uploadPath(u.Id)); err != nil {
+		return h.restartUpload(c, u, badRequest(c, "putblob", err))
+	}
+	if err := h.insertFile(c, &f, &revisionRequest{Author: u.Author, Message: u.Message}); err != nil {
+		if err := h.removeUnused(f.Sha256); err != nil {
+			c.Logger().Errorf("remove: %s: %s", f.Sha256, err)
+		}
+		return h.restartUpload(c, u, err)
+	}
+	h.indexFile(c, &f)
+	u.FileId, u.Error = f.Id, ""
+	if _, err := h.DbMap.Update(u); err != nil {
+		return badRequest(c, "updateupload", err)
+	}
+	c.Logger().Infof("added: %d: %s: upload %s", f.Id, f.Name, u.Id)
+	return nil
+}
+
+// failUpload records err on u, which remains to report it until it
+// expires, and returns err
+func (h *DbHandler) failUpload(c echo.Context, u *Upload, err error) error {
+	u.Error = err.Error()
+	if _, uerr := h.DbMap.Update(u); uerr != nil {
+		c.Logger().Errorf("update: upload: %s: %s", u.Id, uerr)
+	}
+	return err
+}
+
+// restartUpload empties u, whose content is lost, and records err
+func (h *DbHandler) restartUpload(c echo.Context, u *Upload, err error) error {
+	u.Offset, u.State = 0, nil
+	if cerr := ioutil.WriteFile(h.uploadPath(u.Id), nil, 0644); cerr != nil {
+		c.Logger().Errorf("create: upload: %s: %s", u.Id, cerr)
+	}
+	return h.failUpload(c, u, err)
+}
+
+// ExpireUploads removes the uploads and partial contents expired
+func (h *DbHandler) ExpireUploads() (int, error) {
+	var expired []Upload
+	if _, err := h.DbMap.Select(&expired,
+		"SELECT * FROM uploads WHERE expires < $1", time.Now()); err != nil {
+		return 0, err
+	}
+	for idx := range expired {
+		u := &expired[idx]
+		unlock := lockUpload(u.Id)
+		if err := os.Remove(h.uploadPath(u.Id)); err != nil && !os.IsNotExist(err) {
+			log.Printf("expire: upload: %s: %s", u.Id, err)
+		}
+		_, err := h.DbMap.Delete(u)
+		unlock()
+		uploadLocks.Delete(u.Id)
+		if err != nil {
+			return idx, err
+		}
+	}
+	return len(expired), nil
+}
+
+// expireUploads runs ExpireUploads periodically
+func (h *DbHandler) expireUploads(interval time.Duration) {
+	for range time.Tick(interval) {
+		if n, err := h.ExpireUploads(); err != nil {
+			log.Printf("expire: uploads: %s", err)
+		} else if n > 0 {
+			log.Printf("expired: uploads: %d", n)
+		}
+	}
+}
+
+// OPTIONS
+
+// OptionsUploads describes the protocol supported
+func (h *DbHandler) OptionsUploads(c echo.Context) error {
+	hd := c.Response().Header()
+	hd.Set("Tus-Resumable", TUS_VERSION)
+	hd.Set("Tus-Version", TUS_VERSION)
+	hd.Set("Tus-Extension", TUS_EXTENSIONS)
+	if h.Uploads != nil && h.Uploads.MaxSize > 0 {
+		hd.Set("Tus-Max-Size", strconv.FormatInt(h.Uploads.MaxSize, 10))
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// GET
+
+// GetUpload returns the state of an upload and its file when complete
+func (h *DbHandler) GetUpload(c echo.Context) error {
+	u, err := h.getUpload(c)
+	if err != nil {
+		return err
+	}
+	uploadHeaders(c, u)
+	return c.JSON(http.StatusOK, u)
+}
+
+// HEAD
+
+func (h *DbHandler) HeadUpload(c echo.Context) error {
+	u, err := h.getUpload(c)
+	if err != nil {
+		return err
+	}
+	uploadHeaders(c, u)
+	return c.NoContent(http.StatusOK)
+}
+
+// POST
+
+// CreateUpload starts an upload of Upload-Length bytes; Upload-Metadata
+// gives its filename, genre, author and message
+func (h *DbHandler) CreateUpload(c echo.Context) error {
+	size, err := strconv.ParseInt(c.Request().Header.Get("Upload-Length"), 10, 64)
+	if err != nil || size < 0 {
+		return badRequest(c, "uploadlength",
+			fmt.Errorf("wrong Upload-Length: %q", c.Request().Header.Get("Upload-Length")))
+	}
+	if h.Uploads != nil && h.Uploads.MaxSize > 0 && size > h.Uploads.MaxSize {
+		c.Logger().Errorf("%d:uploadlength:%d", http.StatusRequestEntityTooLarge, size)
+		return newHTTPError(http.StatusRequestEntityTooLarge, "uploadlength",
+			fmt.Sprintf("larger than %d bytes", h.Uploads.MaxSize))
+	}
+	md, err := parseUploadMetadata(c.Request().Header.Get("Upload-Metadata"))
+	if err != nil {
+		return badRequest(c, "uploadmetadata", err)
+	}
+	if md["filename"] == "" {
+		return badRequest(c, "uploadmetadata", fmt.Errorf("missing filename"))
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return badRequest(c, "uploadid", err)
+	}
+	now := time.Now()
+	u := &Upload{
+		Id:      hex.EncodeToString(id),
+		Name:    md["filename"],
+		Genre:   md["genre"],
+		Author:  md["author"],
+		Message: md["message"],
+		Size:    size,
+		Created: now,
+		Expires: now.Add(h.uploadExpiry()),
+	}
+	if err := os.MkdirAll(h.uploadDir(), 0755); err != nil {
+		return badRequest(c, "uploaddir", err)
+	}
+	f, err := os.Create(h.uploadPath(u.Id))
+	if err != nil {
+		return badRequest(c, "createupload", err)
+	}
+	f.Close()
+	if err := h.DbMap.Insert(u); err != nil {
+		return badRequest(c, "insert", err)
+	}
+
+	if size == 0 {
+		if err := h.finishUpload(c, u, sha256.New()); err != nil {
+			return err
+		}
+	}
+	uploadHeaders(c, u)
+	c.Response().Header().Set(echo.HeaderLocation, c.Request().URL.Path+"/"+u.Id)
+	c.Logger().Infof("added: upload: %s: %s: %d bytes", u.Id, u.Name, u.Size)
+	return c.JSON(http.StatusCreated, u)
+}
+
+// PATCH
+
+// PatchUpload appends the body at Upload-Offset; the file is added when
+// the content is complete
+func (h *DbHandler) PatchUpload(c echo.Context) error {
+	defer lockUpload(c.Param("id"))()
+
+	if ct := c.Request().Header.Get(echo.HeaderContentType); ct != TUS_CONTENT_TYPE {
+		c.Logger().Errorf("%d:contenttype:%s", http.StatusUnsupportedMediaType, ct)
+		return newHTTPError(http.StatusUnsupportedMediaType, "contenttype",
+			"Content-Type must be "+TUS_CONTENT_TYPE)
+	}
+	u, err := h.getUpload(c)
+	if err != nil {
+		return err
+	}
+	if u.FileId != 0 {
+		return badRequest(c, "patchupload", fmt.Errorf("%s complete", u.Id))
+	}
+	offset, err := strconv.ParseInt(c.Request().Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		return badRequest(c, "uploadoffset", err)
+	}
+	if offset != u.Offset {
+		c.Logger().Errorf("%d:uploadoffset:%d, not %d", http.StatusConflict, offset, u.Offset)
+		return newHTTPError(http.StatusConflict, "uploadoffset",
+			fmt.Sprintf("offset is %d, not %d", u.Offset, offset))
+	}
+
+	sha, err := u.restoreHash()
+	if err != nil {
+		return badRequest(c, "restorehash", err)
+	}
+	f, err := os.OpenFile(h.uploadPath(u.Id), os.O_WRONLY, 0644)
+	if err != nil {
+		return badRequest(c, "openupload", err)
+	}
+	// bytes written after the last state saved are written again
+	if err = f.Truncate(u.Offset); err == nil {
+		_, err = f.Seek(u.Offset, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return badRequest(c, "openupload", err)
+	}
+	// one byte more than remains tells a body too large
+	n, copyErr := io.Copy(io.MultiWriter(f, sha),
+		io.LimitReader(c.Request().Body, u.Size-u.Offset+1))
+	if err := f.Close(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	if u.Offset+n > u.Size {
+		return badRequest(c, "patchupload", fmt.Errorf("more than %d bytes", u.Size))
+	}
+
+	// what has been received is kept even if the connection is lost
+	u.Offset += n
+	if u.State, err = sha.(encoding.BinaryMarshaler).MarshalBinary(); err != nil {
+		return badRequest(c, "savehash", err)
+	}
+	u.Expires = time.Now().Add(h.uploadExpiry())
+	if _, err := h.DbMap.Update(u); err != nil {
+		return badRequest(c, "updateupload", err)
+	}
+	if copyErr != nil {
+		return badRequest(c, "patchupload", copyErr)
+	}
+
+	if u.Offset == u.Size {
+		if err := h.finishUpload(c, u, sha); err != nil {
+			return err
+		}
+	}
+	uploadHeaders(c, u)
+	return c.NoContent(http.StatusNoContent)
+}
+
+// DELETE
+
+// DeleteUpload abandons an upload
+func (h *DbHandler) DeleteUpload(c echo.Context) error {
+	defer lockUpload(c.Param("id"))()
+
+	u, err := h.getUpload(c)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(h.uploadPath(u.Id)); err != nil && !os.IsNotExist(err) {
+		return badRequest(c, "remove", err)
+	}
+	if _, err := h.DbMap.Delete(u); err != nil {
+		return badRequest(c, "delete", err)
+	}
+	c.Response().Header().Set("Tus-Resumable", TUS_VERSION)
+	c.Logger().Infof("deleted: upload: %s", u.Id)
+	return c.NoContent(http.StatusNoContent)
+}
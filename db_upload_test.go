@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseUploadMetadata(t *testing.T) {
+	md, err := parseUploadMetadata("filename 5rqQ5rCPLnhtbA==,genre bW9ub2dhdGFyaQ==, is-draft")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"filename": "源氏.xml", "genre": "monogatari", "is-draft": ""}, md)
+
+	_, err = parseUploadMetadata("filename ***")
+	assert.Error(t, err)
+}
+
+func TestUploadHashResumes(t *testing.T) {
+	content := []byte("<TEI><text>いづれの御時にか</text></TEI>")
+	u := &Upload{}
+	for _, chunk := range [][]byte{content[:7], content[7:20], content[20:]} {
+		sha, err := u.restoreHash()
+		if !assert.NoError(t, err) {
+			return
+		}
+		sha.Write(chunk)
+		u.State, err = sha.(encoding.BinaryMarshaler).MarshalBinary()
+		assert.NoError(t, err)
+	}
+	sha, _ := u.restoreHash()
+	want := sha256.Sum256(content)
+	assert.Equal(t, want[:], sha.Sum(nil))
+}
+
+func TestFinishUploadFails(t *testing.T) {
+	h, mock, done := mockFiles(t)
+	defer done()
+	h.DbMap.AddTableWithName(Upload{}, "uploads")
+	h.Uploads = &UploadOptions{Dir: h.Datapath}
+	h.Validation = &ValidationOptions{Mode: VALIDATION_REJECT, Schema: "tei_subset.yml"}
+	assert.NoError(t, h.loadSchema())
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodPatch, "/", nil), httptest.NewRecorder())
+
+	// refused by the validation, the content stays in the upload
+	content := "<text/>"
+	u := &Upload{Id: "u1", Name: "a.xml", Size: int64(len(content)), Offset: int64(len(content))}
+	path := h.uploadPath(u.Id)
+	assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+	sha := sha256.New()
+	sha.Write([]byte(content))
+	mock.ExpectExec(`update "uploads"`).WillReturnResult(sqlmock.NewResult(0, 1))
+	assert.Error(t, h.finishUpload(c, u, sha))
+	assert.Contains(t, u.Error, "invalidxml")
+	data, _ := ioutil.ReadFile(path)
+	assert.Equal(t, content, string(data))
+	_, err := h.Blobs.Stat(hashOf(content))
+	assert.True(t, os.IsNotExist(err))
+
+	// not added, the content stored is removed and the upload starts again
+	content = `<TEI xmlns="http://www.tei-c.org/ns/1.0"><text><body><p>本文</p></body></text></TEI>`
+	u = &Upload{Id: "u2", Name: "b.xml", Size: int64(len(content)), Offset: int64(len(content))}
+	path = h.uploadPath(u.Id)
+	assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+	sha = sha256.New()
+	sha.Write([]byte(content))
+	mock.ExpectBegin()
+	mock.ExpectQuery(`insert into "files"`).WillReturnError(assert.AnError)
+	mock.ExpectRollback()
+	mock.ExpectQuery(`SELECT \(SELECT count\(\*\) FROM files WHERE sha256 = \$1\)`).
+		WithArgs(hashOf(content)).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectExec(`update "uploads"`).WillReturnResult(sqlmock.NewResult(0, 1))
+	assert.Error(t, h.finishUpload(c, u, sha))
+	assert.Equal(t, int64(0), u.Offset)
+	data, err = ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Empty(t, data)
+	_, err = h.Blobs.Stat(hashOf(content))
+	assert.True(t, os.IsNotExist(err))
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
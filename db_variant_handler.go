@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+)
+
+type Variant struct {
+	Variant   string    `db:"variant,notnull,primarykey" json:"variant"`
+	Canonical string    `db:"canonical,notnull" json:"canonical"`
+	Updated   time.Time `db:"updated,notnull" json:"updated"`
+}
+
+//go:embed variants.tsv
+var defaultVariants string
+
+var lockVariant = sync.Mutex{}
+
+// VariantTable is the in-memory copy of the variants table
+type VariantTable struct {
+	mu      sync.RWMutex
+	m       map[rune]string
+	version int // changed on every update
+}
+
+func NewVariantTable(variants []Variant) *VariantTable {
+	vt := &VariantTable{}
+	vt.Reset(variants)
+	return vt
+}
+
+func (vt *VariantTable) Reset(variants []Variant) {
+	m := make(map[rune]string, len(variants))
+	for _, v := range variants {
+		r, _ := utf8.DecodeRuneInString(v.Variant)
+		m[r] = v.Canonical
+	}
+	vt.mu.Lock()
+	vt.m = m
+	vt.version++
+	vt.mu.Unlock()
+}
+
+func (vt *VariantTable) Set(variant, canonical string) {
+	r, _ := utf8.DecodeRuneInString(variant)
+	vt.mu.Lock()
+	vt.m[r] = canonical
+	vt.version++
+	vt.mu.Unlock()
+}
+
+func (vt *VariantTable) Delete(variant string) {
+	r, _ := utf8.DecodeRuneInString(variant)
+	vt.mu.Lock()
+	delete(vt.m, r)
+	vt.version++
+	vt.mu.Unlock()
+}
+
+// Version tells whether the table has changed since it was last read
+func (vt *VariantTable) Version() int {
+	if vt == nil {
+		return 0
+	}
+	vt.mu.RLock()
+	defer vt.mu.RUnlock()
+	return vt.version
+}
+
+// Lookup returns the canonical form of r, if r is a variant
+func (vt *VariantTable) Lookup(r rune) (string, bool) {
+	if vt == nil {
+		return "", false
+	}
+	vt.mu.RLock()
+	defer vt.mu.RUnlock()
+	s, ok := vt.m[r]
+	return s, ok
+}
+
+// Normalize replaces every variant in s with its canonical form
+func (vt *VariantTable) Normalize(s string) string {
+	if vt == nil {
+		return s
+	}
+	vt.mu.RLock()
+	defer vt.mu.RUnlock()
+	var sb strings.Builder
+	for _, r := range s {
+		if c, ok := vt.m[r]; ok {
+			sb.WriteString(c)
+		} else {
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+// Match reports whether s contains sub ignoring variants
+func (vt *VariantTable) Match(s, sub string) bool {
+	return strings.Contains(vt.Normalize(s), vt.Normalize(sub))
+}
+
+// parseVariants reads lines of "variant<TAB>canonical"
+func parseVariants(s string) ([]Variant, error) {
+	var variants []Variant
+	sc := bufio.NewScanner(strings.NewReader(s))
+	for ln := 1; sc.Scan(); ln++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		cols := strings.Split(line, "\t")
+		if len(cols) != 2 {
+			return nil, fmt.Errorf("variants: line %d: wrong columns", ln)
+		}
+		variants = append(variants, Variant{
+			Variant:   cols[0],
+			Canonical: cols[1],
+		})
+	}
+	return variants, sc.Err()
+}
+
+// loadVariants seeds the variants table from the bundled default when it
+// is empty and returns its contents.
+func (h *DbHandler) loadVariants() ([]Variant, error) {
+	var variants []Variant
+	if _, err := h.DbMap.Select(&variants,
+		"SELECT * FROM variants ORDER BY variant"); err != nil {
+		return nil, err
+	}
+	if len(variants) > 0 {
+		return variants, nil
+	}
+
+	variants, err := parseVariants(defaultVariants)
+	if err != nil {
+		return nil, err
+	}
+	trans, err := h.DbMap.Begin()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for idx := range variants {
+		variants[idx].Updated = now
+		if err = trans.Insert(&variants[idx]); err != nil {
+			trans.Rollback()
+			return nil, err
+		}
+	}
+	return variants, trans.Commit()
+}
+
+func checkVariant(v *Variant) error {
+	if utf8.RuneCountInString(v.Variant) != 1 {
+		return fmt.Errorf("variant must be a single character: %s", v.Variant)
+	}
+	if v.Canonical == "" {
+		return fmt.Errorf("canonical is empty")
+	}
+	return nil
+}
+
+// GET
+func (h *DbHandler) GetAllVariants(c echo.Context) error {
+	var variants []Variant
+	_, err := h.DbMap.Select(&variants,
+		"SELECT * FROM variants ORDER BY variant")
+	if err != nil {
+		return badRequest(c, "selectvariants", err)
+	}
+	return c.JSON(http.StatusOK, variants)
+}
+
+func (h *DbHandler) GetVariant(c echo.Context) error {
+	variant := c.Param("variant")
+	obj, err := h.DbMap.Get(Variant{}, variant)
+	if err != nil {
+		return badRequest(c, "getvariant", err)
+	}
+	if obj == nil {
+		return notFound(c, "getvariant", variant)
+	}
+	return c.JSON(http.StatusOK, obj.(*Variant))
+}
+
+// GetNormalized returns ?text with its variants replaced
+func (h *DbHandler) GetNormalized(c echo.Context) error {
+	text := c.QueryParam("text")
+	return c.JSON(http.StatusOK, map[string]string{
+		"text":       text,
+		"normalized": h.Variants.Normalize(text),
+	})
+}
+
+// POST
+func (h *DbHandler) CreateVariant(c echo.Context) error {
+	lockVariant.Lock()
+	defer lockVariant.Unlock()
+
+	v := &Variant{}
+	if err := c.Bind(v); err != nil {
+		return badRequest(c, "bind", err)
+	}
+	v.Updated = time.Now()
+
+	if err := checkVariant(v); err != nil {
+		return badRequest(c, "bind", err)
+	}
+
+	if err := h.DbMap.Insert(v); err != nil {
+		return badRequest(c, "insert", err)
+	}
+	h.Variants.Set(v.Variant, v.Canonical)
+
+	c.Logger().Infof("added: variants: %s", v.Variant)
+	return c.JSON(http.StatusCreated, v)
+}
+
+// PUT
+func (h *DbHandler) UpdateVariant(c echo.Context) error {
+	lockVariant.Lock()
+	defer lockVariant.Unlock()
+
+	v := &Variant{
+		Variant: c.Param("variant"),
+	}
+	if err := c.Bind(v); err != nil {
+		return badRequest(c, "bind", err)
+	}
+	if v.Variant != c.Param("variant") {
+		return badRequest(c, "bind",
+			fmt.Errorf("variant %q differs from %q", v.Variant, c.Param("variant")))
+	}
+	v.Updated = time.Now()
+
+	if err := checkVariant(v); err != nil {
+		return badRequest(c, "bind", err)
+	}
+
+	count, err := h.DbMap.Update(v)
+	if err != nil {
+		return badRequest(c, "update", err)
+	}
+	if count != 1 {
+		return badRequest(c, "update",
+			fmt.Errorf("something wrong: update: %d", count))
+	}
+	h.Variants.Set(v.Variant, v.Canonical)
+
+	c.Logger().Infof("updated: %s", v.Variant)
+	return c.JSON(http.StatusCreated, v)
+}
+
+// DELETE
+func (h *DbHandler) DeleteVariant(c echo.Context) error {
+	lockVariant.Lock()
+	defer lockVariant.Unlock()
+
+	v := &Variant{
+		Variant: c.Param("variant"),
+	}
+	count, err := h.DbMap.Delete(v)
+	if err != nil {
+		return badRequest(c, "deletevariant", err)
+	}
+	if count != 1 {
+		return notFound(c, "deletevariant", v.Variant)
+	}
+	h.Variants.Delete(v.Variant)
+
+	c.Logger().Infof("deleted: %s", v.Variant)
+	return c.JSON(http.StatusOK, map[string]string{"variant": v.Variant})
+}
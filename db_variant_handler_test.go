@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVariantTable(t *testing.T) {
+	variants, err := parseVariants(defaultVariants)
+	if err != nil {
+		t.Fatalf("parseVariants: %s", err)
+	}
+	vt := NewVariantTable(variants)
+	assert.Equal(t, "国の辺", vt.Normalize("國の邊"))
+	assert.True(t, vt.Match("濱邊日記", "浜辺"))
+	assert.False(t, vt.Match("濱邊日記", "海辺"))
+}
+
+func TestVariantHandlers(t *testing.T) {
+	h, mock, done := mockFiles(t)
+	defer done()
+	h.DbMap.AddTableWithName(Variant{}, "variants")
+	h.Variants = NewVariantTable(nil)
+
+	send := func(handler echo.HandlerFunc, method, variant, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(req, rec)
+		if variant != "" {
+			c.SetParamNames("variant")
+			c.SetParamValues(variant)
+		}
+		if err := handler(c); err != nil {
+			ErrorHandler(err, c)
+		}
+		return rec
+	}
+
+	// every change of the table is seen by normalization at once
+	version := h.Variants.Version()
+	mock.ExpectExec(`insert into "variants"`).WithArgs("邊", "辺", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	rec := send(h.CreateVariant, http.MethodPost, "", `{"variant": "邊", "canonical": "辺"}`)
+	assert.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	assert.Equal(t, "浜辺", h.Variants.Normalize("浜邊"))
+	assert.Greater(t, h.Variants.Version(), version)
+
+	version = h.Variants.Version()
+	mock.ExpectExec(`update "variants" set .* where "variant"=\$4`).
+		WithArgs("邊", "邉", sqlmock.AnyArg(), "邊").WillReturnResult(sqlmock.NewResult(0, 1))
+	rec = send(h.UpdateVariant, http.MethodPut, "邊", `{"variant": "邊", "canonical": "邉"}`)
+	assert.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	assert.Equal(t, "浜邉", h.Variants.Normalize("浜邊"))
+	assert.Greater(t, h.Variants.Version(), version)
+
+	version = h.Variants.Version()
+	mock.ExpectExec(`delete from "variants" where "variant"=\$1`).WithArgs("邊").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	rec = send(h.DeleteVariant, http.MethodDelete, "邊", "")
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, "浜邊", h.Variants.Normalize("浜邊"))
+	assert.Greater(t, h.Variants.Version(), version)
+
+	// failures leave the table as it is
+	version = h.Variants.Version()
+	rec = send(h.CreateVariant, http.MethodPost, "", `{"variant": "邊邉", "canonical": "辺"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = send(h.UpdateVariant, http.MethodPut, "邊", `{"variant": "濱", "canonical": "浜"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	mock.ExpectExec(`delete from "variants"`).WithArgs("濱").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	rec = send(h.DeleteVariant, http.MethodDelete, "濱", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Equal(t, version, h.Variants.Version())
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+)
+
+// LDA is a latent Dirichlet allocation model trained by collapsed Gibbs
+// sampling
+type LDA struct {
+	K     int
+	V     int
+	Alpha float64
+	Beta  float64
+	Phi   [][]float64 // K x V, words of each topic
+	Theta [][]float64 // D x K, topics of each document
+}
+
+// TrainLDA fits K topics to docs, lists of word ids below V. It stops
+// early with ctx.Err() once ctx is done.
+func TrainLDA(ctx context.Context, docs [][]int, V, K, iterations int, alpha, beta float64, rnd *rand.Rand) (*LDA, error) {
+	var (
+		nDK = make([][]int, len(docs)) // topic counts per document
+		nKW = make([][]int, K)         // word counts per topic
+		nK  = make([]int, K)           // word counts per topic in total
+		z   = make([][]int, len(docs)) // topic of each word
+		vb  = float64(V) * beta
+		p   = make([]float64, K)
+	)
+	for k := range nKW {
+		nKW[k] = make([]int, V)
+	}
+	for d, doc := range docs {
+		nDK[d] = make([]int, K)
+		z[d] = make([]int, len(doc))
+		for i, w := range doc {
+			k := rnd.Intn(K)
+			z[d][i] = k
+			nDK[d][k]++
+			nKW[k][w]++
+			nK[k]++
+		}
+	}
+
+	for it := 0; it < iterations; it++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		for d, doc := range docs {
+			for i, w := range doc {
+				k := z[d][i]
+				nDK[d][k]--
+				nKW[k][w]--
+				nK[k]--
+
+				var sum float64
+				for k := 0; k < K; k++ {
+					sum += (float64(nDK[d][k]) + alpha) *
+						(float64(nKW[k][w]) + beta) / (float64(nK[k]) + vb)
+					p[k] = sum
+				}
+				k = sort.SearchFloat64s(p, rnd.Float64()*sum)
+				if k >= K {
+					k = K - 1
+				}
+
+				z[d][i] = k
+				nDK[d][k]++
+				nKW[k][w]++
+				nK[k]++
+			}
+		}
+	}
+
+	m := &LDA{K: K, V: V, Alpha: alpha, Beta: beta}
+	m.Phi = make([][]float64, K)
+	for k := range m.Phi {
+		m.Phi[k] = make([]float64, V)
+		for w := range m.Phi[k] {
+			m.Phi[k][w] = (float64(nKW[k][w]) + beta) / (float64(nK[k]) + vb)
+		}
+	}
+	m.Theta = make([][]float64, len(docs))
+	for d, doc := range docs {
+		m.Theta[d] = make([]float64, K)
+		for k := range m.Theta[d] {
+			m.Theta[d][k] = (float64(nDK[d][k]) + alpha) /
+				(float64(len(doc)) + float64(K)*alpha)
+		}
+	}
+	return m, nil
+}
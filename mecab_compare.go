@@ -0,0 +1,243 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Alignment is a span where two analyses are compared. Segmentation
+// differs unless both sides have exactly one node.
+type Alignment struct {
+	Start int         `json:"start"` // chars
+	End   int         `json:"end"`
+	Kinds []string    `json:"kinds"` // segmentation, pos and/or lemma
+	A     []MecabNode `json:"a"`
+	B     []MecabNode `json:"b"`
+}
+
+type Agreement struct {
+	Segmentation float64 `json:"segmentation"` // same spans / all nodes (F1)
+	Pos          float64 `json:"pos"`          // same pos1-4 / same spans
+	Lemma        float64 `json:"lemma"`        // same lemma / same spans
+	All          float64 `json:"all"`          // same span, pos and lemma / all nodes (F1)
+}
+
+// alignNodes groups two analyses of the same text into minimal spans
+// having the same boundaries on both sides.
+func alignNodes(a, b []MecabNode) []Alignment {
+	var res []Alignment
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		al := Alignment{}
+		switch {
+		case j >= len(b) || (i < len(a) && a[i].Offsets.Char.End <= b[j].Offsets.Char.Start):
+			al.A = []MecabNode{a[i]}
+			i++
+		case i >= len(a) || b[j].Offsets.Char.End <= a[i].Offsets.Char.Start:
+			al.B = []MecabNode{b[j]}
+			j++
+		default:
+			al.A, al.B = []MecabNode{a[i]}, []MecabNode{b[j]}
+			endA, endB := a[i].Offsets.Char.End, b[j].Offsets.Char.End
+			i++
+			j++
+			for endA != endB {
+				if endA < endB && i < len(a) && a[i].Offsets.Char.Start < endB {
+					al.A = append(al.A, a[i])
+					endA = a[i].Offsets.Char.End
+					i++
+				} else if endB < endA && j < len(b) && b[j].Offsets.Char.Start < endA {
+					al.B = append(al.B, b[j])
+					endB = b[j].Offsets.Char.End
+					j++
+				} else {
+					break
+				}
+			}
+		}
+		al.Start, al.End = alignmentSpan(al.A, al.B)
+		al.Kinds = alignmentKinds(al.A, al.B)
+		res = append(res, al)
+	}
+	return res
+}
+
+func alignmentSpan(a, b []MecabNode) (int, int) {
+	all := append(append([]MecabNode{}, a...), b...)
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Offsets.Char.Start < all[j].Offsets.Char.Start
+	})
+	start, end := all[0].Offsets.Char.Start, all[0].Offsets.Char.End
+	for _, n := range all {
+		if n.Offsets.Char.End > end {
+			end = n.Offsets.Char.End
+		}
+	}
+	return start, end
+}
+
+func alignmentKinds(a, b []MecabNode) []string {
+	if len(a) != 1 || len(b) != 1 || a[0].Offsets.Char != b[0].Offsets.Char {
+		return []string{"segmentation"}
+	}
+	kinds := []string{}
+	fa, fb := a[0].Features, b[0].Features
+	if fa.Pos1 != fb.Pos1 || fa.Pos2 != fb.Pos2 ||
+		fa.Pos3 != fb.Pos3 || fa.Pos4 != fb.Pos4 {
+		kinds = append(kinds, "pos")
+	}
+	if fa.Lemma != fb.Lemma {
+		kinds = append(kinds, "lemma")
+	}
+	return kinds
+}
+
+func agreement(als []Alignment, na, nb int) Agreement {
+	var same, pos, lemma, all int
+	for _, al := range als {
+		if len(al.Kinds) == 1 && al.Kinds[0] == "segmentation" {
+			continue
+		}
+		same++
+		samePos, sameLemma := true, true
+		for _, k := range al.Kinds {
+			switch k {
+			case "pos":
+				samePos = false
+			case "lemma":
+				sameLemma = false
+			}
+		}
+		if samePos {
+			pos++
+		}
+		if sameLemma {
+			lemma++
+		}
+		if samePos && sameLemma {
+			all++
+		}
+	}
+	ratio := func(n, d int) float64 {
+		if d == 0 {
+			return 1
+		}
+		return float64(n) / float64(d)
+	}
+	return Agreement{
+		Segmentation: ratio(2*same, na+nb),
+		Pos:          ratio(pos, same),
+		Lemma:        ratio(lemma, same),
+		All:          ratio(2*all, na+nb),
+	}
+}
+
+// GET
+func (h *MecabHandler) GetMecabDicts(c echo.Context) error {
+	names := []string{}
+	for name := range h.Dicts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return c.JSON(http.StatusOK, names)
+}
+
+// requestData reads the stored file ?file= or else the uploaded file
+func (h *MecabHandler) requestData(c echo.Context) (string, []byte, error) {
+	if id := c.QueryParam("file"); id != "" {
+		fid, err := strconv.Atoi(id)
+		if err != nil {
+			return "", nil, badRequest(c, "atoi", err)
+		}
+		obj, err := h.Db.DbMap.Get(File{}, fid)
+		if err != nil {
+			return "", nil, badRequest(c, "getfile", err)
+		}
+		if obj == nil {
+			return "", nil, notFound(c, "getfile", id)
+		}
+		data, err := h.Db.ReadFile(obj.(*File).Sha256)
+		if err != nil {
+			return "", nil, badRequest(c, "readfile", err)
+		}
+		return obj.(*File).Name, data, nil
+	}
+
+	file, err := c.FormFile("file")
+	if err != nil {
+		return "", nil, badRequest(c, "nofile", err)
+	}
+	src, err := file.Open()
+	if err != nil {
+		return "", nil, badRequest(c, "nofile", err)
+	}
+	defer src.Close()
+	data, err := ioutil.ReadAll(src)
+	if err != nil {
+		return "", nil, badRequest(c, "nofile", err)
+	}
+	return file.Filename, data, nil
+}
+
+// POST
+
+// PostMecabCompare analyses an uploaded file, or the stored file ?file=,
+// with the dictionaries ?a= and ?b= and returns where they differ.
+func (h *MecabHandler) PostMecabCompare(c echo.Context) error {
+	nameA, nameB := c.QueryParam("a"), c.QueryParam("b")
+	if nameA == "" {
+		nameA = DEFAULT_DICT
+	}
+	if nameB == "" {
+		nameB = DEFAULT_DICT
+	}
+	ma, err := h.dict(nameA)
+	if err != nil {
+		return badRequest(c, "dict", err)
+	}
+	mb, err := h.dict(nameB)
+	if err != nil {
+		return badRequest(c, "dict", err)
+	}
+
+	filename, data, err := h.requestData(c)
+	if err != nil {
+		return err
+	}
+
+	st, err := h.NewSource(filename, data)
+	if err != nil {
+		return badRequest(c, "notxml", err)
+	}
+	if c.QueryParam("normalize") != "false" {
+		st = Normalize(st, h.Normalize, h.Variants)
+	}
+	ctx := c.Request().Context()
+	a, err := h.analyzeWith(ctx, ma, st, false)
+	if err != nil {
+		return badRequest(c, "couldnotparsed", err)
+	}
+	b, err := h.analyzeWith(ctx, mb, st, false)
+	if err != nil {
+		return badRequest(c, "couldnotparsed", err)
+	}
+
+	als := alignNodes(a, b)
+	diffs := []Alignment{}
+	for _, al := range als {
+		if len(al.Kinds) > 0 {
+			diffs = append(diffs, al)
+		}
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"a":         nameA,
+		"b":         nameB,
+		"nodes":     map[string]int{"a": len(a), "b": len(b)},
+		"agreement": agreement(als, len(a), len(b)),
+		"diffs":     diffs,
+	})
+}
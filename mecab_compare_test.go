@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAlignNodes(t *testing.T) {
+	st := NewPlainSource("東京都に行く")
+	a := []MecabNode{
+		{Surface: "東京", Features: NodeFeatures{Pos1: "名詞", Lemma: "東京"}},
+		{Surface: "都", Features: NodeFeatures{Pos1: "名詞", Lemma: "都"}},
+		{Surface: "に", Features: NodeFeatures{Pos1: "助詞", Lemma: "に"}},
+		{Surface: "行く", Features: NodeFeatures{Pos1: "動詞", Lemma: "行く"}},
+	}
+	b := []MecabNode{
+		{Surface: "東京都", Features: NodeFeatures{Pos1: "名詞", Lemma: "東京都"}},
+		{Surface: "に", Features: NodeFeatures{Pos1: "助詞", Lemma: "に"}},
+		{Surface: "行く", Features: NodeFeatures{Pos1: "動詞", Lemma: "行く-ゆく"}},
+	}
+	st.Locate(a)
+	st.Locate(b)
+
+	als := alignNodes(a, b)
+	assert.Equal(t, 3, len(als))
+	assert.Equal(t, []string{"segmentation"}, als[0].Kinds)
+	assert.Equal(t, 0, als[0].Start)
+	assert.Equal(t, 3, als[0].End)
+	assert.Equal(t, 2, len(als[0].A))
+	assert.Equal(t, []string{}, als[1].Kinds)
+	assert.Equal(t, []string{"lemma"}, als[2].Kinds)
+
+	ag := agreement(als, len(a), len(b))
+	assert.InDelta(t, 4.0/7.0, ag.Segmentation, 1e-9)
+	assert.Equal(t, 1.0, ag.Pos)
+	assert.Equal(t, 0.5, ag.Lemma)
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jszwec/csvutil"
+	"github.com/labstack/echo/v4"
+)
+
+// CorpusStats compare raw MeCab output against manual corrections
+type CorpusStats struct {
+	Files          int     `json:"files"`
+	Tokens         int     `json:"tokens"`         // tokens after merging
+	Corrections    int     `json:"corrections"`    // corrected spans
+	Changed        int     `json:"changed"`        // corrections differing from MeCab
+	BoundaryErrors int     `json:"boundaryErrors"` // MeCab segmented the span otherwise
+	PosErrors      int     `json:"posErrors"`      // same span, other pos1-4
+	LemmaErrors    int     `json:"lemmaErrors"`    // same span, other lemma
+	ErrorRate      float64 `json:"errorRate"`      // changed / tokens
+}
+
+func (s *CorpusStats) add(o CorpusStats) {
+	s.Files += o.Files
+	s.Tokens += o.Tokens
+	s.Corrections += o.Corrections
+	s.Changed += o.Changed
+	s.BoundaryErrors += o.BoundaryErrors
+	s.PosErrors += o.PosErrors
+	s.LemmaErrors += o.LemmaErrors
+	s.rate()
+}
+
+func (s *CorpusStats) rate() {
+	if s.Tokens > 0 {
+		s.ErrorRate = float64(s.Changed) / float64(s.Tokens)
+	}
+}
+
+// compareCorrections counts where raw nodes disagree with corrections
+func compareCorrections(raw []MecabNode, cs []Correction) CorpusStats {
+	stats := CorpusStats{Corrections: len(cs)}
+	for _, cr := range cs {
+		var span []MecabNode
+		for _, n := range raw {
+			if !n.Unlocated && n.Offsets.Char.Start < cr.End && n.Offsets.Char.End > cr.Start {
+				span = append(span, n)
+			}
+		}
+		switch {
+		case len(span) != 1 ||
+			span[0].Offsets.Char.Start != cr.Start ||
+			span[0].Offsets.Char.End != cr.End:
+			stats.BoundaryErrors++
+			stats.Changed++
+		default:
+			f := span[0].Features
+			pos := f.Pos1 != cr.Features.Pos1 || f.Pos2 != cr.Features.Pos2 ||
+				f.Pos3 != cr.Features.Pos3 || f.Pos4 != cr.Features.Pos4
+			lemma := f.Lemma != cr.Features.Lemma
+			if pos {
+				stats.PosErrors++
+			}
+			if lemma {
+				stats.LemmaErrors++
+			}
+			if pos || lemma || f != cr.Features {
+				stats.Changed++
+			}
+		}
+	}
+	return stats
+}
+
+// splitSentences breaks nodes after 句点 and wherever the analysed text
+// is broken by a newline
+func splitSentences(st *SourceText, nodes []MecabNode) [][]MecabNode {
+	var (
+		sentences [][]MecabNode
+		sentence  []MecabNode
+		prev      = -1
+	)
+	for _, n := range nodes {
+		start := st.Map.fromOrigStart(n.Offsets.Byte.Start)
+		if prev >= 0 && prev <= start &&
+			strings.Contains(st.Text[prev:start], "\n") && len(sentence) > 0 {
+			sentences = append(sentences, sentence)
+			sentence = nil
+		}
+		sentence = append(sentence, n)
+		prev = st.Map.fromOrigEnd(n.Offsets.Byte.End)
+		if n.Features.Pos2 == "句点" {
+			sentences = append(sentences, sentence)
+			sentence = nil
+		}
+	}
+	if len(sentence) > 0 {
+		sentences = append(sentences, sentence)
+	}
+	return sentences
+}
+
+// writeCorpus writes sentences in the MeCab training corpus format: a
+// surface and all the feature columns per line, and EOS after each
+// sentence.
+func writeCorpus(w io.Writer, sentences [][]MecabNode) error {
+	var buf bytes.Buffer
+	for _, sentence := range sentences {
+		for _, n := range sentence {
+			buf.Reset()
+			cw := csv.NewWriter(&buf)
+			enc := csvutil.NewEncoder(cw)
+			enc.AutoHeader = false
+			if err := enc.Encode(n.Features); err != nil {
+				return err
+			}
+			cw.Flush()
+			if err := cw.Error(); err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(w, "%s\t%s\n",
+				n.Surface, strings.TrimRight(buf.String(), "\r\n")); err != nil {
+				return err
+			}
+		}
+		if _, err := io.WriteString(w, "EOS\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// trainable reports whether every node of sentence has features
+func trainable(sentence []MecabNode) bool {
+	for _, n := range sentence {
+		if n.Features.Pos1 == "" || n.Surface == "" {
+			return false
+		}
+	}
+	return true
+}
+
+func corrected(sentence []MecabNode) bool {
+	for _, n := range sentence {
+		if n.Manual != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// corpusFiles selects the files of ?files=1,2,... and ?genre=, which have
+// corrections unless all is set
+func (h *MecabHandler) corpusFiles(c echo.Context, all bool) ([]File, error) {
+	query := "SELECT * FROM files WHERE true"
+	var args []interface{}
+	if !all {
+		query += " AND sha256 IN (SELECT DISTINCT sha256 FROM corrections)"
+	}
+	if genre := c.QueryParam("genre"); genre != "" {
+		args = append(args, genre)
+		query += fmt.Sprintf(" AND genre = $%d", len(args))
+	}
+	if ids := c.QueryParam("files"); ids != "" {
+		var in []string
+		for _, s := range strings.Split(ids, ",") {
+			id, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, id)
+			in = append(in, fmt.Sprintf("$%d", len(args)))
+		}
+		query += " AND id IN (" + strings.Join(in, ", ") + ")"
+	}
+	var files []File
+	_, err := h.Db.DbMap.Select(&files, query+" ORDER BY id", args...)
+	return files, err
+}
+
+// storedAnalysis is the analysis of a stored file keeping symbols
+type storedAnalysis struct {
+	Source      *SourceText
+	Raw         []MecabNode // MeCab output
+	Nodes       []MecabNode // with corrections merged
+	Corrections []Correction
+}
+
+func (h *MecabHandler) analyzeStored(f *File) (*storedAnalysis, error) {
+	data, err := h.Db.ReadFile(f.Sha256)
+	if err != nil {
+		return nil, err
+	}
+	st, err := h.NewSource(f.Name, data)
+	if err != nil {
+		return nil, err
+	}
+	st = Normalize(st, h.Normalize, h.Variants)
+	raw, err := h.AnalyzeAll(st)
+	if err != nil {
+		return nil, err
+	}
+	cs, err := h.Db.SelectCorrections(f.Sha256)
+	if err != nil {
+		return nil, err
+	}
+	return &storedAnalysis{
+		Source:      st,
+		Raw:         raw,
+		Nodes:       MergeCorrections(st, raw, cs),
+		Corrections: cs,
+	}, nil
+}
+
+// GET
+func (h *MecabHandler) GetMecabCorpus(c echo.Context) error {
+	files, err := h.corpusFiles(c, c.QueryParam("all") == "true")
+	if err != nil {
+		return badRequest(c, "corpusfiles", err)
+	}
+
+	c.Response().Header().Set(
+		echo.HeaderContentType, echo.MIMETextPlainCharsetUTF8)
+	c.Response().WriteHeader(http.StatusOK)
+	for _, f := range files {
+		a, err := h.analyzeStored(&f)
+		if err != nil {
+			c.Logger().Errorf("corpus: %d: %s", f.Id, err)
+			continue
+		}
+		var sentences [][]MecabNode
+		for _, sentence := range splitSentences(a.Source, a.Nodes) {
+			if !trainable(sentence) {
+				continue
+			}
+			if c.QueryParam("sentences") != "all" && !corrected(sentence) {
+				continue
+			}
+			sentences = append(sentences, sentence)
+		}
+		if err := writeCorpus(c.Response(), sentences); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *MecabHandler) GetMecabCorpusStats(c echo.Context) error {
+	files, err := h.corpusFiles(c, c.QueryParam("all") == "true")
+	if err != nil {
+		return badRequest(c, "corpusfiles", err)
+	}
+
+	type fileStats struct {
+		ID    int         `json:"id"`
+		Name  string      `json:"name"`
+		Genre string      `json:"genre"`
+		Stats CorpusStats `json:"stats"`
+	}
+	var (
+		total  CorpusStats
+		genres = map[string]*CorpusStats{}
+		res    = []fileStats{}
+	)
+	for _, f := range files {
+		a, err := h.analyzeStored(&f)
+		if err != nil {
+			return badRequest(c, "analyze", fmt.Errorf("%d: %s", f.Id, err))
+		}
+		stats := compareCorrections(a.Raw, a.Corrections)
+		stats.Files = 1
+		stats.Tokens = len(a.Nodes)
+		stats.rate()
+
+		res = append(res, fileStats{f.Id, f.Name, f.Genre, stats})
+		total.add(stats)
+		if genres[f.Genre] == nil {
+			genres[f.Genre] = &CorpusStats{}
+		}
+		genres[f.Genre].add(stats)
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"total":  total,
+		"genres": genres,
+		"files":  res,
+	})
+}
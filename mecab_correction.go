@@ -0,0 +1,116 @@
+package main
+
+import (
+	"sort"
+)
+
+// MergeCorrections replaces the nodes overlapping corrections with the
+// corrected ones. Parts of nodes left uncovered by corrections are kept
+// as unknown nodes without features.
+func MergeCorrections(st *SourceText, nodes []MecabNode, cs []Correction) []MecabNode {
+	if len(cs) == 0 {
+		return nodes
+	}
+	sort.Slice(cs, func(i, j int) bool { return cs[i].Start < cs[j].Start })
+
+	// corrections and fragments of nodes are each located in order, by
+	// counters which then never go back
+	counter := func() func(start, end int) NodeOffsets {
+		oc := &offsetCounter{doc: st.Doc}
+		return func(start, end int) NodeOffsets {
+			bs, us := oc.seekRune(start)
+			be, ue := oc.seekRune(end)
+			return NodeOffsets{
+				Char:  OffsetRange{start, end},
+				UTF16: OffsetRange{us, ue},
+				Byte:  OffsetRange{bs, be},
+			}
+		}
+	}
+	offsets, fragmentOffsets := counter(), counter()
+
+	var merged []MecabNode
+	corrected := make([]*MecabNode, len(cs))
+	for idx := range cs {
+		cr := cs[idx]
+		corrected[idx] = &MecabNode{
+			ID:       -1,
+			Stat:     int(MECAB_NOR_NODE),
+			Surface:  cr.Surface,
+			Length:   len(cr.Surface),
+			StartPos: cr.Start,
+			Offsets:  offsets(cr.Start, cr.End),
+			Features: cr.Features,
+			Manual: &NodeManual{
+				ID:        cr.Id,
+				Corrector: cr.Corrector,
+				Updated:   cr.Updated,
+			},
+		}
+	}
+
+	for _, n := range nodes {
+		s, e := n.Offsets.Char.Start, n.Offsets.Char.End
+		if n.Unlocated {
+			merged = append(merged, n)
+			continue
+		}
+		i := sort.Search(len(cs), func(i int) bool { return cs[i].End > s })
+		if i == len(cs) || cs[i].Start >= e {
+			merged = append(merged, n)
+			continue
+		}
+
+		// n overlaps cs[i:j]
+		pos := s
+		for ; i < len(cs) && cs[i].Start < e; i++ {
+			cn := corrected[i]
+			if cn.ID == -1 {
+				cn.ID = n.ID
+				cn.Element = n.Element
+				cn.Location = n.Location
+			}
+			if pos < cs[i].Start {
+				merged = append(merged, fragment(n, pos, cs[i].Start, fragmentOffsets))
+			}
+			if cs[i].End > pos {
+				pos = cs[i].End
+			}
+		}
+		if pos < e {
+			merged = append(merged, fragment(n, pos, e, fragmentOffsets))
+		}
+	}
+
+	for _, cn := range corrected {
+		if cn.ID == -1 {
+			cn.ID = 0
+		}
+		merged = append(merged, *cn)
+	}
+	sort.SliceStable(merged, func(i, j int) bool {
+		return merged[i].Offsets.Char.Start < merged[j].Offsets.Char.Start
+	})
+	return merged
+}
+
+// fragment returns the part [start, end) of n as an unknown node
+func fragment(n MecabNode, start, end int, offsets func(int, int) NodeOffsets) MecabNode {
+	surface := []rune(n.Surface)
+	s, e := start-n.Offsets.Char.Start, end-n.Offsets.Char.Start
+	if len(surface) == n.Offsets.Char.End-n.Offsets.Char.Start {
+		surface = surface[s:e]
+	} else {
+		surface = nil
+	}
+	return MecabNode{
+		ID:       n.ID,
+		Stat:     int(MECAB_UNK_NODE),
+		Surface:  string(surface),
+		Length:   len(string(surface)),
+		StartPos: start,
+		Offsets:  offsets(start, end),
+		Element:  n.Element,
+		Location: n.Location,
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergeCorrections(t *testing.T) {
+	st := NewPlainSource("あいうえお")
+	nodes := []MecabNode{{ID: 1, Surface: "あい"}, {ID: 2, Surface: "うえお"}}
+	st.Locate(nodes)
+
+	cs := []Correction{{
+		Id:        7,
+		Start:     1,
+		End:       3,
+		Surface:   "いう",
+		Features:  NodeFeatures{Pos1: "名詞"},
+		Corrector: "tester",
+	}}
+	merged := MergeCorrections(st, nodes, cs)
+
+	var surfaces []string
+	for _, n := range merged {
+		surfaces = append(surfaces, n.Surface)
+	}
+	assert.Equal(t, []string{"あ", "いう", "えお"}, surfaces)
+	assert.Equal(t, int(MECAB_UNK_NODE), merged[0].Stat)
+	assert.Equal(t, 7, merged[1].Manual.ID)
+	assert.Equal(t, "名詞", merged[1].Features.Pos1)
+	assert.Equal(t, OffsetRange{3, 9}, merged[1].Offsets.Byte)
+	assert.Nil(t, merged[2].Manual)
+
+	// fragments located after corrections further on
+	nodes = []MecabNode{{ID: 1, Surface: "あい"}, {ID: 2, Surface: "うえお"}}
+	st.Locate(nodes)
+	cs = []Correction{{Id: 7, Start: 1, End: 2, Surface: "い"}, {Id: 8, Start: 3, End: 4, Surface: "え"}}
+	merged = MergeCorrections(st, nodes, cs)
+	var offsets []OffsetRange
+	for _, n := range merged {
+		offsets = append(offsets, n.Offsets.Byte)
+	}
+	assert.Equal(t, []OffsetRange{{0, 3}, {3, 6}, {6, 9}, {9, 12}, {12, 15}}, offsets)
+}
+
+func TestCorpus(t *testing.T) {
+	st := NewPlainSource("春が来た。\n夏")
+	raw := []MecabNode{
+		{Surface: "春", Features: NodeFeatures{Pos1: "名詞", Lemma: "春"}},
+		{Surface: "が", Features: NodeFeatures{Pos1: "助詞", Lemma: "が"}},
+		{Surface: "来た", Features: NodeFeatures{Pos1: "動詞", Lemma: "来る"}},
+		{Surface: "。", Features: NodeFeatures{Pos1: "補助記号", Pos2: "句点"}},
+		{Surface: "夏", Features: NodeFeatures{Pos1: "名詞", Lemma: "夏"}},
+	}
+	st.Locate(raw)
+	cs := []Correction{
+		{Start: 0, End: 1, Surface: "春", Features: NodeFeatures{Pos1: "名詞", Lemma: "春"}},
+		{Start: 2, End: 3, Surface: "来", Features: NodeFeatures{Pos1: "動詞", Lemma: "来る"}},
+		{Start: 3, End: 4, Surface: "た", Features: NodeFeatures{Pos1: "助動詞", Lemma: "た"}},
+	}
+	stats := compareCorrections(raw, cs)
+	assert.Equal(t, 3, stats.Corrections)
+	assert.Equal(t, 2, stats.BoundaryErrors)
+	assert.Equal(t, 2, stats.Changed)
+
+	merged := MergeCorrections(st, raw, cs)
+	sentences := splitSentences(st, merged)
+	assert.Equal(t, 2, len(sentences))
+	assert.True(t, corrected(sentences[0]))
+	assert.False(t, corrected(sentences[1]))
+
+	var buf bytes.Buffer
+	if err := writeCorpus(&buf, sentences[:1]); err != nil {
+		t.Fatalf("writeCorpus: %s", err)
+	}
+	lines := strings.Split(buf.String(), "\n")
+	assert.Equal(t, "春\t名詞,,,,,,,春,,,,,,,,,,,,,,,,,,,", lines[0])
+	assert.Equal(t, "EOS", lines[5])
+}
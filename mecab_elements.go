@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const xmlNamespace = "http://www.w3.org/XML/1998/namespace"
+
+// ElementRules tell how TEI elements are handled before tokenization.
+// Selectors are element names optionally followed by an attribute test,
+// e.g. "rt" or "hi[rend=rt]".
+type ElementRules struct {
+	Skip   []string          `yaml:"skip"`   // elements whose content is dropped
+	Inline []string          `yaml:"inline"` // elements which do not break words
+	Choice []string          `yaml:"choice"` // children of <choice> to read, by preference
+	Gaiji  map[string]string `yaml:"gaiji"`  // <g ref> -> character
+}
+
+func matchSelector(sel string, e xml.StartElement) bool {
+	name, test := sel, ""
+	if i := strings.IndexByte(sel, '['); i >= 0 && strings.HasSuffix(sel, "]") {
+		name, test = sel[:i], sel[i+1:len(sel)-1]
+	}
+	if name != e.Name.Local {
+		return false
+	}
+	if test == "" {
+		return true
+	}
+	key, value := test, ""
+	if i := strings.IndexByte(test, '='); i >= 0 {
+		key, value = test[:i], strings.Trim(test[i+1:], `"'`)
+	}
+	key = strings.TrimPrefix(key, "@")
+	for _, a := range e.Attr {
+		if a.Name.Local == key && (value == "" || a.Value == value) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAny(sels []string, e xml.StartElement) bool {
+	for _, sel := range sels {
+		if matchSelector(sel, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// skip reports whether the content of e is to be dropped
+func (r *ElementRules) skip(parent *xmlElement, e xml.StartElement) bool {
+	if r == nil {
+		return false
+	}
+	if parent != nil && parent.choice != "" && e.Name.Local != parent.choice {
+		return true
+	}
+	return matchAny(r.Skip, e)
+}
+
+// inline reports whether e is read as a part of the surrounding text
+func (r *ElementRules) inline(e xml.StartElement) bool {
+	if r == nil {
+		return false
+	}
+	return e.Name.Local == "g" || matchAny(r.Inline, e)
+}
+
+// choose returns the child of a <choice> to be read, if any
+func (r *ElementRules) choose(children []string) string {
+	if r == nil || len(children) == 0 {
+		return ""
+	}
+	for _, pref := range r.Choice {
+		for _, child := range children {
+			if child == pref {
+				return child
+			}
+		}
+	}
+	return children[0]
+}
+
+// gaiji returns the character standing for <g ref>, looked up in the rules
+// first and then in the charDecl of the document.
+func (r *ElementRules) gaiji(e xml.StartElement, glyphs map[string]string) (string, bool) {
+	ref := attrValue(e, "", "ref")
+	if ref == "" {
+		return "", false
+	}
+	if s, ok := r.Gaiji[ref]; ok {
+		return s, true
+	}
+	id := strings.TrimPrefix(ref, "#")
+	if s, ok := r.Gaiji[id]; ok {
+		return s, true
+	}
+	s, ok := glyphs[id]
+	return s, ok
+}
+
+func attrValue(e xml.StartElement, space, local string) string {
+	for _, a := range e.Attr {
+		if a.Name.Local == local && (space == "" || a.Name.Space == space) {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// xmlElement is an open element while extracting text
+type xmlElement struct {
+	name     string
+	start    xml.StartElement
+	path     string
+	id       string
+	lang     string // xml:lang, inherited
+	children map[string]int
+	choice   string
+}
+
+func newXMLElement(parent *xmlElement, e xml.StartElement, offset int) *xmlElement {
+	el := &xmlElement{
+		name:     e.Name.Local,
+		start:    e,
+		children: map[string]int{},
+	}
+	if parent != nil {
+		parent.children[el.name]++
+		el.path = fmt.Sprintf("%s/%s[%d]",
+			parent.path, el.name, parent.children[el.name])
+		el.id = parent.id
+		el.lang = parent.lang
+	} else {
+		el.path = "/" + el.name
+	}
+	if id := attrValue(e, xmlNamespace, "id"); id != "" {
+		el.id = id
+	}
+	if lang := attrValue(e, xmlNamespace, "lang"); lang != "" {
+		el.lang = lang
+	}
+	return el
+}
+
+// xmlDecls holds what has to be known before reading the body
+type xmlDecls struct {
+	choices map[int][]string  // offset of <choice> -> names of its children
+	glyphs  map[string]string // charDecl glyph/char xml:id -> mapping
+}
+
+func scanDecls(doc string) (*xmlDecls, error) {
+	decls := &xmlDecls{
+		choices: map[int][]string{},
+		glyphs:  map[string]string{},
+	}
+	d := xml.NewDecoder(strings.NewReader(doc))
+	var (
+		offsets []int
+		names   []string
+		glyph   string
+		mapping *strings.Builder
+		mtype   string
+	)
+	for {
+		start := int(d.InputOffset())
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if n := len(names); n > 0 && names[n-1] == "choice" {
+				o := offsets[n-1]
+				decls.choices[o] = append(decls.choices[o], t.Name.Local)
+			}
+			offsets = append(offsets, start)
+			names = append(names, t.Name.Local)
+			switch t.Name.Local {
+			case "char", "glyph":
+				glyph = attrValue(t, xmlNamespace, "id")
+			case "mapping":
+				mapping = &strings.Builder{}
+				mtype = attrValue(t, "", "type")
+			}
+		case xml.EndElement:
+			offsets = offsets[:len(offsets)-1]
+			names = names[:len(names)-1]
+			switch t.Name.Local {
+			case "char", "glyph":
+				glyph = ""
+			case "mapping":
+				s := strings.TrimSpace(mapping.String())
+				if _, ok := decls.glyphs[glyph]; glyph != "" && s != "" &&
+					(!ok || mtype == "standard") {
+					decls.glyphs[glyph] = s
+				}
+				mapping = nil
+			}
+		case xml.CharData:
+			if mapping != nil {
+				mapping.Write(t)
+			}
+		}
+	}
+	return decls, nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// EntityCandidate is a proper noun (固有名詞) found by MeCab
+type EntityCandidate struct {
+	Label    string          `json:"label"`
+	Lemma    string          `json:"lemma"`
+	Type     string          `json:"type"` // pos3: 人名, 地名, 組織名 or 一般
+	Count    int             `json:"count"`
+	Contexts []EntityContext `json:"contexts"`
+	Entities []string        `json:"entities"` // ids of matching entities
+}
+
+// EntityContext is an occurrence of a candidate with the text around it
+type EntityContext struct {
+	Left    string      `json:"left"`
+	Right   string      `json:"right"`
+	Offsets NodeOffsets `json:"offsets"`
+}
+
+// properNouns joins adjacent 固有名詞 nodes of the same pos3, e.g. 姓 and
+// 名, into single mentions
+func properNouns(nodes []MecabNode) [][]MecabNode {
+	var res [][]MecabNode
+	prev := -2
+	for idx, n := range nodes {
+		if n.Features.Pos2 != "固有名詞" || n.Unlocated {
+			continue
+		}
+		if k := len(res); k > 0 && prev == idx-1 {
+			p := nodes[prev]
+			if p.Offsets.Char.End == n.Offsets.Char.Start &&
+				p.Features.Pos3 == n.Features.Pos3 {
+				res[k-1] = append(res[k-1], n)
+				prev = idx
+				continue
+			}
+		}
+		res = append(res, []MecabNode{n})
+		prev = idx
+	}
+	return res
+}
+
+// entityCandidates aggregates the proper nouns of nodes analysed from st
+// keeping up to size contexts of width runes each
+func entityCandidates(st *SourceText, nodes []MecabNode, vt *VariantTable, size, width int) []*EntityCandidate {
+	byKey := map[string]*EntityCandidate{}
+	var cands []*EntityCandidate
+	for _, mention := range properNouns(nodes) {
+		first, last := mention[0], mention[len(mention)-1]
+		label, lemma := "", ""
+		for _, n := range mention {
+			label += n.Surface
+			lemma += n.Features.Lemma
+		}
+		typ := first.Features.Pos3
+		key := typ + "\t" + vt.Normalize(label)
+		cand, ok := byKey[key]
+		if !ok {
+			cand = &EntityCandidate{
+				Label:    label,
+				Lemma:    lemma,
+				Type:     typ,
+				Contexts: []EntityContext{},
+				Entities: []string{},
+			}
+			byKey[key] = cand
+			cands = append(cands, cand)
+		}
+		cand.Count++
+		if len(cand.Contexts) >= size {
+			continue
+		}
+		offsets := NodeOffsets{
+			Char:  OffsetRange{first.Offsets.Char.Start, last.Offsets.Char.End},
+			UTF16: OffsetRange{first.Offsets.UTF16.Start, last.Offsets.UTF16.End},
+			Byte:  OffsetRange{first.Offsets.Byte.Start, last.Offsets.Byte.End},
+		}
+		start := st.Map.fromOrigStart(offsets.Byte.Start)
+		end := st.Map.fromOrigEnd(offsets.Byte.End)
+		left := []rune(st.Text[:start])
+		if len(left) > width {
+			left = left[len(left)-width:]
+		}
+		right := []rune(st.Text[end:])
+		if len(right) > width {
+			right = right[:width]
+		}
+		cand.Contexts = append(cand.Contexts, EntityContext{
+			Left:    string(left),
+			Right:   string(right),
+			Offsets: offsets,
+		})
+	}
+	sort.SliceStable(cands, func(i, j int) bool {
+		return cands[i].Count > cands[j].Count
+	})
+	return cands
+}
+
+// POST
+
+// PostMecabEntities lists the proper-noun candidates of an uploaded file,
+// or the stored file ?file=, with the entities they match already.
+// ?type= limits them to a pos3, ?contexts= and ?width= size the contexts.
+func (h *MecabHandler) PostMecabEntities(c echo.Context) error {
+	size, width := 5, 10
+	if s := c.QueryParam("contexts"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return badRequest(c, "atoi", err)
+		}
+		if n <= 0 {
+			return badRequest(c, "contexts", fmt.Errorf("not positive: %d", n))
+		}
+		size = n
+	}
+	if s := c.QueryParam("width"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return badRequest(c, "atoi", err)
+		}
+		if n < 0 {
+			return badRequest(c, "width", fmt.Errorf("negative: %d", n))
+		}
+		width = n
+	}
+
+	filename, data, err := h.requestData(c)
+	if err != nil {
+		return err
+	}
+	st, err := h.NewSource(filename, data)
+	if err != nil {
+		return badRequest(c, "notxml", err)
+	}
+	st = Normalize(st, h.Normalize, h.Variants)
+	nodes, err := h.Analyze(st)
+	if err != nil {
+		return badRequest(c, "couldnotparsed", err)
+	}
+
+	entities, err := h.Db.selectEntities()
+	if err != nil {
+		return badRequest(c, "selectentities", err)
+	}
+	typ := c.QueryParam("type")
+	res := []*EntityCandidate{}
+	for _, cand := range entityCandidates(st, nodes, h.Variants, size, width) {
+		if typ != "" && cand.Type != typ {
+			continue
+		}
+		for _, e := range entities {
+			if h.Db.matchEntityLabel(e, cand.Label) ||
+				(cand.Lemma != "" && h.Db.matchEntityLabel(e, cand.Lemma)) {
+				cand.Entities = append(cand.Entities, e.ID)
+			}
+		}
+		res = append(res, cand)
+	}
+	return c.JSON(http.StatusOK, res)
+}
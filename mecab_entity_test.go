@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEntityCandidates(t *testing.T) {
+	st := NewPlainSource("田中太郎は京都へ行き、田中太郎と会った。")
+	person := func(surface, pos4, lemma string) MecabNode {
+		return MecabNode{Surface: surface, Features: NodeFeatures{
+			Pos1: "名詞", Pos2: "固有名詞", Pos3: "人名", Pos4: pos4, Lemma: lemma}}
+	}
+	other := func(surface string) MecabNode {
+		return MecabNode{Surface: surface, Features: NodeFeatures{Pos1: "助詞"}}
+	}
+	nodes := []MecabNode{
+		person("田中", "姓", "タナカ"), person("太郎", "名", "タロウ"), other("は"),
+		{Surface: "京都", Features: NodeFeatures{
+			Pos1: "名詞", Pos2: "固有名詞", Pos3: "地名", Lemma: "京都"}},
+		other("へ"), other("行き"), other("、"),
+		person("田中", "姓", "タナカ"), person("太郎", "名", "タロウ"), other("と"),
+	}
+	st.Locate(nodes)
+
+	cands := entityCandidates(st, nodes, nil, 1, 2)
+	assert.Len(t, cands, 2)
+	assert.Equal(t, "田中太郎", cands[0].Label)
+	assert.Equal(t, "人名", cands[0].Type)
+	assert.Equal(t, 2, cands[0].Count)
+	assert.Len(t, cands[0].Contexts, 1)
+	assert.Equal(t, "", cands[0].Contexts[0].Left)
+	assert.Equal(t, "は京", cands[0].Contexts[0].Right)
+	assert.Equal(t, OffsetRange{0, 4}, cands[0].Contexts[0].Offsets.Char)
+	assert.Equal(t, "京都", cands[1].Label)
+	assert.Equal(t, "地名", cands[1].Type)
+}
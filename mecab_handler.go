@@ -1,6 +1,9 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"database/sql/driver"
 	"encoding/csv"
 	"encoding/json"
 	"fmt"
@@ -8,9 +11,11 @@ import (
 	"io/ioutil"
 	"net/http"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/antchfx/xmlquery"
 	"github.com/bluele/mecab-golang"
 	"github.com/jszwec/csvutil"
 	"github.com/labstack/echo/v4"
@@ -18,18 +23,94 @@ import (
 
 type MecabHandler struct {
 	Mecab      *mecab.MeCab
+	Dicts      map[string]*MecabDict
 	Nodes      []MecabNode
 	NodeHeader []string
 	UnkHeader  []string
+	OffsetUnit string
+	Rules      *ElementRules
+	Normalize  *NormalizeOptions
+	Variants   *VariantTable
+	Db         *DbHandler
+	Parallel   int               // chunks analysed at once; 0 means the number of CPUs
+	ChunkSize  int               // bytes; 0 means DEFAULT_CHUNK_SIZE
+	Languages  map[string]string // xml:lang -> dictionary
+	DetectLang bool              // guess the language of untagged text by script
+	Keywords   *KeywordOptions
+	Topics     *TopicOptions
+	Search     *SearchOptions
+
+	topicSlots     chan struct{} // topic models trained at once
+	topicTrainings sync.Map      // run id -> *topicTraining
 }
 
 type MecabNode struct {
-	ID       int          `json:"id"`
-	Length   int          `json:"length"`
-	Stat     int          `json:"stat"`
-	StartPos int          `json:"startPos"`
-	Surface  string       `json:"surface"`
-	Features NodeFeatures `json:"features"`
+	ID       int           `json:"id"`
+	Length   int           `json:"length"`
+	Stat     int           `json:"stat"`
+	StartPos int           `json:"startPos"`
+	Surface  string        `json:"surface"`
+	Lang     string        `json:"lang,omitempty"`
+	Offsets  NodeOffsets   `json:"offsets"`
+	Element  *NodeElement  `json:"element,omitempty"`
+	Location *NodeLocation `json:"location,omitempty"`
+	Manual   *NodeManual   `json:"manual,omitempty"`
+	Features NodeFeatures  `json:"features"`
+
+	// Unlocated nodes were not found in the text; their offsets are
+	// empty, after the previous node
+	Unlocated bool `json:"unlocated,omitempty"`
+}
+
+// NodeManual marks a node taken from a manual correction
+type NodeManual struct {
+	ID        int       `json:"id"`
+	Corrector string    `json:"corrector"`
+	Updated   time.Time `json:"updated"`
+}
+
+// NodeElement is the source element a node starts in
+type NodeElement struct {
+	Path string `json:"path"`         // e.g. /TEI/text[1]/body[1]/p[2]
+	ID   string `json:"id,omitempty"` // nearest xml:id
+}
+
+// NodeLocation is the page and line a node starts on
+type NodeLocation struct {
+	Page string `json:"page,omitempty"` // pb/@n
+	Facs string `json:"facs,omitempty"` // pb/@facs
+	Line int    `json:"line,omitempty"` // lb/@n or counted
+}
+
+// NodeOffsets are relative to the original document
+type NodeOffsets struct {
+	Char  OffsetRange `json:"char"`  // runes
+	UTF16 OffsetRange `json:"utf16"` // UTF-16 code units
+	Byte  OffsetRange `json:"byte"`  // bytes
+}
+
+type OffsetRange struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// offset units to be used as canonical in compact formats
+const (
+	OFFSET_UNIT_CHAR  = "char"
+	OFFSET_UNIT_UTF16 = "utf16"
+	OFFSET_UNIT_BYTE  = "byte"
+)
+
+func (no NodeOffsets) In(unit string) (OffsetRange, error) {
+	switch unit {
+	case OFFSET_UNIT_CHAR, "":
+		return no.Char, nil
+	case OFFSET_UNIT_UTF16:
+		return no.UTF16, nil
+	case OFFSET_UNIT_BYTE:
+		return no.Byte, nil
+	}
+	return OffsetRange{}, fmt.Errorf("unknown offset unit: %s", unit)
 }
 
 type MecabStat int
@@ -71,6 +152,21 @@ type NodeFeatures struct {
 	Lemma_id string `json:"lemma_id"` // 語彙素ID
 }
 
+// Value and Scan store NodeFeatures as jsonb
+func (nf NodeFeatures) Value() (driver.Value, error) {
+	return json.Marshal(nf)
+}
+
+func (nf *NodeFeatures) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case []byte:
+		return json.Unmarshal(v, nf)
+	case string:
+		return json.Unmarshal([]byte(v), nf)
+	}
+	return fmt.Errorf("cannot scan %T into NodeFeatures", src)
+}
+
 func (mn MecabNode) String() string {
 	return fmt.Sprintf("%d,%d,%d:%s:%s",
 		mn.ID, mn.Length, mn.StartPos, mn.Surface, mn.Features)
@@ -78,16 +174,65 @@ func (mn MecabNode) String() string {
 
 // constructor
 func NewMecabHandler(dicts []string) (h *MecabHandler, err error) {
-	h = &MecabHandler{}
+	h = &MecabHandler{
+		OffsetUnit: OFFSET_UNIT_CHAR,
+		Dicts:      map[string]*MecabDict{},
+	}
 	h.Mecab, err = mecab.New(
 		fmt.Sprintf("-d %s", strings.Join(dicts, " ")))
 	if err != nil {
 		return h, err
 	}
+	h.Dicts[DEFAULT_DICT] = NewMecabDict(h.Mecab)
 	h.NodeHeader, err = csvutil.Header(NodeFeatures{}, "csv")
 	return h, err
 }
 
+// name of the dictionary given by mecab.dicts
+const DEFAULT_DICT = "default"
+
+// AddDict makes another dictionary available by name. Its features must
+// be in the same (UniDic) format as the default one.
+func (h *MecabHandler) AddDict(name string, dicts ...string) error {
+	if _, ok := h.Dicts[name]; ok {
+		return fmt.Errorf("dictionary already exists: %s", name)
+	}
+	m, err := mecab.New(fmt.Sprintf("-d %s", strings.Join(dicts, " ")))
+	if err != nil {
+		return err
+	}
+	h.Dicts[name] = NewMecabDict(m)
+	return nil
+}
+
+// SetPoolSize limits the number of taggers of each dictionary
+func (h *MecabHandler) SetPoolSize(size int) {
+	for _, d := range h.Dicts {
+		d.Size = size
+	}
+}
+
+func (h *MecabHandler) dict(name string) (*MecabDict, error) {
+	if name == "" {
+		name = DEFAULT_DICT
+	}
+	m, ok := h.Dicts[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown dictionary: %s", name)
+	}
+	return m, nil
+}
+
+func (h *MecabHandler) Destroy() {
+	h.topicTrainings.Range(func(id, t interface{}) bool {
+		h.stopTopicRun(id.(int))
+		return true
+	})
+	for _, m := range h.Dicts {
+		m.Destroy()
+	}
+}
+
 // POST
 func (h *MecabHandler) PostMecabConvert(c echo.Context) error {
 	// read an uploaded file
@@ -101,46 +246,159 @@ func (h *MecabHandler) PostMecabConvert(c echo.Context) error {
 	}
 	defer src.Close()
 
-	// apply xpath
-	var s string
-	if filepath.Ext(file.Filename) == ".xml" {
-		doc, err := xmlquery.Parse(src)
-		if err != nil {
-			return badRequest(c, "notxml", err)
-		}
-		t := xmlquery.FindOne(doc, "//TEI/text/body")
-		s = t.OutputXML(false)
-	} else {
-		data, err := ioutil.ReadAll(src)
+	data, err := ioutil.ReadAll(src)
+	if err != nil {
+		return badRequest(c, "nofile", err)
+	}
+
+	nodes, err := h.analyzeFile(c, file.Filename, data)
+	if err != nil {
+		return err
+	}
+	return h.writeNodes(c, nodes)
+}
+
+// GET
+func (h *MecabHandler) GetMecabFile(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return badRequest(c, "atoi", err)
+	}
+	obj, err := h.Db.DbMap.Get(File{}, id)
+	if err != nil {
+		return badRequest(c, "getfile", err)
+	}
+	if obj == nil {
+		return notFound(c, "getfile", strconv.Itoa(id))
+	}
+	f := obj.(*File)
+	data, err := h.Db.ReadFile(f.Sha256)
+	if err != nil {
+		return badRequest(c, "readfile", err)
+	}
+
+	nodes, err := h.analyzeFile(c, f.Name, data)
+	if err != nil {
+		return err
+	}
+	return h.writeNodes(c, nodes)
+}
+
+// analyzeFile analyses data merging the corrections of the file, if any
+func (h *MecabHandler) analyzeFile(c echo.Context, filename string, data []byte) ([]MecabNode, error) {
+	st, err := h.NewSource(filename, data)
+	if err != nil {
+		return nil, badRequest(c, "notxml", err)
+	}
+	if c.QueryParam("normalize") != "false" {
+		st = Normalize(st, h.Normalize, h.Variants)
+	}
+
+	nodes, err := h.Analyze(st)
+	if err != nil {
+		return nil, badRequest(c, "couldnotparsed", err)
+	}
+
+	if h.Db != nil && c.QueryParam("corrections") != "false" {
+		cs, err := h.Db.SelectCorrections(fmt.Sprintf("%x", sha256.Sum256(data)))
 		if err != nil {
-			return badRequest(c, "nofile", err)
+			return nil, badRequest(c, "selectcorrections", err)
 		}
-		s = string(data)
+		nodes = MergeCorrections(st, nodes, cs)
 	}
+	return nodes, nil
+}
 
-	err = h.ParseToNode(s)
-	if err != nil {
-		return badRequest(c, "couldnotparsed", err)
+// writeNodes responds with nodes in the format of ?fmt= and ?unit=
+func (h *MecabHandler) writeNodes(c echo.Context, nodes []MecabNode) error {
+	unit := c.QueryParam("unit")
+	if unit == "" {
+		unit = h.OffsetUnit
+	}
+	switch c.QueryParam("fmt") {
+	case "compact":
+		rows, err := compactNodes(nodes, unit)
+		if err != nil {
+			return badRequest(c, "unit", err)
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"unit": unit,
+			"data": rows,
+		})
+	case "tsv":
+		if _, err := (NodeOffsets{}).In(unit); err != nil {
+			return badRequest(c, "unit", err)
+		}
+		c.Response().Header().Set(
+			echo.HeaderContentType, "text/tab-separated-values; charset=UTF-8")
+		c.Response().WriteHeader(http.StatusOK)
+		return writeNodesTSV(c.Response(), nodes, unit)
 	}
 
 	c.Response().Header().Set(
 		echo.HeaderContentType, echo.MIMEApplicationJSONCharsetUTF8)
 	c.Response().WriteHeader(http.StatusOK)
 	return json.NewEncoder(c.Response()).Encode(map[string][]MecabNode{
-		"data": h.Nodes,
+		"data": nodes,
 	})
 }
 
 // utililies
+
+// NewSource extracts the text to be analysed from a file: //TEI/text/body
+// of XML files, or the whole file otherwise.
+func (h *MecabHandler) NewSource(filename string, data []byte) (*SourceText, error) {
+	if filepath.Ext(filename) == ".xml" {
+		return NewXMLSource(string(data), h.Rules)
+	}
+	return NewPlainSource(string(data)), nil
+}
+
 func (h *MecabHandler) ParseToNode(s string) error {
-	tg, err := h.Mecab.NewTagger()
+	nodes, err := h.parse(s, false)
 	if err != nil {
 		return err
 	}
-	defer tg.Destroy()
-	lt, err := h.Mecab.NewLattice(s)
+	h.Nodes = nodes
+	return nil
+}
+
+// Analyze parses st.Text and locates each node in st.Doc
+func (h *MecabHandler) Analyze(st *SourceText) ([]MecabNode, error) {
+	return h.analyze(st, false)
+}
+
+// AnalyzeAll is Analyze keeping symbols (補助記号)
+func (h *MecabHandler) AnalyzeAll(st *SourceText) ([]MecabNode, error) {
+	return h.analyze(st, true)
+}
+
+func (h *MecabHandler) analyze(st *SourceText, symbols bool) ([]MecabNode, error) {
+	return h.analyzeWith(context.Background(), h.Dicts[DEFAULT_DICT], st, symbols)
+}
+
+func (h *MecabHandler) analyzeWith(ctx context.Context, d *MecabDict, st *SourceText, symbols bool) ([]MecabNode, error) {
+	nodes, err := h.parseRouted(ctx, d, st, symbols)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	st.Locate(nodes)
+	return nodes, nil
+}
+
+func (h *MecabHandler) parse(s string, symbols bool) ([]MecabNode, error) {
+	return h.parseChunked(context.Background(), h.Dicts[DEFAULT_DICT], s, symbols)
+}
+
+func (h *MecabHandler) parseWith(ctx context.Context, d *MecabDict, s string, symbols bool) ([]MecabNode, error) {
+	tg, err := d.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Put(tg)
+	lt, err := d.NewLattice(s)
+	if err != nil {
+		return nil, err
 	}
 	defer lt.Destroy()
 
@@ -159,7 +417,8 @@ func (h *MecabHandler) ParseToNode(s string) error {
 		if stat == int(MECAB_UNK_NODE) {
 			features += strings.Repeat(",", 21)
 		}
-		if stat == int(MECAB_NOR_NODE) && string(features[0:12]) == "補助記号" {
+		if !symbols && stat == int(MECAB_NOR_NODE) &&
+			strings.HasPrefix(features, "補助記号") {
 			if node.Next() != nil {
 				break
 			}
@@ -169,13 +428,13 @@ func (h *MecabHandler) ParseToNode(s string) error {
 		csvReader := csv.NewReader(strings.NewReader(features))
 		dec, err := csvutil.NewDecoder(csvReader, h.NodeHeader...)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		var nf NodeFeatures
 		if err := dec.Decode(&nf); err == io.EOF {
 			break
 		} else if err != nil {
-			return fmt.Errorf("%s: %d: %+v", err, stat, features)
+			return nil, fmt.Errorf("%s: %d: %+v", err, stat, features)
 		}
 
 		nodes = append(nodes, MecabNode{
@@ -190,9 +449,49 @@ func (h *MecabHandler) ParseToNode(s string) error {
 			break
 		}
 	}
-	h.Nodes = nodes
 
-	return nil
+	return nodes, nil
+}
+
+// compactNodes flattens nodes into rows of
+// [id, start, end, surface, pos1, lemma] in the given offset unit
+func compactNodes(nodes []MecabNode, unit string) ([][]interface{}, error) {
+	rows := make([][]interface{}, 0, len(nodes))
+	for _, n := range nodes {
+		r, err := n.Offsets.In(unit)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, []interface{}{
+			n.ID, r.Start, r.End, n.Surface, n.Features.Pos1, n.Features.Lemma,
+		})
+	}
+	return rows, nil
+}
+
+func writeNodesTSV(w io.Writer, nodes []MecabNode, unit string) error {
+	cw := csv.NewWriter(w)
+	cw.Comma = '\t'
+	header := []string{"id", "start", "end", "surface",
+		"pos1", "pos2", "pos3", "pos4", "cType", "cForm", "lemma"}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, n := range nodes {
+		r, err := n.Offsets.In(unit)
+		if err != nil {
+			return err
+		}
+		f := n.Features
+		if err := cw.Write([]string{
+			strconv.Itoa(n.ID), strconv.Itoa(r.Start), strconv.Itoa(r.End),
+			n.Surface, f.Pos1, f.Pos2, f.Pos3, f.Pos4, f.CType, f.CForm, f.Lemma,
+		}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
 }
 
 func (h *MecabHandler) PrintNode() {
@@ -83,4 +83,9 @@ func TestMecabConvert(t *testing.T) {
 
 	expected := []string{"めかぶ", "名詞"}
 	assert.Equal(t, expected, actual)
+
+	// offsets point into test.xml
+	assert.Equal(t, int64(61), n.Get("offsets.char.start").Int())
+	assert.Equal(t, int64(64), n.Get("offsets.char.end").Int())
+	assert.Equal(t, int64(70), n.Get("offsets.byte.end").Int())
 }
@@ -0,0 +1,297 @@
+package main
+
+// hentaigana maps Kana Supplement and Kana Extended-A code points onto
+// standard kana, after the first reading in their Unicode names.
+var hentaigana = map[rune]rune{
+	0x1B000: 'エ', // KATAKANA LETTER ARCHAIC E
+	0x1B001: 'え', // HIRAGANA LETTER ARCHAIC YE
+	0x1B002: 'あ', // HENTAIGANA LETTER A-1
+	0x1B003: 'あ', // HENTAIGANA LETTER A-2
+	0x1B004: 'あ', // HENTAIGANA LETTER A-3
+	0x1B005: 'あ', // HENTAIGANA LETTER A-WO
+	0x1B006: 'い', // HENTAIGANA LETTER I-1
+	0x1B007: 'い', // HENTAIGANA LETTER I-2
+	0x1B008: 'い', // HENTAIGANA LETTER I-3
+	0x1B009: 'い', // HENTAIGANA LETTER I-4
+	0x1B00A: 'う', // HENTAIGANA LETTER U-1
+	0x1B00B: 'う', // HENTAIGANA LETTER U-2
+	0x1B00C: 'う', // HENTAIGANA LETTER U-3
+	0x1B00D: 'う', // HENTAIGANA LETTER U-4
+	0x1B00E: 'う', // HENTAIGANA LETTER U-5
+	0x1B00F: 'え', // HENTAIGANA LETTER E-2
+	0x1B010: 'え', // HENTAIGANA LETTER E-3
+	0x1B011: 'え', // HENTAIGANA LETTER E-4
+	0x1B012: 'え', // HENTAIGANA LETTER E-5
+	0x1B013: 'え', // HENTAIGANA LETTER E-6
+	0x1B014: 'お', // HENTAIGANA LETTER O-1
+	0x1B015: 'お', // HENTAIGANA LETTER O-2
+	0x1B016: 'お', // HENTAIGANA LETTER O-3
+	0x1B017: 'か', // HENTAIGANA LETTER KA-1
+	0x1B018: 'か', // HENTAIGANA LETTER KA-2
+	0x1B019: 'か', // HENTAIGANA LETTER KA-3
+	0x1B01A: 'か', // HENTAIGANA LETTER KA-4
+	0x1B01B: 'か', // HENTAIGANA LETTER KA-5
+	0x1B01C: 'か', // HENTAIGANA LETTER KA-6
+	0x1B01D: 'か', // HENTAIGANA LETTER KA-7
+	0x1B01E: 'か', // HENTAIGANA LETTER KA-8
+	0x1B01F: 'か', // HENTAIGANA LETTER KA-9
+	0x1B020: 'か', // HENTAIGANA LETTER KA-10
+	0x1B021: 'か', // HENTAIGANA LETTER KA-11
+	0x1B022: 'か', // HENTAIGANA LETTER KA-KE
+	0x1B023: 'き', // HENTAIGANA LETTER KI-1
+	0x1B024: 'き', // HENTAIGANA LETTER KI-2
+	0x1B025: 'き', // HENTAIGANA LETTER KI-3
+	0x1B026: 'き', // HENTAIGANA LETTER KI-4
+	0x1B027: 'き', // HENTAIGANA LETTER KI-5
+	0x1B028: 'き', // HENTAIGANA LETTER KI-6
+	0x1B029: 'き', // HENTAIGANA LETTER KI-7
+	0x1B02A: 'き', // HENTAIGANA LETTER KI-8
+	0x1B02B: 'く', // HENTAIGANA LETTER KU-1
+	0x1B02C: 'く', // HENTAIGANA LETTER KU-2
+	0x1B02D: 'く', // HENTAIGANA LETTER KU-3
+	0x1B02E: 'く', // HENTAIGANA LETTER KU-4
+	0x1B02F: 'く', // HENTAIGANA LETTER KU-5
+	0x1B030: 'く', // HENTAIGANA LETTER KU-6
+	0x1B031: 'く', // HENTAIGANA LETTER KU-7
+	0x1B032: 'け', // HENTAIGANA LETTER KE-1
+	0x1B033: 'け', // HENTAIGANA LETTER KE-2
+	0x1B034: 'け', // HENTAIGANA LETTER KE-3
+	0x1B035: 'け', // HENTAIGANA LETTER KE-4
+	0x1B036: 'け', // HENTAIGANA LETTER KE-5
+	0x1B037: 'け', // HENTAIGANA LETTER KE-6
+	0x1B038: 'こ', // HENTAIGANA LETTER KO-1
+	0x1B039: 'こ', // HENTAIGANA LETTER KO-2
+	0x1B03A: 'こ', // HENTAIGANA LETTER KO-3
+	0x1B03B: 'こ', // HENTAIGANA LETTER KO-KI
+	0x1B03C: 'さ', // HENTAIGANA LETTER SA-1
+	0x1B03D: 'さ', // HENTAIGANA LETTER SA-2
+	0x1B03E: 'さ', // HENTAIGANA LETTER SA-3
+	0x1B03F: 'さ', // HENTAIGANA LETTER SA-4
+	0x1B040: 'さ', // HENTAIGANA LETTER SA-5
+	0x1B041: 'さ', // HENTAIGANA LETTER SA-6
+	0x1B042: 'さ', // HENTAIGANA LETTER SA-7
+	0x1B043: 'さ', // HENTAIGANA LETTER SA-8
+	0x1B044: 'し', // HENTAIGANA LETTER SI-1
+	0x1B045: 'し', // HENTAIGANA LETTER SI-2
+	0x1B046: 'し', // HENTAIGANA LETTER SI-3
+	0x1B047: 'し', // HENTAIGANA LETTER SI-4
+	0x1B048: 'し', // HENTAIGANA LETTER SI-5
+	0x1B049: 'し', // HENTAIGANA LETTER SI-6
+	0x1B04A: 'す', // HENTAIGANA LETTER SU-1
+	0x1B04B: 'す', // HENTAIGANA LETTER SU-2
+	0x1B04C: 'す', // HENTAIGANA LETTER SU-3
+	0x1B04D: 'す', // HENTAIGANA LETTER SU-4
+	0x1B04E: 'す', // HENTAIGANA LETTER SU-5
+	0x1B04F: 'す', // HENTAIGANA LETTER SU-6
+	0x1B050: 'す', // HENTAIGANA LETTER SU-7
+	0x1B051: 'す', // HENTAIGANA LETTER SU-8
+	0x1B052: 'せ', // HENTAIGANA LETTER SE-1
+	0x1B053: 'せ', // HENTAIGANA LETTER SE-2
+	0x1B054: 'せ', // HENTAIGANA LETTER SE-3
+	0x1B055: 'せ', // HENTAIGANA LETTER SE-4
+	0x1B056: 'せ', // HENTAIGANA LETTER SE-5
+	0x1B057: 'そ', // HENTAIGANA LETTER SO-1
+	0x1B058: 'そ', // HENTAIGANA LETTER SO-2
+	0x1B059: 'そ', // HENTAIGANA LETTER SO-3
+	0x1B05A: 'そ', // HENTAIGANA LETTER SO-4
+	0x1B05B: 'そ', // HENTAIGANA LETTER SO-5
+	0x1B05C: 'そ', // HENTAIGANA LETTER SO-6
+	0x1B05D: 'そ', // HENTAIGANA LETTER SO-7
+	0x1B05E: 'た', // HENTAIGANA LETTER TA-1
+	0x1B05F: 'た', // HENTAIGANA LETTER TA-2
+	0x1B060: 'た', // HENTAIGANA LETTER TA-3
+	0x1B061: 'た', // HENTAIGANA LETTER TA-4
+	0x1B062: 'ち', // HENTAIGANA LETTER TI-1
+	0x1B063: 'ち', // HENTAIGANA LETTER TI-2
+	0x1B064: 'ち', // HENTAIGANA LETTER TI-3
+	0x1B065: 'ち', // HENTAIGANA LETTER TI-4
+	0x1B066: 'ち', // HENTAIGANA LETTER TI-5
+	0x1B067: 'ち', // HENTAIGANA LETTER TI-6
+	0x1B068: 'ち', // HENTAIGANA LETTER TI-7
+	0x1B069: 'つ', // HENTAIGANA LETTER TU-1
+	0x1B06A: 'つ', // HENTAIGANA LETTER TU-2
+	0x1B06B: 'つ', // HENTAIGANA LETTER TU-3
+	0x1B06C: 'つ', // HENTAIGANA LETTER TU-4
+	0x1B06D: 'つ', // HENTAIGANA LETTER TU-TO
+	0x1B06E: 'て', // HENTAIGANA LETTER TE-1
+	0x1B06F: 'て', // HENTAIGANA LETTER TE-2
+	0x1B070: 'て', // HENTAIGANA LETTER TE-3
+	0x1B071: 'て', // HENTAIGANA LETTER TE-4
+	0x1B072: 'て', // HENTAIGANA LETTER TE-5
+	0x1B073: 'て', // HENTAIGANA LETTER TE-6
+	0x1B074: 'て', // HENTAIGANA LETTER TE-7
+	0x1B075: 'て', // HENTAIGANA LETTER TE-8
+	0x1B076: 'て', // HENTAIGANA LETTER TE-9
+	0x1B077: 'と', // HENTAIGANA LETTER TO-1
+	0x1B078: 'と', // HENTAIGANA LETTER TO-2
+	0x1B079: 'と', // HENTAIGANA LETTER TO-3
+	0x1B07A: 'と', // HENTAIGANA LETTER TO-4
+	0x1B07B: 'と', // HENTAIGANA LETTER TO-5
+	0x1B07C: 'と', // HENTAIGANA LETTER TO-6
+	0x1B07D: 'と', // HENTAIGANA LETTER TO-RA
+	0x1B07E: 'な', // HENTAIGANA LETTER NA-1
+	0x1B07F: 'な', // HENTAIGANA LETTER NA-2
+	0x1B080: 'な', // HENTAIGANA LETTER NA-3
+	0x1B081: 'な', // HENTAIGANA LETTER NA-4
+	0x1B082: 'な', // HENTAIGANA LETTER NA-5
+	0x1B083: 'な', // HENTAIGANA LETTER NA-6
+	0x1B084: 'な', // HENTAIGANA LETTER NA-7
+	0x1B085: 'な', // HENTAIGANA LETTER NA-8
+	0x1B086: 'な', // HENTAIGANA LETTER NA-9
+	0x1B087: 'に', // HENTAIGANA LETTER NI-1
+	0x1B088: 'に', // HENTAIGANA LETTER NI-2
+	0x1B089: 'に', // HENTAIGANA LETTER NI-3
+	0x1B08A: 'に', // HENTAIGANA LETTER NI-4
+	0x1B08B: 'に', // HENTAIGANA LETTER NI-5
+	0x1B08C: 'に', // HENTAIGANA LETTER NI-6
+	0x1B08D: 'に', // HENTAIGANA LETTER NI-7
+	0x1B08E: 'に', // HENTAIGANA LETTER NI-TE
+	0x1B08F: 'ぬ', // HENTAIGANA LETTER NU-1
+	0x1B090: 'ぬ', // HENTAIGANA LETTER NU-2
+	0x1B091: 'ぬ', // HENTAIGANA LETTER NU-3
+	0x1B092: 'ね', // HENTAIGANA LETTER NE-1
+	0x1B093: 'ね', // HENTAIGANA LETTER NE-2
+	0x1B094: 'ね', // HENTAIGANA LETTER NE-3
+	0x1B095: 'ね', // HENTAIGANA LETTER NE-4
+	0x1B096: 'ね', // HENTAIGANA LETTER NE-5
+	0x1B097: 'ね', // HENTAIGANA LETTER NE-6
+	0x1B098: 'ね', // HENTAIGANA LETTER NE-KO
+	0x1B099: 'の', // HENTAIGANA LETTER NO-1
+	0x1B09A: 'の', // HENTAIGANA LETTER NO-2
+	0x1B09B: 'の', // HENTAIGANA LETTER NO-3
+	0x1B09C: 'の', // HENTAIGANA LETTER NO-4
+	0x1B09D: 'の', // HENTAIGANA LETTER NO-5
+	0x1B09E: 'は', // HENTAIGANA LETTER HA-1
+	0x1B09F: 'は', // HENTAIGANA LETTER HA-2
+	0x1B0A0: 'は', // HENTAIGANA LETTER HA-3
+	0x1B0A1: 'は', // HENTAIGANA LETTER HA-4
+	0x1B0A2: 'は', // HENTAIGANA LETTER HA-5
+	0x1B0A3: 'は', // HENTAIGANA LETTER HA-6
+	0x1B0A4: 'は', // HENTAIGANA LETTER HA-7
+	0x1B0A5: 'は', // HENTAIGANA LETTER HA-8
+	0x1B0A6: 'は', // HENTAIGANA LETTER HA-9
+	0x1B0A7: 'は', // HENTAIGANA LETTER HA-10
+	0x1B0A8: 'は', // HENTAIGANA LETTER HA-11
+	0x1B0A9: 'ひ', // HENTAIGANA LETTER HI-1
+	0x1B0AA: 'ひ', // HENTAIGANA LETTER HI-2
+	0x1B0AB: 'ひ', // HENTAIGANA LETTER HI-3
+	0x1B0AC: 'ひ', // HENTAIGANA LETTER HI-4
+	0x1B0AD: 'ひ', // HENTAIGANA LETTER HI-5
+	0x1B0AE: 'ひ', // HENTAIGANA LETTER HI-6
+	0x1B0AF: 'ひ', // HENTAIGANA LETTER HI-7
+	0x1B0B0: 'ふ', // HENTAIGANA LETTER HU-1
+	0x1B0B1: 'ふ', // HENTAIGANA LETTER HU-2
+	0x1B0B2: 'ふ', // HENTAIGANA LETTER HU-3
+	0x1B0B3: 'へ', // HENTAIGANA LETTER HE-1
+	0x1B0B4: 'へ', // HENTAIGANA LETTER HE-2
+	0x1B0B5: 'へ', // HENTAIGANA LETTER HE-3
+	0x1B0B6: 'へ', // HENTAIGANA LETTER HE-4
+	0x1B0B7: 'へ', // HENTAIGANA LETTER HE-5
+	0x1B0B8: 'へ', // HENTAIGANA LETTER HE-6
+	0x1B0B9: 'へ', // HENTAIGANA LETTER HE-7
+	0x1B0BA: 'ほ', // HENTAIGANA LETTER HO-1
+	0x1B0BB: 'ほ', // HENTAIGANA LETTER HO-2
+	0x1B0BC: 'ほ', // HENTAIGANA LETTER HO-3
+	0x1B0BD: 'ほ', // HENTAIGANA LETTER HO-4
+	0x1B0BE: 'ほ', // HENTAIGANA LETTER HO-5
+	0x1B0BF: 'ほ', // HENTAIGANA LETTER HO-6
+	0x1B0C0: 'ほ', // HENTAIGANA LETTER HO-7
+	0x1B0C1: 'ほ', // HENTAIGANA LETTER HO-8
+	0x1B0C2: 'ま', // HENTAIGANA LETTER MA-1
+	0x1B0C3: 'ま', // HENTAIGANA LETTER MA-2
+	0x1B0C4: 'ま', // HENTAIGANA LETTER MA-3
+	0x1B0C5: 'ま', // HENTAIGANA LETTER MA-4
+	0x1B0C6: 'ま', // HENTAIGANA LETTER MA-5
+	0x1B0C7: 'ま', // HENTAIGANA LETTER MA-6
+	0x1B0C8: 'ま', // HENTAIGANA LETTER MA-7
+	0x1B0C9: 'み', // HENTAIGANA LETTER MI-1
+	0x1B0CA: 'み', // HENTAIGANA LETTER MI-2
+	0x1B0CB: 'み', // HENTAIGANA LETTER MI-3
+	0x1B0CC: 'み', // HENTAIGANA LETTER MI-4
+	0x1B0CD: 'み', // HENTAIGANA LETTER MI-5
+	0x1B0CE: 'み', // HENTAIGANA LETTER MI-6
+	0x1B0CF: 'み', // HENTAIGANA LETTER MI-7
+	0x1B0D0: 'む', // HENTAIGANA LETTER MU-1
+	0x1B0D1: 'む', // HENTAIGANA LETTER MU-2
+	0x1B0D2: 'む', // HENTAIGANA LETTER MU-3
+	0x1B0D3: 'む', // HENTAIGANA LETTER MU-4
+	0x1B0D4: 'め', // HENTAIGANA LETTER ME-1
+	0x1B0D5: 'め', // HENTAIGANA LETTER ME-2
+	0x1B0D6: 'め', // HENTAIGANA LETTER ME-MA
+	0x1B0D7: 'も', // HENTAIGANA LETTER MO-1
+	0x1B0D8: 'も', // HENTAIGANA LETTER MO-2
+	0x1B0D9: 'も', // HENTAIGANA LETTER MO-3
+	0x1B0DA: 'も', // HENTAIGANA LETTER MO-4
+	0x1B0DB: 'も', // HENTAIGANA LETTER MO-5
+	0x1B0DC: 'も', // HENTAIGANA LETTER MO-6
+	0x1B0DD: 'や', // HENTAIGANA LETTER YA-1
+	0x1B0DE: 'や', // HENTAIGANA LETTER YA-2
+	0x1B0DF: 'や', // HENTAIGANA LETTER YA-3
+	0x1B0E0: 'や', // HENTAIGANA LETTER YA-4
+	0x1B0E1: 'や', // HENTAIGANA LETTER YA-5
+	0x1B0E2: 'や', // HENTAIGANA LETTER YA-YO
+	0x1B0E3: 'ゆ', // HENTAIGANA LETTER YU-1
+	0x1B0E4: 'ゆ', // HENTAIGANA LETTER YU-2
+	0x1B0E5: 'ゆ', // HENTAIGANA LETTER YU-3
+	0x1B0E6: 'ゆ', // HENTAIGANA LETTER YU-4
+	0x1B0E7: 'よ', // HENTAIGANA LETTER YO-1
+	0x1B0E8: 'よ', // HENTAIGANA LETTER YO-2
+	0x1B0E9: 'よ', // HENTAIGANA LETTER YO-3
+	0x1B0EA: 'よ', // HENTAIGANA LETTER YO-4
+	0x1B0EB: 'よ', // HENTAIGANA LETTER YO-5
+	0x1B0EC: 'よ', // HENTAIGANA LETTER YO-6
+	0x1B0ED: 'ら', // HENTAIGANA LETTER RA-1
+	0x1B0EE: 'ら', // HENTAIGANA LETTER RA-2
+	0x1B0EF: 'ら', // HENTAIGANA LETTER RA-3
+	0x1B0F0: 'ら', // HENTAIGANA LETTER RA-4
+	0x1B0F1: 'り', // HENTAIGANA LETTER RI-1
+	0x1B0F2: 'り', // HENTAIGANA LETTER RI-2
+	0x1B0F3: 'り', // HENTAIGANA LETTER RI-3
+	0x1B0F4: 'り', // HENTAIGANA LETTER RI-4
+	0x1B0F5: 'り', // HENTAIGANA LETTER RI-5
+	0x1B0F6: 'り', // HENTAIGANA LETTER RI-6
+	0x1B0F7: 'り', // HENTAIGANA LETTER RI-7
+	0x1B0F8: 'る', // HENTAIGANA LETTER RU-1
+	0x1B0F9: 'る', // HENTAIGANA LETTER RU-2
+	0x1B0FA: 'る', // HENTAIGANA LETTER RU-3
+	0x1B0FB: 'る', // HENTAIGANA LETTER RU-4
+	0x1B0FC: 'る', // HENTAIGANA LETTER RU-5
+	0x1B0FD: 'る', // HENTAIGANA LETTER RU-6
+	0x1B0FE: 'れ', // HENTAIGANA LETTER RE-1
+	0x1B0FF: 'れ', // HENTAIGANA LETTER RE-2
+	0x1B100: 'れ', // HENTAIGANA LETTER RE-3
+	0x1B101: 'れ', // HENTAIGANA LETTER RE-4
+	0x1B102: 'ろ', // HENTAIGANA LETTER RO-1
+	0x1B103: 'ろ', // HENTAIGANA LETTER RO-2
+	0x1B104: 'ろ', // HENTAIGANA LETTER RO-3
+	0x1B105: 'ろ', // HENTAIGANA LETTER RO-4
+	0x1B106: 'ろ', // HENTAIGANA LETTER RO-5
+	0x1B107: 'ろ', // HENTAIGANA LETTER RO-6
+	0x1B108: 'わ', // HENTAIGANA LETTER WA-1
+	0x1B109: 'わ', // HENTAIGANA LETTER WA-2
+	0x1B10A: 'わ', // HENTAIGANA LETTER WA-3
+	0x1B10B: 'わ', // HENTAIGANA LETTER WA-4
+	0x1B10C: 'わ', // HENTAIGANA LETTER WA-5
+	0x1B10D: 'ゐ', // HENTAIGANA LETTER WI-1
+	0x1B10E: 'ゐ', // HENTAIGANA LETTER WI-2
+	0x1B10F: 'ゐ', // HENTAIGANA LETTER WI-3
+	0x1B110: 'ゐ', // HENTAIGANA LETTER WI-4
+	0x1B111: 'ゐ', // HENTAIGANA LETTER WI-5
+	0x1B112: 'ゑ', // HENTAIGANA LETTER WE-1
+	0x1B113: 'ゑ', // HENTAIGANA LETTER WE-2
+	0x1B114: 'ゑ', // HENTAIGANA LETTER WE-3
+	0x1B115: 'ゑ', // HENTAIGANA LETTER WE-4
+	0x1B116: 'を', // HENTAIGANA LETTER WO-1
+	0x1B117: 'を', // HENTAIGANA LETTER WO-2
+	0x1B118: 'を', // HENTAIGANA LETTER WO-3
+	0x1B119: 'を', // HENTAIGANA LETTER WO-4
+	0x1B11A: 'を', // HENTAIGANA LETTER WO-5
+	0x1B11B: 'を', // HENTAIGANA LETTER WO-6
+	0x1B11C: 'を', // HENTAIGANA LETTER WO-7
+	0x1B11D: 'ん', // HENTAIGANA LETTER N-MU-MO-1
+	0x1B11E: 'ん', // HENTAIGANA LETTER N-MU-MO-2
+	0x1B11F: 'う', // HIRAGANA LETTER ARCHAIC WU
+	0x1B120: 'イ', // KATAKANA LETTER ARCHAIC YI
+	0x1B121: 'エ', // KATAKANA LETTER ARCHAIC YE
+	0x1B122: 'ウ', // KATAKANA LETTER ARCHAIC WU
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"container/list"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+)
+
+// KeywordOptions configure the extraction of keywords
+type KeywordOptions struct {
+	Method string   `yaml:"method"` // tfidf or bm25
+	Size   int      `yaml:"size"`   // keywords per file
+	Pos    []string `yaml:"pos"`    // pos1 or pos1-pos2..., e.g. 名詞-普通名詞
+}
+
+const (
+	KEYWORD_TFIDF = "tfidf"
+	KEYWORD_BM25  = "bm25"
+
+	DEFAULT_KEYWORD_SIZE = 20
+	BM25_K1              = 1.2
+	BM25_B               = 0.75
+
+	LEMMA_CACHE_SIZE = 256 // files
+)
+
+// Keyword is a lemma characteristic of a file
+type Keyword struct {
+	Lemma string  `json:"lemma"`
+	Pos   string  `json:"pos"`
+	Count int     `json:"count"`
+	Score float64 `json:"score"`
+}
+
+// Keywords are stored as jsonb in files.keywords
+type Keywords []Keyword
+
+func (ks Keywords) Value() (driver.Value, error) {
+	if ks == nil {
+		return "[]", nil
+	}
+	return json.Marshal(ks)
+}
+
+func (ks *Keywords) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*ks = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(v, ks)
+	case string:
+		return json.Unmarshal([]byte(v), ks)
+	}
+	return fmt.Errorf("cannot scan %T into Keywords", src)
+}
+
+// lemmaCounts are the lemmas of a file with their pos1 and counts
+type lemmaCounts struct {
+	Tokens int
+	Counts map[string]int
+	Pos    map[string]string
+}
+
+// lemmaCache holds the lemmaCounts of the files analysed last by sha256,
+// state of corrections, normalization and pos classes
+var lemmaCache = newLRUCache(LEMMA_CACHE_SIZE)
+
+// lruCache keeps the values used last up to size
+type lruCache struct {
+	mu    sync.Mutex
+	size  int
+	order *list.List // of *lruEntry, the latest first
+	items map[string]*list.Element
+}
+
+type lruEntry struct {
+	key   string
+	value interface{}
+}
+
+func newLRUCache(size int) *lruCache {
+	return &lruCache{size: size, order: list.New(), items: map[string]*list.Element{}}
+}
+
+func (lc *lruCache) Load(key string) (interface{}, bool) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	e, ok := lc.items[key]
+	if !ok {
+		return nil, false
+	}
+	lc.order.MoveToFront(e)
+	return e.Value.(*lruEntry).value, true
+}
+
+func (lc *lruCache) Store(key string, value interface{}) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if e, ok := lc.items[key]; ok {
+		e.Value.(*lruEntry).value = value
+		lc.order.MoveToFront(e)
+		return
+	}
+	lc.items[key] = lc.order.PushFront(&lruEntry{key, value})
+	for lc.order.Len() > lc.size {
+		last := lc.order.Back()
+		lc.order.Remove(last)
+		delete(lc.items, last.Value.(*lruEntry).key)
+	}
+}
+
+// matchPos reports whether f is in one of the pos classes; no classes
+// match any token
+func matchPos(f NodeFeatures, classes []string) bool {
+	if len(classes) == 0 {
+		return true
+	}
+	pos := strings.Join([]string{f.Pos1, f.Pos2, f.Pos3, f.Pos4}, "-")
+	for _, class := range classes {
+		if pos == class || strings.HasPrefix(pos, class+"-") {
+			return true
+		}
+	}
+	return false
+}
+
+func countLemmas(nodes []MecabNode, classes []string) *lemmaCounts {
+	lc := &lemmaCounts{Counts: map[string]int{}, Pos: map[string]string{}}
+	for _, n := range nodes {
+		if !isToken(n) {
+			continue
+		}
+		lc.Tokens++
+		if n.Features.Lemma == "" || !matchPos(n.Features, classes) {
+			continue
+		}
+		lc.Counts[n.Features.Lemma]++
+		if _, ok := lc.Pos[n.Features.Lemma]; !ok {
+			lc.Pos[n.Features.Lemma] = n.Features.Pos1
+		}
+	}
+	return lc
+}
+
+// lemmas returns the lemma counts of a stored file, cached until the
+// file or its corrections change
+func (h *MecabHandler) lemmas(f *File, classes []string) (*lemmaCounts, error) {
+	stamp, err := h.Db.DbMap.SelectStr(
+		"SELECT count(*) || ':' || coalesce(max(updated)::text, '') "+
+			"FROM corrections WHERE sha256 = $1", f.Sha256)
+	if err != nil {
+		return nil, err
+	}
+	norm := ""
+	if h.Normalize.enabled() {
+		norm = fmt.Sprintf("%+v:%d", *h.Normalize, h.Variants.Version())
+	}
+	key := strings.Join([]string{f.Sha256, stamp, norm, strings.Join(classes, ",")}, "\t")
+	if lc, ok := lemmaCache.Load(key); ok {
+		return lc.(*lemmaCounts), nil
+	}
+	a, err := h.analyzeStored(f)
+	if err != nil {
+		return nil, err
+	}
+	lc := countLemmas(a.Nodes, classes)
+	lemmaCache.Store(key, lc)
+	return lc, nil
+}
+
+// bm25 weights a term occurring tf times in a document of length dl and
+// in df of n documents
+func bm25(tf, df float64, n int, dl, avgdl float64) float64 {
+	idf := math.Log(1 + (float64(n)-df+0.5)/(df+0.5))
+	norm := 1 - BM25_B
+	if avgdl > 0 {
+		norm += BM25_B * dl / avgdl
+	}
+	return idf * tf * (BM25_K1 + 1) / (tf + BM25_K1*norm)
+}
+
+// scoreKeywords weights the lemmas of doc against the document frequencies
+// df of a corpus of n documents whose mean length is avgdl tokens
+func scoreKeywords(doc *lemmaCounts, df map[string]int, n int, avgdl float64, method string) Keywords {
+	ks := Keywords{}
+	for lemma, count := range doc.Counts {
+		d := float64(df[lemma])
+		tf := float64(count)
+		var score float64
+		switch method {
+		case KEYWORD_BM25:
+			score = bm25(tf, d, n, float64(doc.Tokens), avgdl)
+		default:
+			idf := math.Log(float64(1+n)/(1+d)) + 1
+			score = tf / float64(doc.Tokens) * idf
+		}
+		ks = append(ks, Keyword{lemma, doc.Pos[lemma], count, score})
+	}
+	sort.Slice(ks, func(i, j int) bool {
+		if ks[i].Score != ks[j].Score {
+			return ks[i].Score > ks[j].Score
+		}
+		return ks[i].Lemma < ks[j].Lemma
+	})
+	return ks
+}
+
+// keywordOptions overrides the configuration with ?method=, ?size= and
+// ?pos=a,b
+func (h *MecabHandler) keywordOptions(c echo.Context) (KeywordOptions, error) {
+	opts := KeywordOptions{Method: KEYWORD_BM25, Size: DEFAULT_KEYWORD_SIZE}
+	if h.Keywords != nil {
+		if h.Keywords.Method != "" {
+			opts.Method = h.Keywords.Method
+		}
+		if h.Keywords.Size > 0 {
+			opts.Size = h.Keywords.Size
+		}
+		opts.Pos = h.Keywords.Pos
+	}
+	if s := c.QueryParam("method"); s != "" {
+		opts.Method = s
+	}
+	if s := c.QueryParam("size"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return opts, err
+		}
+		opts.Size = n
+	}
+	if opts.Size <= 0 {
+		return opts, fmt.Errorf("size not positive: %d", opts.Size)
+	}
+	if s := c.QueryParam("pos"); s != "" {
+		opts.Pos = strings.Split(s, ",")
+	}
+	if opts.Method != KEYWORD_TFIDF && opts.Method != KEYWORD_BM25 {
+		return opts, fmt.Errorf("unknown method: %s", opts.Method)
+	}
+	return opts, nil
+}
+
+// keywords computes the keywords of targets against all stored files and
+// stores them in files.keywords
+func (h *MecabHandler) keywords(targets []File, opts KeywordOptions) (map[int]Keywords, error) {
+	var files []File
+	if _, err := h.Db.DbMap.Select(&files, "SELECT * FROM files"); err != nil {
+		return nil, err
+	}
+	df := map[string]int{}
+	total := 0
+	for idx := range files {
+		lc, err := h.lemmas(&files[idx], opts.Pos)
+		if err != nil {
+			return nil, fmt.Errorf("%d: %s", files[idx].Id, err)
+		}
+		total += lc.Tokens
+		for lemma := range lc.Counts {
+			df[lemma]++
+		}
+	}
+	var avgdl float64
+	if len(files) > 0 {
+		avgdl = float64(total) / float64(len(files))
+	}
+
+	res := map[int]Keywords{}
+	for idx := range targets {
+		f := &targets[idx]
+		lc, err := h.lemmas(f, opts.Pos)
+		if err != nil {
+			return nil, fmt.Errorf("%d: %s", f.Id, err)
+		}
+		ks := scoreKeywords(lc, df, len(files), avgdl, opts.Method)
+		if len(ks) > opts.Size {
+			ks = ks[:opts.Size]
+		}
+		if _, err := h.Db.DbMap.Exec(
+			"UPDATE files SET keywords = $1 WHERE id = $2", ks, f.Id); err != nil {
+			return nil, err
+		}
+		res[f.Id] = ks
+	}
+	return res, nil
+}
+
+// GET
+
+// GetFileKeywords computes the keywords of a file relative to the rest of
+// the corpus and stores them as its metadata
+func (h *MecabHandler) GetFileKeywords(c echo.Context) error {
+	opts, err := h.keywordOptions(c)
+	if err != nil {
+		return badRequest(c, "keywordoptions", err)
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return badRequest(c, "atoi", err)
+	}
+	obj, err := h.Db.DbMap.Get(File{}, id)
+	if err != nil {
+		return badRequest(c, "getfile", err)
+	}
+	if obj == nil {
+		return notFound(c, "getfile", c.Param("id"))
+	}
+	res, err := h.keywords([]File{*obj.(*File)}, opts)
+	if err != nil {
+		return badRequest(c, "keywords", err)
+	}
+	return c.JSON(http.StatusOK, res[id])
+}
+
+// POST
+
+// PostFilesKeywords recomputes the keywords of the files of ?files= and
+// ?genre=, or of all files
+func (h *MecabHandler) PostFilesKeywords(c echo.Context) error {
+	opts, err := h.keywordOptions(c)
+	if err != nil {
+		return badRequest(c, "keywordoptions", err)
+	}
+	files, err := h.corpusFiles(c, true)
+	if err != nil {
+		return badRequest(c, "corpusfiles", err)
+	}
+	res, err := h.keywords(files, opts)
+	if err != nil {
+		return badRequest(c, "keywords", err)
+	}
+	c.Logger().Infof("updated: keywords: %d files", len(res))
+	return c.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScoreKeywords(t *testing.T) {
+	node := func(lemma, pos1, pos2 string) MecabNode {
+		return MecabNode{Surface: lemma, Features: NodeFeatures{
+			Pos1: pos1, Pos2: pos2, Lemma: lemma}}
+	}
+	nodes := []MecabNode{
+		node("桜", "名詞", "普通名詞"), node("が", "助詞", "格助詞"),
+		node("咲く", "動詞", "一般"), node("桜", "名詞", "普通名詞"),
+		node("春", "名詞", "普通名詞"), node("。", "補助記号", "句点"),
+	}
+	doc := countLemmas(nodes, []string{"名詞", "動詞-一般"})
+	assert.Equal(t, 5, doc.Tokens)
+	assert.Equal(t, map[string]int{"桜": 2, "咲く": 1, "春": 1}, doc.Counts)
+
+	// 春 and 咲く appear in every document, 桜 only in this one
+	df := map[string]int{"桜": 1, "咲く": 3, "春": 3}
+	for _, method := range []string{KEYWORD_TFIDF, KEYWORD_BM25} {
+		ks := scoreKeywords(doc, df, 3, 5, method)
+		assert.Len(t, ks, 3)
+		assert.Equal(t, "桜", ks[0].Lemma, method)
+		assert.Equal(t, 2, ks[0].Count)
+		assert.Equal(t, "名詞", ks[0].Pos)
+	}
+}
+
+func TestLRUCache(t *testing.T) {
+	lc := newLRUCache(2)
+	lc.Store("a", 1)
+	lc.Store("b", 2)
+	lc.Load("a")
+	lc.Store("c", 3)
+	_, ok := lc.Load("b")
+	assert.False(t, ok)
+	v, ok := lc.Load("a")
+	assert.True(t, ok)
+	assert.Equal(t, 1, v)
+	_, ok = lc.Load("c")
+	assert.True(t, ok)
+}
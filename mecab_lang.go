@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// DEFAULT_LANG is the language of text neither tagged nor detected
+const DEFAULT_LANG = "ja"
+
+// langSegment is a run of text in one language
+type langSegment struct {
+	OffsetRange
+	Lang string
+}
+
+// primaryLang returns the primary subtag of a language tag
+func primaryLang(lang string) string {
+	if i := strings.IndexAny(lang, "-_"); i >= 0 {
+		return strings.ToLower(lang[:i])
+	}
+	return strings.ToLower(lang)
+}
+
+// langSegments splits st.Text by the xml:lang of its elements. Untagged
+// text is split by script when detect is set. The segments cover the
+// whole text; text between elements belongs to the segment before it.
+func langSegments(st *SourceText, detect bool) []langSegment {
+	var segs []langSegment
+	push := func(start, end int, lang string) {
+		if lang == "" {
+			lang = DEFAULT_LANG
+		}
+		if n := len(segs); n == 0 {
+			start = 0
+		} else if segs[n-1].Lang == lang {
+			segs[n-1].End = end
+			return
+		}
+		segs = append(segs, langSegment{OffsetRange{start, end}, lang})
+	}
+	text := func(start, end int, lang string) {
+		if lang != "" || !detect {
+			push(start, end, lang)
+			return
+		}
+		for _, seg := range scriptSegments(st.Text[start:end]) {
+			push(start+seg.Start, start+seg.End, seg.Lang)
+		}
+	}
+
+	pos := 0
+	for _, el := range st.Elements {
+		if n := len(segs); n > 0 && el.Start > pos {
+			segs[n-1].End = el.Start
+		}
+		text(el.Start, el.End, el.Lang)
+		pos = el.End
+	}
+	if len(segs) == 0 {
+		text(0, len(st.Text), "")
+	} else {
+		segs[len(segs)-1].End = len(st.Text)
+	}
+	if len(segs) == 0 {
+		segs = append(segs, langSegment{OffsetRange{0, 0}, DEFAULT_LANG})
+	}
+	return segs
+}
+
+// scriptLang guesses the language of a letter by its script, or returns
+// "" for letters of Japanese and characters common to all scripts
+func scriptLang(r rune) string {
+	switch {
+	case !unicode.IsLetter(r):
+		return ""
+	case unicode.Is(unicode.Latin, r):
+		return "und-Latn"
+	case unicode.Is(unicode.Hangul, r):
+		return "ko"
+	case unicode.Is(unicode.Cyrillic, r):
+		return "und-Cyrl"
+	case unicode.Is(unicode.Greek, r):
+		return "und-Grek"
+	}
+	return ""
+}
+
+// scriptSegments splits s into runs of Japanese and of other scripts.
+// Spaces, digits and punctuation stay with the run they are in.
+func scriptSegments(s string) []langSegment {
+	var segs []langSegment
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		lang := scriptLang(r)
+		if n := len(segs); n > 0 {
+			last := &segs[n-1]
+			if lang == "" && !unicode.IsLetter(r) || lang == last.Lang {
+				last.End = i + size
+				i += size
+				continue
+			}
+		}
+		segs = append(segs, langSegment{OffsetRange{i, i + size}, lang})
+		i += size
+	}
+	return segs
+}
+
+// route returns the dictionary for lang: one configured for the tag or
+// its primary subtag, d for Japanese, or nil for the fallback tokenizer
+func (h *MecabHandler) route(d *MecabDict, lang string) *MecabDict {
+	if name, ok := h.Languages[lang]; ok {
+		return h.Dicts[name]
+	}
+	primary := primaryLang(lang)
+	if primary == "ja" {
+		return d
+	}
+	if name, ok := h.Languages[primary]; ok {
+		return h.Dicts[name]
+	}
+	return nil
+}
+
+// tokenize is the fallback tokenizer for languages without a dictionary.
+// Words are runs of letters and digits except Han characters, which are
+// single tokens; punctuation is kept as 補助記号 if symbols is set.
+func tokenize(s string, symbols bool) []MecabNode {
+	var (
+		nodes []MecabNode
+		runes int
+	)
+	add := func(start, end, startRune int, pos1 string) {
+		surface := s[start:end]
+		nodes = append(nodes, MecabNode{
+			ID:       len(nodes) + 1,
+			Length:   len(surface),
+			Stat:     int(MECAB_UNK_NODE),
+			StartPos: startRune,
+			Surface:  surface,
+			Features: NodeFeatures{Pos1: pos1, Lemma: surface},
+		})
+	}
+	word := func(r rune) bool {
+		return (unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r)) &&
+			!unicode.Is(unicode.Han, r)
+	}
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case unicode.IsSpace(r):
+			i += size
+			runes++
+		case word(r):
+			start, startRune := i, runes
+			for i < len(s) {
+				r, size := utf8.DecodeRuneInString(s[i:])
+				if !word(r) && !(r == '\'' || r == '-') {
+					break
+				}
+				i += size
+				runes++
+			}
+			add(start, i, startRune, "")
+		case unicode.Is(unicode.Han, r):
+			add(i, i+size, runes, "")
+			i += size
+			runes++
+		default:
+			if symbols {
+				add(i, i+size, runes, "補助記号")
+			}
+			i += size
+			runes++
+		}
+	}
+	return nodes
+}
+
+// parseRouted parses each language segment of st with its dictionary or
+// the fallback tokenizer and records the language on every node
+func (h *MecabHandler) parseRouted(ctx context.Context, d *MecabDict, st *SourceText, symbols bool) ([]MecabNode, error) {
+	segs := langSegments(st, h.DetectLang)
+	chunks := make([]OffsetRange, len(segs))
+	results := make([][]MecabNode, len(segs))
+	for idx, seg := range segs {
+		s := st.Text[seg.Start:seg.End]
+		var nodes []MecabNode
+		if m := h.route(d, seg.Lang); m != nil {
+			var err error
+			if nodes, err = h.parseChunked(ctx, m, s, symbols); err != nil {
+				return nil, err
+			}
+		} else {
+			nodes = tokenize(s, symbols)
+		}
+		for i := range nodes {
+			nodes[i].Lang = seg.Lang
+		}
+		chunks[idx], results[idx] = seg.OffsetRange, nodes
+	}
+	return stitchChunks(st.Text, chunks, results), nil
+}
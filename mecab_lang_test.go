@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLangSegments(t *testing.T) {
+	doc := `<TEI><teiHeader/><text><body>` +
+		`<p>子曰く<quote xml:lang="zh">學而時習之</quote>と。</p>` +
+		`<p>see Analects 1.1 参照</p>` +
+		`</body></text></TEI>`
+	st, err := NewXMLSource(doc, &ElementRules{Inline: []string{"quote"}})
+	if err != nil {
+		t.Fatalf("NewXMLSource: %s", err)
+	}
+
+	type seg struct{ Text, Lang string }
+	var got []seg
+	for _, s := range langSegments(st, true) {
+		got = append(got, seg{st.Text[s.Start:s.End], s.Lang})
+	}
+	assert.Equal(t, []seg{
+		{"子曰く", "ja"},
+		{"學而時習之", "zh"},
+		{"と。\n", "ja"},
+		{"see Analects 1.1 ", "und-Latn"},
+		{"参照\n", "ja"},
+	}, got)
+
+	// untagged text without detection is Japanese
+	st = NewPlainSource("see 参照")
+	assert.Equal(t, []langSegment{{OffsetRange{0, len(st.Text)}, "ja"}},
+		langSegments(st, false))
+}
+
+func TestTokenize(t *testing.T) {
+	var surfaces []string
+	var pos []int
+	for _, n := range tokenize("Don't panic, 學而", false) {
+		surfaces = append(surfaces, n.Surface)
+		pos = append(pos, n.StartPos)
+	}
+	assert.Equal(t, []string{"Don't", "panic", "學", "而"}, surfaces)
+	assert.Equal(t, []int{0, 6, 13, 14}, pos)
+	assert.Len(t, tokenize("a, b", true), 3)
+}
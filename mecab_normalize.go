@@ -0,0 +1,212 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+	"golang.org/x/text/width"
+)
+
+// NormalizeOptions configure the normalization of historical text before
+// it is handed to MeCab.
+type NormalizeOptions struct {
+	Iteration      bool `yaml:"iteration"`      // expand ゝ ゞ ヽ ヾ 〱 〲
+	IterationKanji bool `yaml:"iterationKanji"` // expand 々 〻
+	Hentaigana     bool `yaml:"hentaigana"`     // hentaigana -> standard kana
+	Ligatures      bool `yaml:"ligatures"`      // ゟ ヿ 𪜈 𬼀 -> より コト トモ シテ
+	Width          bool `yaml:"width"`          // fold full/half width forms
+	NFKC           bool `yaml:"nfkc"`           // apply NFKC
+	SmallKana      bool `yaml:"smallKana"`      // small kana -> large kana
+	Variants       bool `yaml:"variants"`       // kanji variants -> canonical forms
+}
+
+func (opts *NormalizeOptions) enabled() bool {
+	return opts != nil && *opts != NormalizeOptions{}
+}
+
+var kanaLigatures = map[rune]string{
+	'ゟ': "より",
+	'ヿ': "コト",
+	'𪜈': "トモ",
+	'𬼀': "シテ",
+	'𬼂': "ナリ",
+}
+
+var smallKana = map[rune]rune{
+	'ぁ': 'あ', 'ぃ': 'い', 'ぅ': 'う', 'ぇ': 'え', 'ぉ': 'お',
+	'っ': 'つ', 'ゃ': 'や', 'ゅ': 'ゆ', 'ょ': 'よ', 'ゎ': 'わ',
+	'ゕ': 'か', 'ゖ': 'け',
+	'ァ': 'ア', 'ィ': 'イ', 'ゥ': 'ウ', 'ェ': 'エ', 'ォ': 'オ',
+	'ッ': 'ツ', 'ャ': 'ヤ', 'ュ': 'ユ', 'ョ': 'ヨ', 'ヮ': 'ワ',
+	'ヵ': 'カ', 'ヶ': 'ケ',
+	'ㇰ': 'ク', 'ㇱ': 'シ', 'ㇲ': 'ス', 'ㇳ': 'ト', 'ㇴ': 'ヌ', 'ㇵ': 'ハ',
+	'ㇶ': 'ヒ', 'ㇷ': 'フ', 'ㇸ': 'ヘ', 'ㇹ': 'ホ', 'ㇺ': 'ム', 'ㇻ': 'ラ',
+	'ㇼ': 'リ', 'ㇽ': 'ル', 'ㇾ': 'レ', 'ㇿ': 'ロ',
+	'\U0001B150': 'ゐ', '\U0001B151': 'ゑ', '\U0001B152': 'を',
+	'\U0001B164': 'ヰ', '\U0001B165': 'ヱ', '\U0001B166': 'ヲ', '\U0001B167': 'ン',
+}
+
+// Normalize returns st with its text normalized according to opts and the
+// variant table vt. The offset map is composed so that the result still
+// points into st.Doc.
+func Normalize(st *SourceText, opts *NormalizeOptions, vt *VariantTable) *SourceText {
+	if !opts.enabled() {
+		return st
+	}
+
+	b := &sourceBuilder{}
+	var out []rune // normalized text so far, for iteration marks
+	s := st.Text
+	for i := 0; i < len(s); {
+		_, size := utf8.DecodeRuneInString(s[i:])
+
+		// iteration marks
+		if rep, n, ok := opts.iterate(s[i:], out); ok {
+			b.replace(rep, i, i+n)
+			out = append(out, []rune(rep)...)
+			i += n
+			continue
+		}
+
+		// a base character with its (half width) combining marks
+		j := i + size
+		for j < len(s) {
+			m, n := utf8.DecodeRuneInString(s[j:])
+			if !unicode.Is(unicode.Mn, m) && m != 'ﾞ' && m != 'ﾟ' {
+				break
+			}
+			j += n
+		}
+		chunk := s[i:j]
+		rep := opts.normalizeChunk(chunk, vt)
+		if rep == chunk {
+			b.copy(chunk, i)
+		} else {
+			b.replace(rep, i, j)
+		}
+		out = append(out, []rune(rep)...)
+		i = j
+	}
+
+	ns := b.source(st.Doc)
+	ns.Map = b.m.compose(st.Map)
+	for _, el := range st.Elements {
+		el.Start, el.End = b.m.fromOrigStart(el.Start), b.m.fromOrigEnd(el.End)
+		ns.Elements = append(ns.Elements, el)
+	}
+	for _, br := range st.Breaks {
+		br.Pos = b.m.fromOrigStart(br.Pos)
+		ns.Breaks = append(ns.Breaks, br)
+	}
+	return ns
+}
+
+func (opts *NormalizeOptions) normalizeChunk(chunk string, vt *VariantTable) string {
+	var sb strings.Builder
+	for _, r := range chunk {
+		if opts.Variants {
+			if v, ok := vt.Lookup(r); ok {
+				sb.WriteString(v)
+				continue
+			}
+		}
+		if opts.Hentaigana {
+			if k, ok := hentaigana[r]; ok {
+				r = k
+			}
+		}
+		if opts.Ligatures {
+			if l, ok := kanaLigatures[r]; ok {
+				sb.WriteString(l)
+				continue
+			}
+		}
+		sb.WriteRune(r)
+	}
+	s := sb.String()
+	if opts.NFKC {
+		s = norm.NFKC.String(s)
+	}
+	if opts.Width {
+		s = norm.NFC.String(width.Fold.String(s))
+	}
+	if opts.SmallKana {
+		s = strings.Map(func(r rune) rune {
+			if k, ok := smallKana[r]; ok {
+				return k
+			}
+			return r
+		}, s)
+	}
+	return s
+}
+
+// iterate expands an iteration mark at the head of s, repeating what
+// has been output so far. It returns the expansion and the length of the
+// mark in bytes.
+func (opts *NormalizeOptions) iterate(s string, out []rune) (string, int, bool) {
+	r, size := utf8.DecodeRuneInString(s)
+	if len(out) == 0 {
+		return "", 0, false
+	}
+	prev := out[len(out)-1]
+	kana := unicode.In(prev, unicode.Hiragana, unicode.Katakana)
+
+	if opts.Iteration {
+		switch r {
+		case 'ゝ', 'ヽ':
+			if kana {
+				return string(unvoice(prev)), size, true
+			}
+		case 'ゞ', 'ヾ':
+			if kana {
+				return string(voice(prev)), size, true
+			}
+		case '〱', '〲', '〳', '〴':
+			n := size
+			if r == '〳' || r == '〴' {
+				m, msize := utf8.DecodeRuneInString(s[size:])
+				if m != '〵' {
+					return "", 0, false
+				}
+				n += msize
+			}
+			if len(out) < 2 {
+				return "", 0, false
+			}
+			first, second := out[len(out)-2], prev
+			if unicode.IsSpace(first) || unicode.IsSpace(second) {
+				return "", 0, false
+			}
+			if r == '〲' || r == '〴' {
+				first = voice(first)
+			} else {
+				first = unvoice(first)
+			}
+			return string([]rune{first, second}), n, true
+		}
+	}
+	if opts.IterationKanji && (r == '々' || r == '〻') &&
+		unicode.Is(unicode.Han, prev) {
+		return string(prev), size, true
+	}
+	return "", 0, false
+}
+
+// voice returns the voiced kana of r, if any
+func voice(r rune) rune {
+	s := norm.NFC.String(string(unvoice(r)) + "\u3099")
+	if v, n := utf8.DecodeRuneInString(s); n == len(s) {
+		return v
+	}
+	return r
+}
+
+// unvoice returns the unvoiced kana of r
+func unvoice(r rune) rune {
+	s := norm.NFD.String(string(r))
+	u, _ := utf8.DecodeRuneInString(s)
+	return u
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"runtime"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// DEFAULT_CHUNK_SIZE is the size in bytes above which a text is split
+// into chunks analysed concurrently
+const DEFAULT_CHUNK_SIZE = 32 * 1024
+
+// splitChunks splits s into chunks of at least size bytes, each ending
+// after a newline or, lacking one, after 。 so that no morpheme straddles
+// two chunks. A text without such a boundary is a single chunk.
+func splitChunks(s string, size int) []OffsetRange {
+	if size <= 0 {
+		size = DEFAULT_CHUNK_SIZE
+	}
+	var chunks []OffsetRange
+	start := 0
+	for len(s)-start > size {
+		rest := s[start+size:]
+		i := strings.IndexByte(rest, '\n')
+		n := 1
+		if i < 0 {
+			i, n = strings.Index(rest, "。"), len("。")
+		}
+		if i < 0 {
+			break
+		}
+		end := start + size + i + n
+		chunks = append(chunks, OffsetRange{start, end})
+		start = end
+	}
+	if start < len(s) || len(chunks) == 0 {
+		chunks = append(chunks, OffsetRange{start, len(s)})
+	}
+	return chunks
+}
+
+// stitchChunks concatenates the nodes of consecutive chunks of s, shifting
+// StartPos by the runes and IDs by the nodes of the chunks before them
+func stitchChunks(s string, chunks []OffsetRange, results [][]MecabNode) []MecabNode {
+	var nodes []MecabNode
+	runes, ids := 0, 0
+	for idx, ch := range chunks {
+		next := ids
+		for _, n := range results[idx] {
+			n.StartPos += runes
+			n.ID += ids
+			if n.ID >= next {
+				next = n.ID + 1
+			}
+			nodes = append(nodes, n)
+		}
+		runes += utf8.RuneCountInString(s[ch.Start:ch.End])
+		ids = next
+	}
+	return nodes
+}
+
+// parseChunked parses large texts chunk by chunk on up to h.Parallel
+// taggers of d at once
+func (h *MecabHandler) parseChunked(ctx context.Context, d *MecabDict, s string, symbols bool) ([]MecabNode, error) {
+	chunks := splitChunks(s, h.ChunkSize)
+	if len(chunks) == 1 {
+		return h.parseWith(ctx, d, s, symbols)
+	}
+	workers := h.Parallel
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg      sync.WaitGroup
+		once    sync.Once
+		err     error
+		sem     = make(chan struct{}, workers)
+		results = make([][]MecabNode, len(chunks))
+	)
+	for idx, ch := range chunks {
+		wg.Add(1)
+		go func(idx int, ch OffsetRange) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if ctx.Err() != nil {
+				return
+			}
+			nodes, e := h.parseWith(ctx, d, s[ch.Start:ch.End], symbols)
+			if e != nil {
+				once.Do(func() {
+					err = e
+					cancel()
+				})
+				return
+			}
+			results[idx] = nodes
+		}(idx, ch)
+	}
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return stitchChunks(s, chunks, results), nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitChunks(t *testing.T) {
+	s := "春はあけぼの。やうやう白くなりゆく\n山ぎは少しあかりて。紫だちたる雲"
+	chunks := splitChunks(s, 10)
+	var got []string
+	for _, ch := range chunks {
+		got = append(got, s[ch.Start:ch.End])
+	}
+	assert.Equal(t, []string{
+		"春はあけぼの。やうやう白くなりゆく\n",
+		"山ぎは少しあかりて。",
+		"紫だちたる雲",
+	}, got)
+
+	assert.Equal(t, []OffsetRange{{0, 15}}, splitChunks("あいうえお", 3))
+	assert.Len(t, splitChunks("", 3), 1)
+}
+
+func TestStitchChunks(t *testing.T) {
+	s := "𠮷野。家で"
+	chunks := []OffsetRange{{0, len("𠮷野。")}, {len("𠮷野。"), len(s)}}
+	nodes := stitchChunks(s, chunks, [][]MecabNode{
+		{{ID: 1, StartPos: 0, Surface: "𠮷野"}, {ID: 3, StartPos: 2, Surface: "。"}},
+		{{ID: 1, StartPos: 0, Surface: "家"}, {ID: 2, StartPos: 1, Surface: "で"}},
+	})
+	var ids, pos []int
+	for _, n := range nodes {
+		ids = append(ids, n.ID)
+		pos = append(pos, n.StartPos)
+	}
+	assert.Equal(t, []int{1, 3, 5, 6}, ids)
+	assert.Equal(t, []int{0, 2, 3, 4}, pos)
+}
+
+func BenchmarkAnalyze(b *testing.B) {
+	h := createHandler()
+	defer h.Destroy()
+	text := strings.Repeat(
+		"春はあけぼの。やうやう白くなりゆく山ぎは、少しあかりて、紫だちたる雲の細くたなびきたる。\n", 2000)
+	h.ChunkSize = 8 * 1024
+
+	workers := []int{1, 2, 4, runtime.NumCPU()}
+	h.SetPoolSize(workers[len(workers)-1])
+	for _, n := range workers {
+		b.Run(fmt.Sprintf("parallel=%d", n), func(b *testing.B) {
+			h.Parallel = n
+			b.SetBytes(int64(len(text)))
+			for i := 0; i < b.N; i++ {
+				if _, err := h.Analyze(NewPlainSource(text)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
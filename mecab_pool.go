@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"runtime"
+	"sync"
+
+	"github.com/bluele/mecab-golang"
+)
+
+// MecabDict is a dictionary with a pool of reusable taggers
+type MecabDict struct {
+	*mecab.MeCab
+	Size int // max taggers; 0 means the number of CPUs
+
+	once    sync.Once
+	taggers chan *mecab.Tagger
+	tokens  chan struct{}
+}
+
+func NewMecabDict(m *mecab.MeCab) *MecabDict {
+	return &MecabDict{MeCab: m}
+}
+
+func (d *MecabDict) init() {
+	d.once.Do(func() {
+		size := d.Size
+		if size <= 0 {
+			size = runtime.NumCPU()
+		}
+		d.taggers = make(chan *mecab.Tagger, size)
+		d.tokens = make(chan struct{}, size)
+	})
+}
+
+// Get returns an idle tagger, creating one while the pool is not full
+func (d *MecabDict) Get(ctx context.Context) (*mecab.Tagger, error) {
+	d.init()
+	select {
+	case tg := <-d.taggers:
+		return tg, nil
+	default:
+	}
+	select {
+	case tg := <-d.taggers:
+		return tg, nil
+	case d.tokens <- struct{}{}:
+		tg, err := d.NewTagger()
+		if err != nil {
+			<-d.tokens
+			return nil, err
+		}
+		return tg, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Put returns a tagger to the pool
+func (d *MecabDict) Put(tg *mecab.Tagger) {
+	d.taggers <- tg
+}
+
+func (d *MecabDict) Destroy() {
+	d.init()
+	for {
+		select {
+		case tg := <-d.taggers:
+			tg.Destroy()
+		default:
+			d.MeCab.Destroy()
+			return
+		}
+	}
+}
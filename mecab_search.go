@@ -0,0 +1,540 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+)
+
+// SearchOptions configure the full-text search
+type SearchOptions struct {
+	Lemmas   bool `yaml:"lemmas"`   // index lemmas by MeCab
+	Snippets int  `yaml:"snippets"` // per file
+	Context  int  `yaml:"context"`  // characters around a hit
+}
+
+const (
+	SEARCH_NGRAM = "ngram"
+	SEARCH_LEMMA = "lemma"
+
+	DEFAULT_SEARCH_LIMIT    = 20
+	DEFAULT_SEARCH_SNIPPETS = 3
+	DEFAULT_SEARCH_CONTEXT  = 30
+)
+
+// SearchEntry is the indexed text of a file; Grams are the characters and
+// bigrams of the folded text and Hits the places of each lemma
+type SearchEntry struct {
+	FileId  int            `db:"file_id,primarykey" json:"fileId"`
+	Sha256  string         `db:"sha256,notnull" json:"sha256"`
+	Text    string         `db:"text" json:"-"`
+	Length  int            `db:"length" json:"length"` // characters
+	Grams   pq.StringArray `db:"grams" json:"-"`
+	Lemmas  pq.StringArray `db:"lemmas" json:"-"`
+	Tokens  int            `db:"tokens" json:"tokens"`
+	Hits    SearchHits     `db:"hits" json:"-"`
+	Indexed time.Time      `db:"indexed" json:"indexed"`
+}
+
+// SearchHits are character ranges of Text by lemma
+type SearchHits map[string][]OffsetRange
+
+// Value and Scan store SearchHits as jsonb
+func (sh SearchHits) Value() (driver.Value, error) {
+	return json.Marshal(sh)
+}
+
+func (sh *SearchHits) Scan(src interface{}) error {
+	return scanJSON(src, sh)
+}
+
+// Snippet is a part of a text around hits; Highlights are relative to Text
+type Snippet struct {
+	Start      int           `json:"start"` // characters
+	End        int           `json:"end"`
+	Text       string        `json:"text"`
+	Highlights []OffsetRange `json:"highlights"`
+	HTML       string        `json:"html"` // hits in <mark>
+}
+
+type SearchResult struct {
+	File     File      `json:"file"`
+	Score    float64   `json:"score"`
+	Hits     int       `json:"hits"`
+	Snippets []Snippet `json:"snippets"`
+}
+
+type SearchResponse struct {
+	Query   string         `json:"query"`
+	Mode    string         `json:"mode"`
+	Terms   []string       `json:"terms"`
+	Total   int            `json:"total"`
+	Results []SearchResult `json:"results"`
+}
+
+// foldText maps every character onto the form it is indexed and searched
+// as: kanji variants to their canonical form and letters to lower case
+func foldText(vt *VariantTable, s string) []rune {
+	rs := []rune(s)
+	for i, r := range rs {
+		if c, ok := vt.Lookup(r); ok && utf8.RuneCountInString(c) == 1 {
+			r, _ = utf8.DecodeRuneInString(c)
+		}
+		rs[i] = unicode.ToLower(r)
+	}
+	return rs
+}
+
+// textGrams returns the distinct characters and bigrams of rs not
+// containing spaces
+func textGrams(rs []rune) pq.StringArray {
+	seen := map[string]bool{}
+	for i, r := range rs {
+		if unicode.IsSpace(r) {
+			continue
+		}
+		seen[string(r)] = true
+		if i+1 < len(rs) && !unicode.IsSpace(rs[i+1]) {
+			seen[string(rs[i:i+2])] = true
+		}
+	}
+	grams := pq.StringArray{}
+	for g := range seen {
+		grams = append(grams, g)
+	}
+	sort.Strings(grams)
+	return grams
+}
+
+// queryGrams returns the grams a text containing q has: q itself if a
+// single character, or its bigrams
+func queryGrams(q []rune) []string {
+	if len(q) == 1 {
+		return textGrams(q)
+	}
+	var grams []string
+	for i := 0; i+1 < len(q); i++ {
+		if !unicode.IsSpace(q[i]) && !unicode.IsSpace(q[i+1]) {
+			grams = appendNew(grams, string(q[i:i+2]))
+		}
+	}
+	return grams
+}
+
+// findAll returns the ranges of the occurrences of q in text, not
+// overlapping
+func findAll(text, q []rune) []OffsetRange {
+	var hits []OffsetRange
+	if len(q) == 0 {
+		return hits
+	}
+	for i := 0; i+len(q) <= len(text); {
+		j := 0
+		for j < len(q) && text[i+j] == q[j] {
+			j++
+		}
+		if j == len(q) {
+			hits = append(hits, OffsetRange{i, i + len(q)})
+			i += len(q)
+		} else {
+			i++
+		}
+	}
+	return hits
+}
+
+// lemmaHits returns the number of tokens and the character ranges in
+// st.Text of the lemma of each token
+func lemmaHits(st *SourceText, nodes []MecabNode) (int, SearchHits) {
+	// byte offsets -> character offsets
+	runeAt := make([]int, len(st.Text)+1)
+	n := 0
+	for i := 0; i < len(st.Text); i++ {
+		if i > 0 && utf8.RuneStart(st.Text[i]) {
+			n++
+		}
+		runeAt[i] = n
+	}
+	runeAt[len(st.Text)] = utf8.RuneCountInString(st.Text)
+
+	tokens := 0
+	hits := SearchHits{}
+	for _, node := range nodes {
+		if !isToken(node) {
+			continue
+		}
+		tokens++
+		lemma := node.Features.Lemma
+		if lemma == "" || node.Unlocated {
+			continue
+		}
+		start := st.Map.fromOrigStart(node.Offsets.Byte.Start)
+		end := st.Map.fromOrigEnd(node.Offsets.Byte.End)
+		hits[lemma] = append(hits[lemma], OffsetRange{runeAt[start], runeAt[end]})
+	}
+	return tokens, hits
+}
+
+// makeSnippets cuts at most max parts of text around the hits, sorted,
+// with context characters on both sides
+func makeSnippets(text []rune, hits []OffsetRange, max, context int) []Snippet {
+	snippets := []Snippet{}
+	var cur *Snippet
+	var marks []OffsetRange
+	flush := func() {
+		if cur == nil {
+			return
+		}
+		part := text[cur.Start:cur.End]
+		cur.Text = string(part)
+		var sb strings.Builder
+		last := 0
+		for _, m := range marks {
+			start, end := m.Start-cur.Start, m.End-cur.Start
+			if start < last {
+				start = last
+			}
+			if start >= end {
+				continue
+			}
+			cur.Highlights = append(cur.Highlights, OffsetRange{start, end})
+			sb.WriteString(html.EscapeString(string(part[last:start])))
+			sb.WriteString("<mark>")
+			sb.WriteString(html.EscapeString(string(part[start:end])))
+			sb.WriteString("</mark>")
+			last = end
+		}
+		sb.WriteString(html.EscapeString(string(part[last:])))
+		cur.HTML = sb.String()
+		snippets = append(snippets, *cur)
+		cur, marks = nil, nil
+	}
+	for _, hit := range hits {
+		if cur != nil && hit.Start < cur.End {
+			if end := hit.End + context; end > cur.End {
+				cur.End = end
+			}
+		} else {
+			flush()
+			if len(snippets) == max {
+				break
+			}
+			cur = &Snippet{Start: hit.Start - context, End: hit.End + context,
+				Highlights: []OffsetRange{}}
+			if cur.Start < 0 {
+				cur.Start = 0
+			}
+		}
+		if cur.End > len(text) {
+			cur.End = len(text)
+		}
+		marks = append(marks, hit)
+	}
+	flush()
+	return snippets
+}
+
+// IndexFile updates the search index of f unless its content is indexed
+// already; corrections and variants changed need a reindex
+func (h *MecabHandler) IndexFile(f *File) error {
+	return h.index(f, false)
+}
+
+// UnindexFile removes a file from the search index
+func (h *MecabHandler) UnindexFile(id int) error {
+	_, err := h.Db.DbMap.Exec("DELETE FROM search_texts WHERE file_id = $1", id)
+	return err
+}
+
+func (h *MecabHandler) index(f *File, force bool) error {
+	if !force {
+		obj, err := h.Db.DbMap.Get(SearchEntry{}, f.Id)
+		if err != nil {
+			return err
+		}
+		if obj != nil && obj.(*SearchEntry).Sha256 == f.Sha256 {
+			return nil
+		}
+	}
+	data, err := h.Db.ReadFile(f.Sha256)
+	if err != nil {
+		return err
+	}
+	st, err := h.NewSource(f.Name, data)
+	if err != nil {
+		return err
+	}
+	folded := foldText(h.Variants, st.Text)
+	e := &SearchEntry{
+		FileId:  f.Id,
+		Sha256:  f.Sha256,
+		Text:    st.Text,
+		Length:  len(folded),
+		Grams:   textGrams(folded),
+		Lemmas:  pq.StringArray{},
+		Hits:    SearchHits{},
+		Indexed: time.Now(),
+	}
+	if h.Search != nil && h.Search.Lemmas {
+		a, err := h.analyzeStored(f)
+		if err != nil {
+			return err
+		}
+		e.Tokens, e.Hits = lemmaHits(st, a.Nodes)
+		for lemma := range e.Hits {
+			e.Lemmas = append(e.Lemmas, lemma)
+		}
+		sort.Strings(e.Lemmas)
+	}
+
+	trans, err := h.Db.DbMap.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := trans.Exec("DELETE FROM search_texts WHERE file_id = $1", f.Id); err != nil {
+		trans.Rollback()
+		return err
+	}
+	if err := trans.Insert(e); err != nil {
+		trans.Rollback()
+		return err
+	}
+	return trans.Commit()
+}
+
+// searchOptions reads ?mode=, ?limit=, ?offset=, ?snippets= and ?context=
+func (h *MecabHandler) searchOptions(c echo.Context) (mode string, params map[string]int, err error) {
+	mode = SEARCH_NGRAM
+	if s := c.QueryParam("mode"); s != "" {
+		mode = s
+	}
+	if mode != SEARCH_NGRAM && mode != SEARCH_LEMMA {
+		return mode, nil, fmt.Errorf("unknown mode: %s", mode)
+	}
+	params = map[string]int{
+		"limit":    DEFAULT_SEARCH_LIMIT,
+		"offset":   0,
+		"snippets": DEFAULT_SEARCH_SNIPPETS,
+		"context":  DEFAULT_SEARCH_CONTEXT,
+	}
+	if h.Search != nil {
+		if h.Search.Snippets > 0 {
+			params["snippets"] = h.Search.Snippets
+		}
+		if h.Search.Context > 0 {
+			params["context"] = h.Search.Context
+		}
+	}
+	for name := range params {
+		if s := c.QueryParam(name); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				return mode, nil, fmt.Errorf("%s: %q", name, s)
+			}
+			params[name] = n
+		}
+	}
+	return mode, params, nil
+}
+
+// queryLemmas returns the lemmas of the tokens of q
+func (h *MecabHandler) queryLemmas(q string) ([]string, error) {
+	nodes, err := h.Analyze(Normalize(NewPlainSource(q), h.Normalize, h.Variants))
+	if err != nil {
+		return nil, err
+	}
+	var lemmas []string
+	for _, n := range nodes {
+		if !isToken(n) {
+			continue
+		}
+		lemma := n.Features.Lemma
+		if lemma == "" {
+			lemma = n.Surface
+		}
+		lemmas = appendNew(lemmas, lemma)
+	}
+	return lemmas, nil
+}
+
+// GET
+
+// GetSearch finds the files containing ?q=, as a substring ignoring kanji
+// variants and case (?mode=ngram) or as lemmas in any form (?mode=lemma),
+// ranked by BM25; files are filtered by ?genre= and their metadata as in
+// /api/files
+func (h *MecabHandler) GetSearch(c echo.Context) error {
+	q := normalizeSpace(c.QueryParam("q"))
+	if q == "" {
+		return badRequest(c, "search", fmt.Errorf("missing q"))
+	}
+	mode, params, err := h.searchOptions(c)
+	if err != nil {
+		return badRequest(c, "searchoptions", err)
+	}
+
+	var terms []string
+	column := "grams"
+	folded := foldText(h.Variants, q)
+	if mode == SEARCH_LEMMA {
+		column = "lemmas"
+		if terms, err = h.queryLemmas(q); err != nil {
+			return badRequest(c, "querylemmas", err)
+		}
+	} else {
+		terms = queryGrams(folded)
+	}
+	res := SearchResponse{Query: q, Mode: mode, Terms: terms, Results: []SearchResult{}}
+	if len(terms) == 0 {
+		return c.JSON(http.StatusOK, res)
+	}
+
+	query := "SELECT f.* FROM files f JOIN search_texts s " +
+		"ON s.file_id = f.id AND s.sha256 = f.sha256 WHERE s." + column + " @> $1"
+	args := []interface{}{pq.StringArray(terms)}
+	if genre := c.QueryParam("genre"); genre != "" {
+		args = append(args, genre)
+		query += " AND f.genre = $2"
+	}
+	var files []File
+	if _, err := h.Db.DbMap.Select(&files, query, args...); err != nil {
+		return badRequest(c, "select", err)
+	}
+	files = h.Db.matchMetadata(c, files)
+	if len(files) == 0 {
+		return c.JSON(http.StatusOK, res)
+	}
+	byId := map[int]File{}
+	ids := make([]int64, len(files))
+	for i, f := range files {
+		byId[f.Id] = f
+		ids[i] = int64(f.Id)
+	}
+	var entries []SearchEntry
+	if _, err := h.Db.DbMap.Select(&entries,
+		"SELECT * FROM search_texts WHERE file_id = ANY($1)", pq.Int64Array(ids)); err != nil {
+		return badRequest(c, "selecttexts", err)
+	}
+
+	// the statistics of the whole index for BM25
+	var n int
+	var avgLength, avgTokens float64
+	if err := h.Db.Db.QueryRow("SELECT count(*), coalesce(avg(length), 0), "+
+		"coalesce(avg(tokens), 0) FROM search_texts").Scan(&n, &avgLength, &avgTokens); err != nil {
+		return badRequest(c, "selectstats", err)
+	}
+	df := map[string]int{}
+	if mode == SEARCH_LEMMA {
+		for _, t := range terms {
+			count, err := h.Db.DbMap.SelectInt(
+				"SELECT count(*) FROM search_texts WHERE lemmas @> $1", pq.StringArray{t})
+			if err != nil {
+				return badRequest(c, "selectdf", err)
+			}
+			df[t] = int(count)
+		}
+	}
+
+	hits := map[int][]OffsetRange{}
+	for _, e := range entries {
+		var found []OffsetRange
+		if mode == SEARCH_LEMMA {
+			for _, t := range terms {
+				found = append(found, e.Hits[t]...)
+			}
+			sort.Slice(found, func(i, j int) bool { return found[i].Start < found[j].Start })
+		} else {
+			// texts with every bigram may still lack the phrase
+			found = findAll(foldText(h.Variants, e.Text), folded)
+		}
+		if len(found) > 0 {
+			hits[e.FileId] = found
+		}
+	}
+	for _, e := range entries {
+		found := hits[e.FileId]
+		if len(found) == 0 {
+			continue
+		}
+		var score float64
+		if mode == SEARCH_LEMMA {
+			for _, t := range terms {
+				score += bm25(float64(len(e.Hits[t])), float64(df[t]), n,
+					float64(e.Tokens), avgTokens)
+			}
+		} else {
+			score = bm25(float64(len(found)), float64(len(hits)), n,
+				float64(e.Length), avgLength)
+		}
+		res.Results = append(res.Results, SearchResult{
+			File:  byId[e.FileId],
+			Score: score,
+			Hits:  len(found),
+		})
+	}
+	sort.Slice(res.Results, func(i, j int) bool {
+		if res.Results[i].Score != res.Results[j].Score {
+			return res.Results[i].Score > res.Results[j].Score
+		}
+		return res.Results[i].File.Id < res.Results[j].File.Id
+	})
+
+	res.Total = len(res.Results)
+	start, end := params["offset"], params["offset"]+params["limit"]
+	if start > res.Total {
+		start = res.Total
+	}
+	if end > res.Total {
+		end = res.Total
+	}
+	res.Results = res.Results[start:end]
+	texts := map[int]string{}
+	for _, e := range entries {
+		texts[e.FileId] = e.Text
+	}
+	for i := range res.Results {
+		r := &res.Results[i]
+		r.Snippets = makeSnippets([]rune(texts[r.File.Id]), hits[r.File.Id],
+			params["snippets"], params["context"])
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// POST
+
+// PostSearchReindex indexes again the files of ?files= and ?genre=, or all
+// files dropping the entries of files deleted
+func (h *MecabHandler) PostSearchReindex(c echo.Context) error {
+	files, err := h.corpusFiles(c, true)
+	if err != nil {
+		return badRequest(c, "corpusfiles", err)
+	}
+	if c.QueryParam("files") == "" && c.QueryParam("genre") == "" {
+		if _, err := h.Db.DbMap.Exec("DELETE FROM search_texts " +
+			"WHERE file_id NOT IN (SELECT id FROM files)"); err != nil {
+			return badRequest(c, "delete", err)
+		}
+	}
+	failed := map[int]string{}
+	for idx := range files {
+		if err := h.index(&files[idx], true); err != nil {
+			failed[files[idx].Id] = err.Error()
+		}
+	}
+	c.Logger().Infof("updated: search: %d files, %d failed", len(files), len(failed))
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"indexed": len(files) - len(failed),
+		"failed":  failed,
+	})
+}
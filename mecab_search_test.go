@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSearchGrams(t *testing.T) {
+	vt := NewVariantTable([]Variant{{Variant: "櫻", Canonical: "桜"}})
+	text := foldText(vt, "櫻の花 Sakura")
+	assert.Equal(t, "桜の花 sakura", string(text))
+
+	grams := textGrams(text)
+	assert.Contains(t, grams, "桜の")
+	assert.Contains(t, grams, "花")
+	assert.NotContains(t, grams, "花 ")
+	assert.Equal(t, []string{"花"}, queryGrams([]rune("花")))
+	assert.Equal(t, []string{"桜の", "の花"}, queryGrams(foldText(vt, "櫻の花")))
+
+	assert.Equal(t, []OffsetRange{{0, 3}}, findAll(text, foldText(vt, "櫻の花")))
+	assert.Equal(t, []OffsetRange{{5, 6}, {9, 10}}, findAll(text, []rune("a")))
+	assert.Empty(t, findAll(text, []rune("桜花")))
+}
+
+func TestMakeSnippets(t *testing.T) {
+	text := []rune("春はあけぼの。やうやう白くなりゆく山ぎは、すこしあかりて、紫だちたる雲の細くたなびきたる。")
+	hits := []OffsetRange{{0, 1}, {3, 6}, {28, 29}, {40, 41}}
+	ss := makeSnippets(text, hits, 2, 3)
+	if !assert.Len(t, ss, 2) {
+		return
+	}
+	assert.Equal(t, "春はあけぼの。やう", ss[0].Text)
+	assert.Equal(t, []OffsetRange{{0, 1}, {3, 6}}, ss[0].Highlights)
+	assert.Equal(t, "<mark>春</mark>はあ<mark>けぼの</mark>。やう", ss[0].HTML)
+	assert.Equal(t, 25, ss[1].Start)
+	assert.Equal(t, "かりて、紫だち", ss[1].Text)
+
+	ss = makeSnippets([]rune("<a&b>"), []OffsetRange{{1, 4}, {2, 3}}, 3, 1)
+	assert.Equal(t, "&lt;<mark>a&amp;b</mark>&gt;", ss[0].HTML)
+}
+
+func TestLemmaHits(t *testing.T) {
+	st, err := NewXMLSource(`<TEI><text><body><p>咲きにけり</p></body></text></TEI>`, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	doc := len(`<TEI><text><body><p>`)
+	node := func(surface, lemma string, start int) MecabNode {
+		n := MecabNode{Surface: surface}
+		n.Features.Pos1 = "動詞"
+		n.Features.Lemma = lemma
+		n.Offsets.Byte = OffsetRange{doc + start, doc + start + len(surface)}
+		return n
+	}
+	tokens, hits := lemmaHits(st, []MecabNode{
+		node("咲き", "咲く", 0), node("に", "ぬ", 6), node("けり", "けり", 9),
+	})
+	assert.Equal(t, 3, tokens)
+	assert.Equal(t, []OffsetRange{{0, 2}}, hits["咲く"])
+	assert.Equal(t, []OffsetRange{{3, 5}}, hits["けり"])
+}
@@ -0,0 +1,598 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// SourceText is the text handed to MeCab together with a map from its
+// byte offsets back to the original document.
+type SourceText struct {
+	Doc      string        // original document
+	Text     string        // text to be analysed
+	Map      OffsetMap     // Text -> Doc
+	Elements []ElementSpan // source elements of Text, if any
+	Breaks   []SourceBreak // page and line breaks in Text, if any
+}
+
+// OffsetSegment maps Text[Start:End] onto Doc[OrigStart:OrigEnd].
+// Segments of the same length map byte by byte; others are atomic.
+type OffsetSegment struct {
+	Start     int
+	End       int
+	OrigStart int
+	OrigEnd   int
+}
+
+func (seg OffsetSegment) linear() bool {
+	return seg.End-seg.Start == seg.OrigEnd-seg.OrigStart
+}
+
+// OffsetMap is a sorted list of contiguous segments covering the whole Text.
+type OffsetMap []OffsetSegment
+
+// OrigStart maps a start offset in Text onto Doc.
+func (m OffsetMap) OrigStart(pos int) int {
+	if len(m) == 0 {
+		return pos
+	}
+	i := sort.Search(len(m), func(i int) bool { return m[i].End > pos })
+	if i == len(m) {
+		return m[len(m)-1].OrigEnd
+	}
+	seg := m[i]
+	if seg.linear() {
+		return seg.OrigStart + pos - seg.Start
+	}
+	return seg.OrigStart
+}
+
+// OrigEnd maps an end offset in Text onto Doc.
+func (m OffsetMap) OrigEnd(pos int) int {
+	if len(m) == 0 {
+		return pos
+	}
+	i := sort.Search(len(m), func(i int) bool { return m[i].End >= pos })
+	if i == len(m) {
+		return m[len(m)-1].OrigEnd
+	}
+	seg := m[i]
+	if seg.linear() {
+		return seg.OrigStart + pos - seg.Start
+	}
+	if pos <= seg.Start {
+		return seg.OrigStart
+	}
+	return seg.OrigEnd
+}
+
+// ElementSpan records the element Text[Start:End] was extracted from.
+type ElementSpan struct {
+	Start int
+	End   int
+	Path  string
+	ID    string
+	Lang  string // xml:lang, inherited
+}
+
+// SourceBreak records the page and line Text[Pos:] starts on.
+type SourceBreak struct {
+	Pos  int
+	Page string // pb/@n
+	Facs string // pb/@facs
+	Line int    // lb/@n, or lbs counted from the last pb
+}
+
+// compose maps m, pointing into an intermediate text, through inner onto
+// the text inner points into.
+func (m OffsetMap) compose(inner OffsetMap) OffsetMap {
+	var res OffsetMap
+	for _, seg := range m {
+		if !seg.linear() || seg.Start == seg.End {
+			res = append(res, OffsetSegment{
+				Start:     seg.Start,
+				End:       seg.End,
+				OrigStart: inner.OrigStart(seg.OrigStart),
+				OrigEnd:   inner.OrigEnd(seg.OrigEnd),
+			})
+			continue
+		}
+		i := sort.Search(len(inner), func(i int) bool {
+			return inner[i].End > seg.OrigStart
+		})
+		for ; i < len(inner) && inner[i].Start < seg.OrigEnd; i++ {
+			in := inner[i]
+			a, b := in.Start, in.End
+			if a < seg.OrigStart {
+				a = seg.OrigStart
+			}
+			if b > seg.OrigEnd {
+				b = seg.OrigEnd
+			}
+			piece := OffsetSegment{
+				Start:     seg.Start + a - seg.OrigStart,
+				End:       seg.Start + b - seg.OrigStart,
+				OrigStart: in.OrigStart,
+				OrigEnd:   in.OrigEnd,
+			}
+			if in.linear() {
+				piece.OrigStart = in.OrigStart + a - in.Start
+				piece.OrigEnd = in.OrigStart + b - in.Start
+			}
+			res = append(res, piece)
+		}
+	}
+	return res
+}
+
+// fromOrigStart maps a start offset in the original back onto the text
+func (m OffsetMap) fromOrigStart(pos int) int {
+	i := sort.Search(len(m), func(i int) bool { return m[i].OrigEnd > pos })
+	if i == len(m) {
+		if len(m) == 0 {
+			return pos
+		}
+		return m[len(m)-1].End
+	}
+	seg := m[i]
+	if seg.linear() && pos >= seg.OrigStart {
+		return seg.Start + pos - seg.OrigStart
+	}
+	return seg.Start
+}
+
+// fromOrigEnd maps an end offset in the original back onto the text
+func (m OffsetMap) fromOrigEnd(pos int) int {
+	i := sort.Search(len(m), func(i int) bool { return m[i].OrigEnd >= pos })
+	if i == len(m) {
+		if len(m) == 0 {
+			return pos
+		}
+		return m[len(m)-1].End
+	}
+	seg := m[i]
+	if seg.linear() && pos >= seg.OrigStart {
+		return seg.Start + pos - seg.OrigStart
+	}
+	if pos <= seg.OrigStart {
+		return seg.Start
+	}
+	return seg.End
+}
+
+// sourceBuilder accumulates Text and its OffsetMap
+type sourceBuilder struct {
+	text   []byte
+	m      OffsetMap
+	elems  []ElementSpan
+	elem   *xmlElement
+	breaks []SourceBreak
+	loc    SourceBreak
+	join   bool
+	sep    int // end of the last block separator, kept by trimSpace
+}
+
+func (b *sourceBuilder) add(s string, origStart, origEnd int) {
+	if b.join {
+		s = strings.TrimLeft(s, " \t\r\n")
+		if s == "" {
+			return
+		}
+		b.join = false
+	}
+	start := len(b.text)
+	b.text = append(b.text, s...)
+	b.addElement(start, len(b.text))
+	seg := OffsetSegment{
+		Start:     start,
+		End:       len(b.text),
+		OrigStart: origStart,
+		OrigEnd:   origEnd,
+	}
+	if n := len(b.m); n > 0 {
+		last := &b.m[n-1]
+		if last.linear() && seg.linear() &&
+			last.End == seg.Start && last.OrigEnd == seg.OrigStart {
+			last.End = seg.End
+			last.OrigEnd = seg.OrigEnd
+			return
+		}
+	}
+	b.m = append(b.m, seg)
+}
+
+// copy appends s which appears verbatim in the document at orig
+func (b *sourceBuilder) copy(s string, orig int) {
+	b.add(s, orig, orig+len(s))
+}
+
+// replace appends s standing for Doc[origStart:origEnd]
+func (b *sourceBuilder) replace(s string, origStart, origEnd int) {
+	b.add(s, origStart, origEnd)
+}
+
+func (b *sourceBuilder) lastByte() byte {
+	if len(b.text) == 0 {
+		return 0
+	}
+	return b.text[len(b.text)-1]
+}
+
+// trimSpace drops trailing white space since the last block so that the
+// text is joined with whatever comes next
+func (b *sourceBuilder) trimSpace() {
+	n := len(b.text)
+	for n > b.sep && strings.IndexByte(" \t\r\n", b.text[n-1]) >= 0 {
+		n--
+	}
+	if n == len(b.text) {
+		return
+	}
+	b.text = b.text[:n]
+	for len(b.m) > 0 && b.m[len(b.m)-1].Start >= n {
+		b.m = b.m[:len(b.m)-1]
+	}
+	if k := len(b.m); k > 0 && b.m[k-1].End > n {
+		seg := &b.m[k-1]
+		if seg.linear() {
+			seg.OrigEnd -= seg.End - n
+		}
+		seg.End = n
+	}
+	for len(b.elems) > 0 && b.elems[len(b.elems)-1].Start >= n {
+		b.elems = b.elems[:len(b.elems)-1]
+	}
+	if k := len(b.elems); k > 0 && b.elems[k-1].End > n {
+		b.elems[k-1].End = n
+	}
+	for len(b.breaks) > 0 && b.breaks[len(b.breaks)-1].Pos > n {
+		b.breaks[len(b.breaks)-1].Pos = n
+	}
+}
+
+// pageBreak starts a new page at pb
+func (b *sourceBuilder) pageBreak(e xml.StartElement) {
+	b.loc.Page = attrValue(e, "", "n")
+	b.loc.Facs = attrValue(e, "", "facs")
+	b.loc.Line = 0
+}
+
+// lineBreak starts a new line at lb
+func (b *sourceBuilder) lineBreak(e xml.StartElement) {
+	if n, err := strconv.Atoi(attrValue(e, "", "n")); err == nil {
+		b.loc.Line = n
+	} else {
+		b.loc.Line++
+	}
+}
+
+// mark records the current location at the end of the text
+func (b *sourceBuilder) mark() {
+	loc := b.loc
+	loc.Pos = len(b.text)
+	if n := len(b.breaks); n > 0 && b.breaks[n-1].Pos == loc.Pos {
+		b.breaks[n-1] = loc
+		return
+	}
+	b.breaks = append(b.breaks, loc)
+}
+
+// separate makes sure the text is broken at orig
+func (b *sourceBuilder) separate(orig int) {
+	b.join = false
+	switch b.lastByte() {
+	case 0, ' ', '\t', '\n':
+	default:
+		b.replace("\n", orig, orig)
+	}
+	b.sep = len(b.text)
+}
+
+func (b *sourceBuilder) addElement(start, end int) {
+	if b.elem == nil || start == end {
+		return
+	}
+	if n := len(b.elems); n > 0 {
+		last := &b.elems[n-1]
+		if last.End == start && last.Path == b.elem.path {
+			last.End = end
+			return
+		}
+	}
+	b.elems = append(b.elems, ElementSpan{
+		Start: start,
+		End:   end,
+		Path:  b.elem.path,
+		ID:    b.elem.id,
+		Lang:  b.elem.lang,
+	})
+}
+
+func (b *sourceBuilder) source(doc string) *SourceText {
+	return &SourceText{
+		Doc:      doc,
+		Text:     string(b.text),
+		Map:      b.m,
+		Elements: b.elems,
+		Breaks:   b.breaks,
+	}
+}
+
+// NewPlainSource returns a SourceText analysing the whole document as is.
+func NewPlainSource(doc string) *SourceText {
+	return &SourceText{
+		Doc:  doc,
+		Text: doc,
+		Map:  OffsetMap{{0, len(doc), 0, len(doc)}},
+	}
+}
+
+// NewXMLSource extracts the text of //TEI/text/body keeping offsets into
+// the original XML. Elements are handled according to rules; with nil
+// rules every tag breaks the text as it did when the inner XML was handed
+// to MeCab.
+func NewXMLSource(doc string, rules *ElementRules) (*SourceText, error) {
+	decls, err := scanDecls(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	d := xml.NewDecoder(strings.NewReader(doc))
+	b := &sourceBuilder{}
+	var stack []*xmlElement
+	for {
+		start := int(d.InputOffset())
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		end := int(d.InputOffset())
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			var parent *xmlElement
+			if len(stack) > 0 {
+				parent = stack[len(stack)-1]
+			}
+			el := newXMLElement(parent, t, start)
+			body := inBody(stack)
+			if rules != nil && isBreak(t) {
+				// milestones: pb, cb and lb
+				switch t.Name.Local {
+				case "pb":
+					b.pageBreak(t)
+				case "lb":
+					b.lineBreak(t)
+				}
+				if !body {
+					continue
+				}
+				if attrValue(t, "", "break") == "yes" {
+					b.separate(start)
+				} else {
+					b.trimSpace()
+					b.join = true
+				}
+				b.mark()
+				continue
+			}
+			if body && rules.skip(parent, t) {
+				if err := d.Skip(); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if body && rules != nil && t.Name.Local == "g" {
+				if s, ok := rules.gaiji(t, decls.glyphs); ok {
+					if err := d.Skip(); err != nil {
+						return nil, err
+					}
+					b.elem = el
+					b.replace(s, start, int(d.InputOffset()))
+					b.elem = parent
+					continue
+				}
+			}
+			if body && !rules.inline(t) {
+				b.separate(start)
+			}
+			el.choice = rules.choose(decls.choices[start])
+			stack = append(stack, el)
+			if inBody(stack) {
+				if !body {
+					b.mark()
+				}
+				b.elem = el
+			}
+		case xml.EndElement:
+			if rules != nil && isBreak(xml.StartElement{Name: t.Name}) {
+				continue
+			}
+			el := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if inBody(stack) {
+				if !rules.inline(el.start) {
+					b.separate(start)
+				}
+				b.elem = stack[len(stack)-1]
+			}
+		case xml.CharData:
+			if inBody(stack) {
+				appendCharData(b, doc[start:end], start)
+			}
+		}
+	}
+	if b.m == nil {
+		return nil, fmt.Errorf("no //TEI/text/body found")
+	}
+	return b.source(doc), nil
+}
+
+// isBreak reports whether e is a milestone breaking pages, columns or lines
+func isBreak(e xml.StartElement) bool {
+	switch e.Name.Local {
+	case "pb", "cb", "lb":
+		return true
+	}
+	return false
+}
+
+// inBody reports whether the element stack is inside TEI/text/body
+func inBody(stack []*xmlElement) bool {
+	for i := 0; i+2 < len(stack); i++ {
+		if stack[i].name == "TEI" && stack[i+1].name == "text" &&
+			stack[i+2].name == "body" {
+			return true
+		}
+	}
+	return false
+}
+
+// appendCharData unescapes raw character data found at orig
+func appendCharData(b *sourceBuilder, raw string, orig int) {
+	if strings.HasPrefix(raw, "<![CDATA[") {
+		b.copy(strings.TrimSuffix(raw[9:], "]]>"), orig+9)
+		return
+	}
+	for i := 0; i < len(raw); {
+		switch raw[i] {
+		case '&':
+			if n := strings.IndexByte(raw[i:], ';'); n > 0 {
+				b.replace(unescapeEntity(raw[i+1:i+n]), orig+i, orig+i+n+1)
+				i += n + 1
+				continue
+			}
+		case '\r':
+			n := 1
+			if i+1 < len(raw) && raw[i+1] == '\n' {
+				n = 2
+			}
+			b.replace("\n", orig+i, orig+i+n)
+			i += n
+			continue
+		}
+		j := i + 1
+		for j < len(raw) && raw[j] != '&' && raw[j] != '\r' {
+			j++
+		}
+		b.copy(raw[i:j], orig+i)
+		i = j
+	}
+}
+
+func unescapeEntity(name string) string {
+	var s string
+	if err := xml.Unmarshal([]byte("<x>&"+name+";</x>"), &s); err != nil {
+		return "&" + name + ";"
+	}
+	return s
+}
+
+// offsetCounter converts byte offsets of a document into rune and UTF-16
+// offsets. It is fastest when queried in ascending order.
+type offsetCounter struct {
+	doc   string
+	pos   int
+	runes int
+	units int
+}
+
+func (oc *offsetCounter) count(pos int) (runes, units int) {
+	if pos < oc.pos {
+		oc.pos, oc.runes, oc.units = 0, 0, 0
+	}
+	if pos > len(oc.doc) {
+		pos = len(oc.doc)
+	}
+	for oc.pos < pos {
+		r, size := utf8.DecodeRuneInString(oc.doc[oc.pos:])
+		oc.pos += size
+		oc.runes++
+		if r >= 0x10000 {
+			oc.units += 2
+		} else {
+			oc.units++
+		}
+	}
+	return oc.runes, oc.units
+}
+
+// seekRune converts a rune offset into byte and UTF-16 offsets
+func (oc *offsetCounter) seekRune(runes int) (pos, units int) {
+	if runes < oc.runes {
+		oc.pos, oc.runes, oc.units = 0, 0, 0
+	}
+	for oc.runes < runes && oc.pos < len(oc.doc) {
+		oc.count(oc.pos + 1)
+	}
+	return oc.pos, oc.units
+}
+
+// Locate fills in the offsets of nodes analysed from st.Text. Nodes
+// whose surface is not found after the previous one are marked Unlocated.
+func (st *SourceText) Locate(nodes []MecabNode) {
+	oc := &offsetCounter{doc: st.Doc}
+	cursor := 0
+	for idx := range nodes {
+		n := &nodes[idx]
+		start, end := cursor, cursor
+		if i := strings.Index(st.Text[cursor:], n.Surface); i >= 0 {
+			start += i
+			end = start + len(n.Surface)
+			cursor = end
+		} else {
+			n.Unlocated = true
+		}
+
+		bs, be := st.Map.OrigStart(start), st.Map.OrigEnd(end)
+		rs, us := oc.count(bs)
+		re, ue := oc.count(be)
+		n.Offsets = NodeOffsets{
+			Char:  OffsetRange{rs, re},
+			UTF16: OffsetRange{us, ue},
+			Byte:  OffsetRange{bs, be},
+		}
+		n.Element = st.elementAt(start)
+		n.Location = st.locationAt(start)
+	}
+}
+
+// locationAt returns the page and line of the text at pos
+func (st *SourceText) locationAt(pos int) *NodeLocation {
+	i := sort.Search(len(st.Breaks), func(i int) bool {
+		return st.Breaks[i].Pos > pos
+	})
+	if i == 0 {
+		return nil
+	}
+	br := st.Breaks[i-1]
+	if br.Page == "" && br.Facs == "" && br.Line == 0 {
+		return nil
+	}
+	return &NodeLocation{
+		Page: br.Page,
+		Facs: br.Facs,
+		Line: br.Line,
+	}
+}
+
+// elementAt returns the source element of the text at pos
+func (st *SourceText) elementAt(pos int) *NodeElement {
+	i := sort.Search(len(st.Elements), func(i int) bool {
+		return st.Elements[i].End > pos
+	})
+	if i == len(st.Elements) || st.Elements[i].Start > pos {
+		return nil
+	}
+	return &NodeElement{
+		Path: st.Elements[i].Path,
+		ID:   st.Elements[i].ID,
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewXMLSource(t *testing.T) {
+	doc := "<TEI><teiHeader/><text><body><p>a&amp;b</p><p>𠮷は</p></body></text></TEI>"
+	st, err := NewXMLSource(doc, nil)
+	if err != nil {
+		t.Fatalf("NewXMLSource: %s", err)
+	}
+	assert.Equal(t, "a&b\n𠮷は\n", st.Text)
+
+	nodes := []MecabNode{{Surface: "&"}, {Surface: "𠮷"}, {Surface: "は"}}
+	st.Locate(nodes)
+	assert.Equal(t, "&amp;", doc[nodes[0].Offsets.Byte.Start:nodes[0].Offsets.Byte.End])
+	assert.Equal(t, "𠮷", doc[nodes[1].Offsets.Byte.Start:nodes[1].Offsets.Byte.End])
+	assert.Equal(t, OffsetRange{46, 47}, nodes[1].Offsets.Char)
+	assert.Equal(t, OffsetRange{46, 48}, nodes[1].Offsets.UTF16)
+	assert.Equal(t, OffsetRange{48, 49}, nodes[2].Offsets.UTF16)
+}
+
+func TestLocateUnlocated(t *testing.T) {
+	st := NewPlainSource("あいうえお")
+	nodes := []MecabNode{{Surface: "あい"}, {Surface: "か"}, {Surface: "うえ"}}
+	st.Locate(nodes)
+	assert.False(t, nodes[0].Unlocated)
+	assert.True(t, nodes[1].Unlocated)
+	assert.Equal(t, OffsetRange{2, 2}, nodes[1].Offsets.Char)
+	assert.False(t, nodes[2].Unlocated, "the cursor stays after the last located node")
+	assert.Equal(t, OffsetRange{2, 4}, nodes[2].Offsets.Char)
+
+	// neither corrected nor searched
+	merged := MergeCorrections(st, nodes, []Correction{{Start: 1, End: 3, Surface: "いう"}})
+	assert.Contains(t, merged, nodes[1])
+	_, hits := lemmaHits(st, []MecabNode{{Surface: "か", Unlocated: true,
+		Features: NodeFeatures{Lemma: "か"}}})
+	assert.Empty(t, hits)
+}
+
+func TestNewXMLSourceNoBody(t *testing.T) {
+	_, err := NewXMLSource("<TEI><teiHeader/></TEI>", nil)
+	assert.Error(t, err)
+}
+
+func TestNewXMLSourceRules(t *testing.T) {
+	doc := `<TEI><teiHeader><encodingDesc><charDecl>` +
+		`<glyph xml:id="g1"><mapping type="standard">辺</mapping></glyph>` +
+		`</charDecl></encodingDesc></teiHeader><text><body>` +
+		`<p xml:id="p1">浜<g ref="#g1">〓</g>に<ruby><rb>遊</rb><rt>あそ</rt></ruby>ぶ` +
+		`<note>注</note><choice><orig>ゐ</orig><reg>い</reg></choice>る</p>` +
+		`</body></text></TEI>`
+	rules := &ElementRules{
+		Skip:   []string{"rt", "note"},
+		Inline: []string{"ruby", "rb", "choice", "orig", "reg"},
+		Choice: []string{"reg"},
+	}
+	st, err := NewXMLSource(doc, rules)
+	if err != nil {
+		t.Fatalf("NewXMLSource: %s", err)
+	}
+	assert.Equal(t, "浜辺に遊ぶいる\n", st.Text)
+
+	nodes := []MecabNode{{Surface: "浜辺"}, {Surface: "に"}, {Surface: "遊ぶ"}, {Surface: "いる"}}
+	st.Locate(nodes)
+	assert.Equal(t, `浜<g ref="#g1">〓</g>`,
+		doc[nodes[0].Offsets.Byte.Start:nodes[0].Offsets.Byte.End])
+	assert.Equal(t, "/TEI/text[1]/body[1]/p[1]", nodes[0].Element.Path)
+	assert.Equal(t, "p1", nodes[0].Element.ID)
+	assert.Equal(t, "/TEI/text[1]/body[1]/p[1]/ruby[1]/rb[1]", nodes[2].Element.Path)
+	assert.Equal(t, "/TEI/text[1]/body[1]/p[1]/choice[1]/reg[1]", nodes[3].Element.Path)
+}
+
+func TestNewXMLSourceBreaks(t *testing.T) {
+	doc := "<TEI><text><body><pb n=\"1\" facs=\"p001.jpg\"/><p>\n" +
+		"<lb/>あいう\n" +
+		"<lb/>えお\n" +
+		"<pb n=\"2\" facs=\"p002.jpg\"/><lb break=\"yes\"/>かき</p><p>くけ</p></body></text></TEI>"
+	st, err := NewXMLSource(doc, &ElementRules{})
+	if err != nil {
+		t.Fatalf("NewXMLSource: %s", err)
+	}
+	assert.Equal(t, "あいうえお\nかき\nくけ\n", st.Text)
+
+	nodes := []MecabNode{{Surface: "あい"}, {Surface: "うえ"}, {Surface: "お"}, {Surface: "かき"}, {Surface: "くけ"}}
+	st.Locate(nodes)
+	assert.Equal(t, &NodeLocation{Page: "1", Facs: "p001.jpg", Line: 1}, nodes[0].Location)
+	assert.Equal(t, &NodeLocation{Page: "1", Facs: "p001.jpg", Line: 1}, nodes[1].Location)
+	assert.Equal(t, &NodeLocation{Page: "1", Facs: "p001.jpg", Line: 2}, nodes[2].Location)
+	assert.Equal(t, &NodeLocation{Page: "2", Facs: "p002.jpg", Line: 1}, nodes[3].Location)
+	assert.Equal(t, &NodeLocation{Page: "2", Facs: "p002.jpg", Line: 1}, nodes[4].Location)
+	assert.Equal(t, "う\n<lb/>え", doc[nodes[1].Offsets.Byte.Start:nodes[1].Offsets.Byte.End])
+
+	// a paragraph opening with lb is not joined to the one before
+	st, err = NewXMLSource("<TEI><text><body><p>くけ</p>\n<p>\n<lb/>あいう\n<lb/>えお</p></body></text></TEI>",
+		&ElementRules{})
+	if err != nil {
+		t.Fatalf("NewXMLSource: %s", err)
+	}
+	assert.Equal(t, "くけ\n\nあいうえお\n", st.Text)
+}
+
+func TestNormalize(t *testing.T) {
+	doc := "<TEI><text><body><p>いすゞ\U0001B002ゟこゝろ〳〵ｶﾞ</p></body></text></TEI>"
+	st, err := NewXMLSource(doc, &ElementRules{})
+	if err != nil {
+		t.Fatalf("NewXMLSource: %s", err)
+	}
+	st = Normalize(st, &NormalizeOptions{
+		Iteration:  true,
+		Hentaigana: true,
+		Ligatures:  true,
+		Width:      true,
+	}, nil)
+	assert.Equal(t, "いすずあよりこころころガ\n", st.Text)
+
+	nodes := []MecabNode{{Surface: "いすず"}, {Surface: "あ"}, {Surface: "より"}, {Surface: "こころ"}, {Surface: "ころ"}, {Surface: "ガ"}}
+	st.Locate(nodes)
+	orig := func(n MecabNode) string {
+		return doc[n.Offsets.Byte.Start:n.Offsets.Byte.End]
+	}
+	assert.Equal(t, "いすゞ", orig(nodes[0]))
+	assert.Equal(t, "\U0001B002", orig(nodes[1]))
+	assert.Equal(t, OffsetRange{23, 24}, nodes[1].Offsets.Char)
+	assert.Equal(t, OffsetRange{23, 25}, nodes[1].Offsets.UTF16)
+	assert.Equal(t, "ゟ", orig(nodes[2]))
+	assert.Equal(t, "こゝろ", orig(nodes[3]))
+	assert.Equal(t, "〳〵", orig(nodes[4]))
+	assert.Equal(t, "ｶﾞ", orig(nodes[5]))
+	assert.Equal(t, "/TEI/text[1]/body[1]/p[1]", nodes[5].Element.Path)
+}
+
+func TestNormalizeVariants(t *testing.T) {
+	variants, err := parseVariants(defaultVariants)
+	if err != nil {
+		t.Fatalf("parseVariants: %s", err)
+	}
+	vt := NewVariantTable(variants)
+	st := Normalize(NewPlainSource("學校"), &NormalizeOptions{Variants: true}, vt)
+	assert.Equal(t, "学校", st.Text)
+	nodes := []MecabNode{{Surface: "学校"}}
+	st.Locate(nodes)
+	assert.Equal(t, OffsetRange{0, 2}, nodes[0].Offsets.Char)
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"unicode"
+
+	"github.com/labstack/echo/v4"
+)
+
+// DEFAULT_MATTR_WINDOW is the window of the moving-average TTR in tokens
+const DEFAULT_MATTR_WINDOW = 100
+
+// TextStats are lexical statistics of a file or a collection of files.
+// Symbols (補助記号) and white space (空白) are not counted as tokens.
+type TextStats struct {
+	Files              int                `json:"files"`
+	Tokens             int                `json:"tokens"`
+	Types              int                `json:"types"` // distinct lemmas
+	Sentences          int                `json:"sentences"`
+	TTR                float64            `json:"ttr"`
+	MATTR              float64            `json:"mattr"`
+	YuleK              float64            `json:"yuleK"`
+	MeanSentenceLength float64            `json:"meanSentenceLength"` // tokens
+	Pos                map[string]float64 `json:"pos"`                // pos1 ratios
+	Goshu              map[string]float64 `json:"goshu"`              // 和, 漢, 外, 混, 固... ratios
+	Script             map[string]float64 `json:"script"`             // ratios of characters
+}
+
+// textCounts accumulate what TextStats are computed from
+type textCounts struct {
+	files     int
+	tokens    int
+	sentences int
+	freq      map[string]int
+	pos       map[string]int
+	goshu     map[string]int
+	script    map[string]int
+	chars     int
+	mattr     float64 // sum of the TTRs of all windows
+	windows   int
+}
+
+func newTextCounts() *textCounts {
+	return &textCounts{
+		freq:   map[string]int{},
+		pos:    map[string]int{},
+		goshu:  map[string]int{},
+		script: map[string]int{},
+	}
+}
+
+// isToken reports whether n counts as a token
+func isToken(n MecabNode) bool {
+	return n.Features.Pos1 != "補助記号" && n.Features.Pos1 != "空白"
+}
+
+// scriptOf classifies a character as kanji, hiragana, katakana or other
+func scriptOf(r rune) string {
+	switch {
+	case unicode.Is(unicode.Han, r) || r == '々' || r == '〆':
+		return "kanji"
+	case unicode.Is(unicode.Hiragana, r):
+		return "hiragana"
+	case unicode.Is(unicode.Katakana, r) || r == 'ー':
+		return "katakana"
+	}
+	return "other"
+}
+
+// add counts the sentences of a file with MATTR over window tokens
+func (tc *textCounts) add(sentences [][]MecabNode, window int) {
+	tc.files++
+	var types []string
+	for _, sentence := range sentences {
+		n := 0
+		for _, node := range sentence {
+			if !isToken(node) {
+				continue
+			}
+			n++
+			typ := node.Features.Lemma
+			if typ == "" {
+				typ = node.Surface
+			}
+			types = append(types, typ)
+			tc.freq[typ]++
+			tc.pos[node.Features.Pos1]++
+			if node.Features.Goshu != "" {
+				tc.goshu[node.Features.Goshu]++
+			}
+			for _, r := range node.Surface {
+				tc.script[scriptOf(r)]++
+				tc.chars++
+			}
+		}
+		if n > 0 {
+			tc.tokens += n
+			tc.sentences++
+		}
+	}
+
+	if len(types) == 0 {
+		return
+	}
+	if window <= 0 || window > len(types) {
+		window = len(types)
+	}
+	inWindow := map[string]int{}
+	for i, typ := range types {
+		inWindow[typ]++
+		if i >= window {
+			old := types[i-window]
+			if inWindow[old]--; inWindow[old] == 0 {
+				delete(inWindow, old)
+			}
+		}
+		if i >= window-1 {
+			tc.mattr += float64(len(inWindow)) / float64(window)
+			tc.windows++
+		}
+	}
+}
+
+func (tc *textCounts) merge(o *textCounts) {
+	tc.files += o.files
+	tc.tokens += o.tokens
+	tc.sentences += o.sentences
+	tc.chars += o.chars
+	tc.mattr += o.mattr
+	tc.windows += o.windows
+	for _, m := range []struct{ to, from map[string]int }{
+		{tc.freq, o.freq}, {tc.pos, o.pos}, {tc.goshu, o.goshu}, {tc.script, o.script},
+	} {
+		for k, v := range m.from {
+			m.to[k] += v
+		}
+	}
+}
+
+func (tc *textCounts) stats() TextStats {
+	ratios := func(m map[string]int, total int) map[string]float64 {
+		res := make(map[string]float64, len(m))
+		for k, v := range m {
+			res[k] = float64(v) / float64(total)
+		}
+		return res
+	}
+	s := TextStats{
+		Files:     tc.files,
+		Tokens:    tc.tokens,
+		Types:     len(tc.freq),
+		Sentences: tc.sentences,
+		Pos:       ratios(tc.pos, tc.tokens),
+		Goshu:     ratios(tc.goshu, tc.tokens),
+		Script:    ratios(tc.script, tc.chars),
+	}
+	if tc.tokens == 0 {
+		return s
+	}
+	n := float64(tc.tokens)
+	s.TTR = float64(s.Types) / n
+	if tc.windows > 0 {
+		s.MATTR = tc.mattr / float64(tc.windows)
+	}
+	// Yule's K = 10^4 * (Σ f² - N) / N²
+	var sum float64
+	for _, f := range tc.freq {
+		sum += float64(f) * float64(f)
+	}
+	s.YuleK = 1e4 * (sum - n) / (n * n)
+	if tc.sentences > 0 {
+		s.MeanSentenceLength = n / float64(tc.sentences)
+	}
+	return s
+}
+
+func mattrWindow(c echo.Context) (int, error) {
+	if s := c.QueryParam("window"); s != "" {
+		return strconv.Atoi(s)
+	}
+	return DEFAULT_MATTR_WINDOW, nil
+}
+
+// countFile analyses a stored file with corrections merged
+func (h *MecabHandler) countFile(f *File, window int) (*textCounts, error) {
+	a, err := h.analyzeStored(f)
+	if err != nil {
+		return nil, err
+	}
+	tc := newTextCounts()
+	tc.add(splitSentences(a.Source, a.Nodes), window)
+	return tc, nil
+}
+
+// GET
+
+// GetFileStats returns the lexical statistics of a file; ?window= is the
+// MATTR window
+func (h *MecabHandler) GetFileStats(c echo.Context) error {
+	window, err := mattrWindow(c)
+	if err != nil {
+		return badRequest(c, "atoi", err)
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return badRequest(c, "atoi", err)
+	}
+	obj, err := h.Db.DbMap.Get(File{}, id)
+	if err != nil {
+		return badRequest(c, "getfile", err)
+	}
+	if obj == nil {
+		return notFound(c, "getfile", c.Param("id"))
+	}
+	tc, err := h.countFile(obj.(*File), window)
+	if err != nil {
+		return badRequest(c, "analyze", err)
+	}
+	return c.JSON(http.StatusOK, tc.stats())
+}
+
+// GetFilesStats aggregates the statistics of the files of ?files= and
+// ?genre= in total and per genre
+func (h *MecabHandler) GetFilesStats(c echo.Context) error {
+	window, err := mattrWindow(c)
+	if err != nil {
+		return badRequest(c, "atoi", err)
+	}
+	files, err := h.corpusFiles(c, true)
+	if err != nil {
+		return badRequest(c, "corpusfiles", err)
+	}
+
+	type fileStats struct {
+		ID    int       `json:"id"`
+		Name  string    `json:"name"`
+		Genre string    `json:"genre"`
+		Stats TextStats `json:"stats"`
+	}
+	var (
+		total  = newTextCounts()
+		genres = map[string]*textCounts{}
+		res    = []fileStats{}
+	)
+	for _, f := range files {
+		tc, err := h.countFile(&f, window)
+		if err != nil {
+			return badRequest(c, "analyze", fmt.Errorf("%d: %s", f.Id, err))
+		}
+		res = append(res, fileStats{f.Id, f.Name, f.Genre, tc.stats()})
+		total.merge(tc)
+		if genres[f.Genre] == nil {
+			genres[f.Genre] = newTextCounts()
+		}
+		genres[f.Genre].merge(tc)
+	}
+	genreStats := map[string]TextStats{}
+	for g, tc := range genres {
+		genreStats[g] = tc.stats()
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"total":  total.stats(),
+		"genres": genreStats,
+		"files":  res,
+	})
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTextStats(t *testing.T) {
+	node := func(surface, pos1, lemma, goshu string) MecabNode {
+		return MecabNode{Surface: surface, Features: NodeFeatures{
+			Pos1: pos1, Lemma: lemma, Goshu: goshu}}
+	}
+	sentences := [][]MecabNode{
+		{
+			node("花", "名詞", "花", "和"), node("が", "助詞", "が", "和"),
+			node("咲く", "動詞", "咲く", "和"), node("。", "補助記号", "。", "記号"),
+		},
+		{node("花", "名詞", "花", "和"), node("見物", "名詞", "見物", "漢")},
+	}
+	tc := newTextCounts()
+	tc.add(sentences, 2)
+	s := tc.stats()
+
+	assert.Equal(t, 5, s.Tokens)
+	assert.Equal(t, 4, s.Types)
+	assert.Equal(t, 2, s.Sentences)
+	assert.InDelta(t, 0.8, s.TTR, 1e-9)
+	assert.InDelta(t, 1.0, s.MATTR, 1e-9) // every window of 2 differs
+	assert.InDelta(t, 1e4*(7-5)/25.0, s.YuleK, 1e-9)
+	assert.InDelta(t, 2.5, s.MeanSentenceLength, 1e-9)
+	assert.InDelta(t, 0.6, s.Pos["名詞"], 1e-9)
+	assert.InDelta(t, 0.8, s.Goshu["和"], 1e-9)
+	assert.InDelta(t, 5.0/7, s.Script["kanji"], 1e-9)
+
+	total := newTextCounts()
+	total.merge(tc)
+	total.merge(tc)
+	assert.Equal(t, 2, total.stats().Files)
+	assert.Equal(t, 10, total.stats().Tokens)
+	assert.Equal(t, 4, total.stats().Types)
+}
@@ -0,0 +1,510 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// TopicOptions configure the training of a topic model
+type TopicOptions struct {
+	Topics     int      `yaml:"topics" json:"topics"`
+	Iterations int      `yaml:"iterations" json:"iterations"`
+	Alpha      float64  `yaml:"alpha" json:"alpha"` // 0 means 50 / topics
+	Beta       float64  `yaml:"beta" json:"beta"`
+	Words      int      `yaml:"words" json:"words"` // top lemmas kept per topic
+	Pos        []string `yaml:"pos" json:"pos"`     // as in KeywordOptions
+	Stop       []string `yaml:"stop" json:"stop"`   // stop lemmas
+	Seed       int64    `yaml:"seed" json:"seed"`   // 0 means random
+	Runs       int      `yaml:"runs" json:"-"`      // models trained at once
+}
+
+const (
+	TOPIC_RUNNING = "running"
+	TOPIC_DONE    = "done"
+	TOPIC_FAILED  = "failed"
+
+	DEFAULT_TOPIC_RUNS = 2
+)
+
+// topicTraining is a run being trained, stopped by cancel
+type topicTraining struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// SetTopicRuns limits the number of topic models trained at once
+func (h *MecabHandler) SetTopicRuns(n int) {
+	if n <= 0 {
+		n = DEFAULT_TOPIC_RUNS
+	}
+	h.topicSlots = make(chan struct{}, n)
+}
+
+// stopTopicRun cancels the training of a run and waits for it to end
+func (h *MecabHandler) stopTopicRun(id int) {
+	if t, ok := h.topicTrainings.Load(id); ok {
+		t.(*topicTraining).cancel()
+		<-t.(*topicTraining).done
+	}
+}
+
+// TopicRun is a trained, or training, topic model
+type TopicRun struct {
+	Id         int          `db:"id,primarykey,autoincrement" json:"id"`
+	Status     string       `db:"status,notnull" json:"status"`
+	Error      string       `db:"error" json:"error,omitempty"`
+	Options    TopicOptions `db:"options,notnull" json:"options"`
+	Files      int          `db:"files" json:"files"`
+	Vocabulary int          `db:"vocabulary" json:"vocabulary"`
+	Topics     Topics       `db:"topics" json:"topics"`
+	Created    time.Time    `db:"created,notnull" json:"created"`
+	Updated    time.Time    `db:"updated,notnull" json:"updated"`
+}
+
+// Topic is a topic with its top lemmas and its share of the corpus
+type Topic struct {
+	Index  int         `json:"index"`
+	Weight float64     `json:"weight"`
+	Words  []TopicWord `json:"words"`
+}
+
+type TopicWord struct {
+	Lemma  string  `json:"lemma"`
+	Weight float64 `json:"weight"`
+}
+
+// TopicDoc is the topic distribution of a file in a run
+type TopicDoc struct {
+	RunId  int       `db:"run_id,notnull" json:"runId"`
+	FileId int       `db:"file_id,notnull" json:"fileId"`
+	Dist   TopicDist `db:"dist,notnull" json:"dist"`
+}
+
+type Topics []Topic
+
+type TopicDist []float64
+
+// Value and Scan store TopicOptions, Topics and TopicDist as jsonb
+
+func (o TopicOptions) Value() (driver.Value, error) {
+	return json.Marshal(o)
+}
+
+func (o *TopicOptions) Scan(src interface{}) error {
+	return scanJSON(src, o)
+}
+
+func (ts Topics) Value() (driver.Value, error) {
+	if ts == nil {
+		return "[]", nil
+	}
+	return json.Marshal(ts)
+}
+
+func (ts *Topics) Scan(src interface{}) error {
+	return scanJSON(src, ts)
+}
+
+func (td TopicDist) Value() (driver.Value, error) {
+	if td == nil {
+		return "[]", nil
+	}
+	return json.Marshal(td)
+}
+
+func (td *TopicDist) Scan(src interface{}) error {
+	return scanJSON(src, td)
+}
+
+func scanJSON(src interface{}, v interface{}) error {
+	switch s := src.(type) {
+	case nil:
+		return nil
+	case []byte:
+		return json.Unmarshal(s, v)
+	case string:
+		return json.Unmarshal([]byte(s), v)
+	}
+	return fmt.Errorf("cannot scan %T into %T", src, v)
+}
+
+// topicOptions returns the configured options overridden by the body
+func (h *MecabHandler) topicOptions(c echo.Context) (TopicOptions, error) {
+	opts := TopicOptions{Topics: 20, Iterations: 500, Beta: 0.01, Words: 20}
+	if t := h.Topics; t != nil {
+		// options left out of the configuration keep their default
+		if t.Topics > 0 {
+			opts.Topics = t.Topics
+		}
+		if t.Iterations > 0 {
+			opts.Iterations = t.Iterations
+		}
+		if t.Alpha > 0 {
+			opts.Alpha = t.Alpha
+		}
+		if t.Beta > 0 {
+			opts.Beta = t.Beta
+		}
+		if t.Words > 0 {
+			opts.Words = t.Words
+		}
+		opts.Pos, opts.Stop, opts.Seed, opts.Runs = t.Pos, t.Stop, t.Seed, t.Runs
+	}
+	if c.Request().ContentLength != 0 {
+		if err := c.Bind(&opts); err != nil {
+			return opts, err
+		}
+	}
+	if opts.Topics < 1 {
+		return opts, fmt.Errorf("topics must be positive: %d", opts.Topics)
+	}
+	if opts.Iterations < 1 {
+		return opts, fmt.Errorf("iterations must be positive: %d", opts.Iterations)
+	}
+	if opts.Alpha <= 0 {
+		opts.Alpha = 50 / float64(opts.Topics)
+	}
+	if opts.Beta <= 0 {
+		opts.Beta = 0.01
+	}
+	if opts.Words <= 0 {
+		opts.Words = 20
+	}
+	if opts.Seed == 0 {
+		opts.Seed = time.Now().UnixNano()
+	}
+	return opts, nil
+}
+
+// bagsOfWords turns the lemma counts of files into lists of word ids
+func bagsOfWords(counts []*lemmaCounts, stop []string) ([][]int, []string) {
+	stopped := map[string]bool{}
+	for _, s := range stop {
+		stopped[s] = true
+	}
+	ids := map[string]int{}
+	var vocab []string
+	docs := make([][]int, len(counts))
+	for d, lc := range counts {
+		lemmas := make([]string, 0, len(lc.Counts))
+		for lemma := range lc.Counts {
+			if !stopped[lemma] {
+				lemmas = append(lemmas, lemma)
+			}
+		}
+		sort.Strings(lemmas)
+		for _, lemma := range lemmas {
+			id, ok := ids[lemma]
+			if !ok {
+				id = len(vocab)
+				ids[lemma] = id
+				vocab = append(vocab, lemma)
+			}
+			for i := 0; i < lc.Counts[lemma]; i++ {
+				docs[d] = append(docs[d], id)
+			}
+		}
+	}
+	return docs, vocab
+}
+
+// topTopics summarizes a model by the top words of each topic
+func topTopics(m *LDA, vocab []string, words int) Topics {
+	ts := make(Topics, m.K)
+	for k := range ts {
+		ts[k].Index = k
+		for _, theta := range m.Theta {
+			ts[k].Weight += theta[k] / float64(len(m.Theta))
+		}
+		ws := make([]TopicWord, len(vocab))
+		for w, lemma := range vocab {
+			ws[w] = TopicWord{lemma, m.Phi[k][w]}
+		}
+		sort.Slice(ws, func(i, j int) bool { return ws[i].Weight > ws[j].Weight })
+		if len(ws) > words {
+			ws = ws[:words]
+		}
+		ts[k].Words = ws
+	}
+	return ts
+}
+
+// trainTopics trains the model of run on files and stores the results
+func (h *MecabHandler) trainTopics(ctx context.Context, run *TopicRun, files []File) error {
+	counts := make([]*lemmaCounts, len(files))
+	for idx := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		lc, err := h.lemmas(&files[idx], run.Options.Pos)
+		if err != nil {
+			return fmt.Errorf("%d: %s", files[idx].Id, err)
+		}
+		counts[idx] = lc
+	}
+	docs, vocab := bagsOfWords(counts, run.Options.Stop)
+	if len(vocab) == 0 {
+		return fmt.Errorf("no lemmas")
+	}
+
+	opts := run.Options
+	m, err := TrainLDA(ctx, docs, len(vocab), opts.Topics,
+		opts.Iterations, opts.Alpha, opts.Beta, rand.New(rand.NewSource(opts.Seed)))
+	if err != nil {
+		return err
+	}
+
+	trans, err := h.Db.DbMap.Begin()
+	if err != nil {
+		return err
+	}
+	for idx, f := range files {
+		if err := trans.Insert(&TopicDoc{run.Id, f.Id, m.Theta[idx]}); err != nil {
+			trans.Rollback()
+			return err
+		}
+	}
+	run.Vocabulary = len(vocab)
+	run.Topics = topTopics(m, vocab, opts.Words)
+	run.Status = TOPIC_DONE
+	run.Updated = time.Now()
+	if _, err := trans.Update(run); err != nil {
+		trans.Rollback()
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		trans.Rollback()
+		return err
+	}
+	return trans.Commit()
+}
+
+// topicSimilarity is the cosine similarity of the top words of two topics
+func topicSimilarity(a, b Topic) float64 {
+	wb := map[string]float64{}
+	var na, nb, dot float64
+	for _, w := range b.Words {
+		wb[w.Lemma] = w.Weight
+		nb += w.Weight * w.Weight
+	}
+	for _, w := range a.Words {
+		na += w.Weight * w.Weight
+		dot += w.Weight * wb[w.Lemma]
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / math.Sqrt(na*nb)
+}
+
+func (h *MecabHandler) getTopicRun(c echo.Context, param string) (*TopicRun, error) {
+	id, err := strconv.Atoi(c.Param(param))
+	if err != nil {
+		return nil, badRequest(c, "atoi", err)
+	}
+	obj, err := h.Db.DbMap.Get(TopicRun{}, id)
+	if err != nil {
+		return nil, badRequest(c, "gettopicrun", err)
+	}
+	if obj == nil {
+		return nil, notFound(c, "gettopicrun", c.Param(param))
+	}
+	return obj.(*TopicRun), nil
+}
+
+// GET
+func (h *MecabHandler) GetAllTopicRuns(c echo.Context) error {
+	var runs []TopicRun
+	_, err := h.Db.DbMap.Select(&runs, "SELECT * FROM topic_runs ORDER BY id")
+	if err != nil {
+		return badRequest(c, "selecttopicruns", err)
+	}
+	return c.JSON(http.StatusOK, runs)
+}
+
+func (h *MecabHandler) GetTopicRun(c echo.Context) error {
+	run, err := h.getTopicRun(c, "id")
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, run)
+}
+
+// GetTopicRunFiles returns the topic distribution of each file of a run
+func (h *MecabHandler) GetTopicRunFiles(c echo.Context) error {
+	run, err := h.getTopicRun(c, "id")
+	if err != nil {
+		return err
+	}
+	type topicFile struct {
+		FileId int       `db:"file_id" json:"fileId"`
+		Name   string    `db:"name" json:"name"`
+		Genre  string    `db:"genre" json:"genre"`
+		Dist   TopicDist `db:"dist" json:"dist"`
+	}
+	var res []topicFile
+	_, err = h.Db.DbMap.Select(&res,
+		"SELECT d.file_id, f.name, f.genre, d.dist FROM topic_docs d "+
+			"JOIN files f ON f.id = d.file_id WHERE d.run_id = $1 ORDER BY d.file_id",
+		run.Id)
+	if err != nil {
+		return badRequest(c, "selecttopicdocs", err)
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// GetTopicRunCompare matches each topic of a run with the most similar
+// topic of the run :other
+func (h *MecabHandler) GetTopicRunCompare(c echo.Context) error {
+	a, err := h.getTopicRun(c, "id")
+	if err != nil {
+		return err
+	}
+	b, err := h.getTopicRun(c, "other")
+	if err != nil {
+		return err
+	}
+
+	type match struct {
+		A          int     `json:"a"`
+		B          int     `json:"b"`
+		Similarity float64 `json:"similarity"`
+	}
+	matrix := make([][]float64, len(a.Topics))
+	matches := []match{}
+	for i, ta := range a.Topics {
+		matrix[i] = make([]float64, len(b.Topics))
+		best := match{A: ta.Index, B: -1}
+		for j, tb := range b.Topics {
+			matrix[i][j] = topicSimilarity(ta, tb)
+			if best.B < 0 || matrix[i][j] > best.Similarity {
+				best.B, best.Similarity = tb.Index, matrix[i][j]
+			}
+		}
+		matches = append(matches, best)
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"a":       a.Id,
+		"b":       b.Id,
+		"matches": matches,
+		"matrix":  matrix,
+	})
+}
+
+// POST
+
+// PostTopicRun starts training a topic model on the files of ?files= and
+// ?genre=, or all files, with the options of the body
+func (h *MecabHandler) PostTopicRun(c echo.Context) error {
+	opts, err := h.topicOptions(c)
+	if err != nil {
+		return badRequest(c, "bind", err)
+	}
+	files, err := h.corpusFiles(c, true)
+	if err != nil {
+		return badRequest(c, "corpusfiles", err)
+	}
+	if len(files) == 0 {
+		return badRequest(c, "corpusfiles", fmt.Errorf("no files"))
+	}
+
+	if h.topicSlots != nil {
+		select {
+		case h.topicSlots <- struct{}{}:
+		default:
+			c.Logger().Errorf("%d:topicruns:%d running", http.StatusTooManyRequests, cap(h.topicSlots))
+			return newHTTPError(http.StatusTooManyRequests, "topicruns",
+				fmt.Sprintf("%d runs training already", cap(h.topicSlots)))
+		}
+	}
+	release := func() {
+		if h.topicSlots != nil {
+			<-h.topicSlots
+		}
+	}
+
+	now := time.Now()
+	run := &TopicRun{
+		Status:  TOPIC_RUNNING,
+		Options: opts,
+		Files:   len(files),
+		Topics:  Topics{},
+		Created: now,
+		Updated: now,
+	}
+	if err := h.Db.DbMap.Insert(run); err != nil {
+		release()
+		return badRequest(c, "insert", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &topicTraining{cancel: cancel, done: make(chan struct{})}
+	h.topicTrainings.Store(run.Id, t)
+	logger := c.Logger()
+	go func(run TopicRun) {
+		defer func() {
+			cancel()
+			h.topicTrainings.Delete(run.Id)
+			close(t.done)
+			release()
+		}()
+		if err := h.trainTopics(ctx, &run, files); err != nil {
+			if ctx.Err() != nil {
+				// deleted, or the server is stopping
+				logger.Infof("cancelled: topics: %d", run.Id)
+				return
+			}
+			logger.Errorf("topics: %d: %s", run.Id, err)
+			run.Status = TOPIC_FAILED
+			run.Error = err.Error()
+			run.Updated = time.Now()
+			if _, err := h.Db.DbMap.Update(&run); err != nil {
+				logger.Errorf("topics: %d: %s", run.Id, err)
+			}
+			return
+		}
+		logger.Infof("trained: topics: %d", run.Id)
+	}(*run)
+
+	c.Logger().Infof("added: topic_runs: %d", run.Id)
+	return c.JSON(http.StatusAccepted, run)
+}
+
+// DELETE
+func (h *MecabHandler) DeleteTopicRun(c echo.Context) error {
+	run, err := h.getTopicRun(c, "id")
+	if err != nil {
+		return err
+	}
+	// a run still training is cancelled
+	h.stopTopicRun(run.Id)
+
+	trans, err := h.Db.DbMap.Begin()
+	if err != nil {
+		return badRequest(c, "trans", err)
+	}
+	if _, err = trans.Exec("DELETE FROM topic_docs WHERE run_id = $1", run.Id); err != nil {
+		trans.Rollback()
+		return badRequest(c, "deletetopicrun", err)
+	}
+	if _, err = trans.Delete(run); err != nil {
+		trans.Rollback()
+		return badRequest(c, "deletetopicrun", err)
+	}
+	if err = trans.Commit(); err != nil {
+		return badRequest(c, "trans", err)
+	}
+
+	c.Logger().Infof("deleted: topic_runs: %d", run.Id)
+	return c.JSON(http.StatusOK, map[string]int{"id": run.Id})
+}
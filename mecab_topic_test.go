@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrainLDA(t *testing.T) {
+	// words 0-2 and 3-5 never occur together
+	docs := [][]int{
+		{0, 1, 2, 0, 1, 2, 0, 1},
+		{3, 4, 5, 3, 4, 5, 3, 4},
+		{0, 0, 1, 2, 2, 1, 0, 2},
+		{5, 5, 4, 3, 3, 4, 5, 3},
+	}
+	m, err := TrainLDA(context.Background(), docs, 6, 2, 200, 0.1, 0.01, rand.New(rand.NewSource(1)))
+	assert.Nil(t, err)
+
+	top := func(dist []float64) int {
+		best := 0
+		for k, p := range dist {
+			if p > dist[best] {
+				best = k
+			}
+		}
+		return best
+	}
+	assert.Equal(t, top(m.Theta[0]), top(m.Theta[2]))
+	assert.Equal(t, top(m.Theta[1]), top(m.Theta[3]))
+	assert.NotEqual(t, top(m.Theta[0]), top(m.Theta[1]))
+
+	k := top(m.Theta[0])
+	assert.Greater(t, m.Phi[k][0], m.Phi[k][3])
+	var sum float64
+	for _, p := range m.Phi[k] {
+		sum += p
+	}
+	assert.InDelta(t, 1, sum, 1e-9)
+}
+
+func TestBagsOfWords(t *testing.T) {
+	docs, vocab := bagsOfWords([]*lemmaCounts{
+		{Counts: map[string]int{"桜": 2, "為る": 3}},
+		{Counts: map[string]int{"月": 1, "桜": 1}},
+	}, []string{"為る"})
+	assert.Equal(t, []string{"桜", "月"}, vocab)
+	assert.Equal(t, [][]int{{0, 0}, {1, 0}}, docs)
+}
+
+func TestTopicSimilarity(t *testing.T) {
+	a := Topic{Words: []TopicWord{{"桜", 0.6}, {"花", 0.4}}}
+	b := Topic{Words: []TopicWord{{"花", 0.4}, {"桜", 0.6}}}
+	c := Topic{Words: []TopicWord{{"月", 1}}}
+	assert.InDelta(t, 1, topicSimilarity(a, b), 1e-9)
+	assert.InDelta(t, 0, topicSimilarity(a, c), 1e-9)
+}
+
+func TestTopicOptions(t *testing.T) {
+	options := func(h *MecabHandler, body string) TopicOptions {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		opts, err := h.topicOptions(echo.New().NewContext(req, httptest.NewRecorder()))
+		assert.NoError(t, err)
+		return opts
+	}
+
+	// the configuration overrides only the options it gives
+	h := &MecabHandler{Topics: &TopicOptions{Words: 10, Runs: 1}}
+	opts := options(h, "")
+	assert.Equal(t, 20, opts.Topics)
+	assert.Equal(t, 500, opts.Iterations)
+	assert.Equal(t, 10, opts.Words)
+	assert.Equal(t, 1, opts.Runs)
+	assert.InDelta(t, 2.5, opts.Alpha, 1e-9)
+
+	// and the body the configuration
+	opts = options(h, `{"topics": 5, "iterations": 50}`)
+	assert.Equal(t, 5, opts.Topics)
+	assert.Equal(t, 50, opts.Iterations)
+	assert.Equal(t, 10, opts.Words)
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/websocket"
+)
+
+// liveRequest is a revision of the text sent by an editor: either the
+// whole text or a diff replacing [start, end) of the previous revision.
+type liveRequest struct {
+	Rev  int       `json:"rev"`
+	Text *string   `json:"text,omitempty"`
+	Diff *liveDiff `json:"diff,omitempty"`
+}
+
+type liveDiff struct {
+	Start int    `json:"start"` // in the unit of the session
+	End   int    `json:"end"`
+	Text  string `json:"text"`
+}
+
+// liveAnalysis is the analysis of one sentence; node offsets are relative
+// to the start of the sentence.
+type liveAnalysis struct {
+	Index int         `json:"index"`
+	Nodes []MecabNode `json:"nodes"`
+}
+
+// liveResponse lists every sentence of a revision but only analyses the
+// sentences whose text was not in the previous revision.
+type liveResponse struct {
+	Rev       int            `json:"rev"`
+	Unit      string         `json:"unit"`
+	Sentences []OffsetRange  `json:"sentences"`
+	Analyses  []liveAnalysis `json:"analyses"`
+	Error     string         `json:"error,omitempty"`
+}
+
+// liveSession keeps the text of an editor and the analyses of its
+// sentences between revisions
+type liveSession struct {
+	h      *MecabHandler
+	d      *MecabDict
+	unit   string
+	text   string
+	rev    int // of text, -1 before the first message
+	cancel context.CancelFunc
+
+	mu    sync.Mutex // guards cache and ws writes
+	ws    *websocket.Conn
+	cache map[string][]MecabNode
+}
+
+// liveSentences splits text after sentence-final punctuation and
+// newlines; the ranges are in bytes and cover the whole text.
+func liveSentences(text string) []OffsetRange {
+	var res []OffsetRange
+	start := 0
+	for i := 0; i < len(text); {
+		r, size := utf8.DecodeRuneInString(text[i:])
+		i += size
+		if !strings.ContainsRune("。．！？!?\n", r) {
+			continue
+		}
+		// keep closing brackets and repeated marks with the sentence
+		for i < len(text) {
+			r, size := utf8.DecodeRuneInString(text[i:])
+			if !strings.ContainsRune("。．！？!?」』）)】〉》", r) {
+				break
+			}
+			i += size
+		}
+		res = append(res, OffsetRange{start, i})
+		start = i
+	}
+	if start < len(text) {
+		res = append(res, OffsetRange{start, len(text)})
+	}
+	return res
+}
+
+// unitOffset converts the byte offset pos of s into unit
+func unitOffset(s string, pos int, unit string) int {
+	oc := &offsetCounter{doc: s}
+	runes, units := oc.count(pos)
+	switch unit {
+	case OFFSET_UNIT_UTF16:
+		return units
+	case OFFSET_UNIT_BYTE:
+		return pos
+	}
+	return runes
+}
+
+// byteOffset converts the offset pos in unit of s into bytes
+func byteOffset(s string, pos int, unit string) (int, error) {
+	if pos < 0 {
+		return 0, fmt.Errorf("offset out of range: %d", pos)
+	}
+	if unit == OFFSET_UNIT_BYTE {
+		if pos > len(s) || (pos < len(s) && !utf8.RuneStart(s[pos])) {
+			return 0, fmt.Errorf("offset out of range: %d", pos)
+		}
+		return pos, nil
+	}
+	n := 0
+	for i, r := range s {
+		if n == pos {
+			return i, nil
+		}
+		if n > pos {
+			break
+		}
+		n++
+		if unit == OFFSET_UNIT_UTF16 && r >= 0x10000 {
+			n++
+		}
+	}
+	if n == pos {
+		return len(s), nil
+	}
+	return 0, fmt.Errorf("offset out of range: %d", pos)
+}
+
+// newer tells whether req comes after the revision of the text; messages
+// delivered out of order are dropped rather than applied to a newer text
+func (s *liveSession) newer(req *liveRequest) bool {
+	return req.Rev > s.rev
+}
+
+// apply updates the text of the session with req
+func (s *liveSession) apply(req *liveRequest) error {
+	switch {
+	case req.Text != nil:
+		s.text = *req.Text
+	case req.Diff != nil:
+		start, err := byteOffset(s.text, req.Diff.Start, s.unit)
+		if err != nil {
+			return err
+		}
+		end, err := byteOffset(s.text, req.Diff.End, s.unit)
+		if err != nil {
+			return err
+		}
+		if start > end {
+			return fmt.Errorf("diff: start > end")
+		}
+		s.text = s.text[:start] + req.Diff.Text + s.text[end:]
+	default:
+		return fmt.Errorf("neither text nor diff")
+	}
+	s.rev = req.Rev
+	return nil
+}
+
+// analyze analyses the sentences of text not cached yet. It gives up as
+// soon as ctx is cancelled by a newer revision.
+func (s *liveSession) analyze(ctx context.Context, rev int, text string) {
+	res := liveResponse{Rev: rev, Unit: s.unit, Analyses: []liveAnalysis{}}
+	spans := liveSentences(text)
+	cache := make(map[string][]MecabNode, len(spans))
+	for idx, sp := range spans {
+		res.Sentences = append(res.Sentences, OffsetRange{
+			unitOffset(text, sp.Start, s.unit),
+			unitOffset(text, sp.End, s.unit),
+		})
+
+		sentence := text[sp.Start:sp.End]
+		s.mu.Lock()
+		nodes, ok := s.cache[sentence]
+		s.mu.Unlock()
+		if !ok {
+			if ctx.Err() != nil {
+				return
+			}
+			st := Normalize(NewPlainSource(sentence), s.h.Normalize, s.h.Variants)
+			var err error
+			if nodes, err = s.h.analyzeWith(ctx, s.d, st, false); err != nil {
+				if ctx.Err() == nil {
+					s.send(ctx, &liveResponse{Rev: rev, Error: err.Error()})
+				}
+				return
+			}
+			res.Analyses = append(res.Analyses, liveAnalysis{idx, nodes})
+		}
+		cache[sentence] = nodes
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ctx.Err() != nil {
+		return
+	}
+	s.cache = cache
+	if err := websocket.JSON.Send(s.ws, res); err != nil {
+		s.ws.Close()
+	}
+}
+
+// send writes res unless its revision is stale
+func (s *liveSession) send(ctx context.Context, res *liveResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ctx.Err() != nil {
+		return
+	}
+	if err := websocket.JSON.Send(s.ws, res); err != nil {
+		s.ws.Close()
+	}
+}
+
+func (s *liveSession) serve() {
+	defer func() {
+		if s.cancel != nil {
+			s.cancel()
+		}
+	}()
+	for {
+		var req liveRequest
+		if err := websocket.JSON.Receive(s.ws, &req); err != nil {
+			return
+		}
+		if !s.newer(&req) {
+			continue
+		}
+		if s.cancel != nil {
+			s.cancel()
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		s.cancel = cancel
+
+		if err := s.apply(&req); err != nil {
+			s.send(ctx, &liveResponse{Rev: req.Rev, Error: err.Error()})
+			continue
+		}
+		go s.analyze(ctx, req.Rev, s.text)
+	}
+}
+
+// GET
+
+// MecabWS analyses the text of an editor as it is typed. Each message
+// carries a revision number and the full text or a diff; the reply lists
+// the sentences of the revision and the analyses of changed sentences.
+// Analyses of a revision are dropped once a newer one arrives, and
+// messages not newer than the last one are ignored.
+func (h *MecabHandler) MecabWS(c echo.Context) error {
+	unit := c.QueryParam("unit")
+	if unit == "" {
+		unit = h.OffsetUnit
+	}
+	if _, err := (NodeOffsets{}).In(unit); err != nil {
+		return badRequest(c, "unit", err)
+	}
+	d, err := h.dict(c.QueryParam("dict"))
+	if err != nil {
+		return badRequest(c, "dict", err)
+	}
+
+	websocket.Handler(func(ws *websocket.Conn) {
+		defer ws.Close()
+		s := &liveSession{
+			h:     h,
+			d:     d,
+			unit:  unit,
+			rev:   -1,
+			ws:    ws,
+			cache: map[string][]MecabNode{},
+		}
+		s.serve()
+	}).ServeHTTP(c.Response(), c.Request())
+	return nil
+}
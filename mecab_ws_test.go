@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLiveSentences(t *testing.T) {
+	text := "春はあけぼの。「やうやう白くなりゆく。」山ぎは\n少し"
+	var got []string
+	for _, sp := range liveSentences(text) {
+		got = append(got, text[sp.Start:sp.End])
+	}
+	assert.Equal(t, []string{
+		"春はあけぼの。",
+		"「やうやう白くなりゆく。」",
+		"山ぎは\n",
+		"少し",
+	}, got)
+}
+
+func TestLiveDiff(t *testing.T) {
+	s := &liveSession{unit: OFFSET_UNIT_UTF16, text: "𠮷野家で食べる"}
+	err := s.apply(&liveRequest{Rev: 2, Diff: &liveDiff{Start: 2, End: 3, Text: "の"}})
+	assert.Nil(t, err)
+	assert.Equal(t, "𠮷の家で食べる", s.text)
+
+	err = s.apply(&liveRequest{Rev: 3, Diff: &liveDiff{Start: 1, End: 2}})
+	assert.NotNil(t, err)
+
+	assert.Equal(t, 2, s.rev, "a failed diff keeps the revision")
+	assert.False(t, s.newer(&liveRequest{Rev: 2}))
+	assert.False(t, s.newer(&liveRequest{Rev: 1}))
+	assert.True(t, s.newer(&liveRequest{Rev: 3}))
+
+	assert.Equal(t, 3, unitOffset(s.text, len("𠮷の"), OFFSET_UNIT_UTF16))
+	assert.Equal(t, 2, unitOffset(s.text, len("𠮷の"), OFFSET_UNIT_CHAR))
+}
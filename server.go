@@ -1,7 +1,10 @@
 package main
 
 import (
+	"fmt"
 	"net/http"
+	"os"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
@@ -19,16 +22,59 @@ func main() {
 		panic(err)
 	}
 
+	// admin commands
+	if len(os.Args) > 1 && os.Args[1] == "fsck" {
+		if err := dbh.FsckCommand(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	mh, err := NewMecabHandler(cfg.Mecab.Dicts)
 	if err != nil {
 		panic(err)
 	}
-	defer mh.Mecab.Destroy()
+	defer mh.Destroy()
+	for name, dicts := range cfg.Mecab.Dictionaries {
+		if err := mh.AddDict(name, dicts...); err != nil {
+			panic(err)
+		}
+	}
+	mh.SetPoolSize(cfg.Mecab.Taggers)
+	mh.Parallel = cfg.Mecab.Parallel
+	mh.ChunkSize = cfg.Mecab.ChunkSize
+	for _, name := range cfg.Mecab.Languages {
+		if _, err := mh.dict(name); err != nil {
+			panic(err)
+		}
+	}
+	mh.Languages = cfg.Mecab.Languages
+	mh.DetectLang = cfg.Mecab.DetectLang
+	if cfg.Mecab.OffsetUnit != "" {
+		if _, err := (NodeOffsets{}).In(cfg.Mecab.OffsetUnit); err != nil {
+			panic(err)
+		}
+		mh.OffsetUnit = cfg.Mecab.OffsetUnit
+	}
+	mh.Rules = &cfg.Mecab.Elements
+	mh.Normalize = &cfg.Mecab.Normalize
+	mh.Keywords = &cfg.Mecab.Keywords
+	mh.Topics = &cfg.Mecab.Topics
+	mh.SetTopicRuns(cfg.Mecab.Topics.Runs)
+	mh.Search = &cfg.Mecab.Search
+	mh.Variants = dbh.Variants
+	mh.Db = dbh
+	dbh.SetIndex(mh)
 
 	e := echo.New()
 	e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
-	e.Use(middleware.CORS())
+	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
+		ExposeHeaders: []string{echo.HeaderLocation, "Tus-Resumable", "Tus-Version",
+			"Tus-Extension", "Tus-Max-Size", "Upload-Offset", "Upload-Length",
+			"Upload-Expires", "Upload-File-Id"},
+	}))
 	e.HTTPErrorHandler = ErrorHandler
 
 	// routes
@@ -38,11 +84,40 @@ func main() {
 	filesApi := api.Group("/files")
 	filesApi.GET("", dbh.GetAllFiles)
 	filesApi.POST("", dbh.CreateFile)
+	filesApi.POST("/validate", dbh.ValidateFile)
+	filesApi.POST("/metadata", dbh.PostFilesMetadata)
 	filesApi.GET("/:id", dbh.GetFile)
 	filesApi.PUT("/:id", dbh.UpdateFile)
 	filesApi.DELETE("/:id", dbh.DeleteFile)
+	filesApi.GET("/:id/revisions", dbh.GetFileRevisions)
+	filesApi.POST("/:id/revisions", dbh.CreateFileRevision)
+	filesApi.GET("/:id/revisions/:rev", dbh.GetFileRevision)
+	filesApi.GET("/:id/revisions/:rev/xml", dbh.GetFileRevisionXML)
+	filesApi.POST("/:id/revisions/:rev/rollback", dbh.RollbackFile)
 	filesApi.GET("/:id/xml", dbh.GetFileXML)
+	filesApi.GET("/:id/diff", dbh.GetFileDiff)
+	filesApi.GET("/:id/query", dbh.GetFileQuery)
+	filesApi.GET("/query", dbh.GetFilesQuery)
 	filesApi.GET("/xmlbyname/:name", dbh.GetFileXMLByName)
+	filesApi.GET("/stats", mh.GetFilesStats)
+	filesApi.GET("/:id/stats", mh.GetFileStats)
+	filesApi.POST("/keywords", mh.PostFilesKeywords)
+	filesApi.GET("/:id/keywords", mh.GetFileKeywords)
+
+	// uploads
+	uploadsApi := api.Group("/uploads")
+	uploadsApi.OPTIONS("", dbh.OptionsUploads)
+	uploadsApi.POST("", dbh.CreateUpload)
+	uploadsApi.GET("/:id", dbh.GetUpload)
+	uploadsApi.HEAD("/:id", dbh.HeadUpload)
+	uploadsApi.PATCH("/:id", dbh.PatchUpload)
+	uploadsApi.DELETE("/:id", dbh.DeleteUpload)
+	go dbh.expireUploads(time.Hour)
+
+	// admin
+	adminApi := api.Group("/admin")
+	adminApi.GET("/fsck", dbh.GetFsck)
+	adminApi.POST("/fsck", dbh.PostFsck)
 
 	// jsonData
 	jsonDataApi := api.Group("/jsonData")
@@ -56,13 +131,52 @@ func main() {
 	entitiesApi := api.Group("/entities")
 	entitiesApi.GET("", dbh.GetAllEntities)
 	entitiesApi.POST("", dbh.CreateEntity)
+	entitiesApi.POST("/bulk", dbh.CreateEntities)
 	entitiesApi.GET("/:id", dbh.GetEntity)
 	entitiesApi.PUT("/:id", dbh.UpdateEntity)
 	entitiesApi.DELETE("/:id", dbh.DeleteEntity)
 
+	// variants
+	variantsApi := api.Group("/variants")
+	variantsApi.GET("", dbh.GetAllVariants)
+	variantsApi.POST("", dbh.CreateVariant)
+	variantsApi.GET("/normalize", dbh.GetNormalized)
+	variantsApi.GET("/:variant", dbh.GetVariant)
+	variantsApi.PUT("/:variant", dbh.UpdateVariant)
+	variantsApi.DELETE("/:variant", dbh.DeleteVariant)
+
+	// corrections
+	correctionsApi := api.Group("/corrections")
+	correctionsApi.GET("", dbh.GetAllCorrections)
+	correctionsApi.POST("", dbh.CreateCorrection)
+	correctionsApi.GET("/:id", dbh.GetCorrection)
+	correctionsApi.PUT("/:id", dbh.UpdateCorrection)
+	correctionsApi.DELETE("/:id", dbh.DeleteCorrection)
+
+	// topics
+	topicsApi := api.Group("/topics")
+	topicsApi.GET("", mh.GetAllTopicRuns)
+	topicsApi.POST("", mh.PostTopicRun)
+	topicsApi.GET("/:id", mh.GetTopicRun)
+	topicsApi.GET("/:id/files", mh.GetTopicRunFiles)
+	topicsApi.GET("/:id/compare/:other", mh.GetTopicRunCompare)
+	topicsApi.DELETE("/:id", mh.DeleteTopicRun)
+
+	// search
+	searchApi := api.Group("/search")
+	searchApi.GET("", mh.GetSearch)
+	searchApi.POST("/reindex", mh.PostSearchReindex)
+
 	// mecab
 	mecabApi := api.Group("/mecab")
 	mecabApi.POST("/convert", mh.PostMecabConvert)
+	mecabApi.GET("/files/:id", mh.GetMecabFile)
+	mecabApi.GET("/corpus", mh.GetMecabCorpus)
+	mecabApi.GET("/corpus/stats", mh.GetMecabCorpusStats)
+	mecabApi.GET("/dicts", mh.GetMecabDicts)
+	mecabApi.POST("/compare", mh.PostMecabCompare)
+	mecabApi.POST("/entities", mh.PostMecabEntities)
+	mecabApi.GET("/ws", mh.MecabWS)
 
 	e.Logger.Fatal(e.Start(":" + cfg.Server.Port))
 }